@@ -1,17 +1,23 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/qiniu/api.v6/conf"
 	"github.com/qiniu/log"
 	"os"
 	"ufop"
 	"ufop/amerge"
+	"ufop/gifanimate"
 	"ufop/html2image"
 	"ufop/html2pdf"
 	"ufop/imagecomp"
 	"ufop/mkzip"
+	"ufop/ossimg"
 	"ufop/roundpic"
+	"ufop/unrar"
 	"ufop/unzip"
 )
 
@@ -20,67 +26,105 @@ const (
 )
 
 func help() {
-	fmt.Printf("Usage: qufop <UfopConfig>\r\n\r\nVERSION: %s\r\n", VERSION)
+	fmt.Printf("Usage: qufop <UfopConfig>\r\n       qufop run [--conf <UfopConfig>] --cmd <cmd> [--src <file>] [--mime <mimetype>] [--out <file>]\r\n\r\nVERSION: %s\r\n", VERSION)
 }
 
 func setQiniuHosts() {
 	conf.RS_HOST = "http://rs.qiniu.com"
 }
 
-func main() {
-	log.SetOutput(os.Stdout)
-	setQiniuHosts()
-
-	args := os.Args
-	argc := len(args)
-
-	var configFilePath string
-
-	switch argc {
-	case 2:
-		configFilePath = args[1]
-	default:
-		help()
-		return
-	}
-
+func newServer(configFilePath string) (ufopServ *ufop.UfopServer, err error) {
 	//load config
 	ufopConf := &ufop.UfopConfig{}
-	confErr := ufopConf.LoadFromFile(configFilePath)
-	if confErr != nil {
-		log.Error("load config file error,", confErr)
+	if err = ufopConf.LoadFromFile(configFilePath); err != nil {
+		err = errors.New(fmt.Sprintf("load config file error, %s", err.Error()))
 		return
 	}
 
-	ufopServ := ufop.NewServer(ufopConf)
+	ufopServ = ufop.NewServer(ufopConf)
+
+	//register the job handlers enabled in the config
+	err = ufopServ.RegisterJobHandlers(
+		&amerge.AudioMerger{},
+		&html2image.Html2Imager{},
+		&html2pdf.Html2Pdfer{},
+		&mkzip.Mkzipper{},
+		&unzip.Unzipper{},
+		&unrar.Unrarer{},
+		&imagecomp.ImageComposer{},
+		&roundpic.RoundPicer{},
+		&gifanimate.GifAnimater{},
+		&ossimg.OSSImager{},
+	)
+	return
+}
 
-	//register job handlers
-	if err := ufopServ.RegisterJobHandler("amerge.conf", &amerge.AudioMerger{}); err != nil {
-		log.Error(err)
+//run a fop on the local file without the http server, for debugging
+func run(args []string) {
+	//the result may be written to stdout
+	log.SetOutput(os.Stderr)
+
+	runFlags := flag.NewFlagSet("run", flag.ExitOnError)
+	configFilePath := runFlags.String("conf", "qufop.conf", "ufop config file")
+	cmd := runFlags.String("cmd", "", "fop command, like roundpic/radius/20")
+	srcFile := runFlags.String("src", "", "local file used as the src of the fop")
+	srcMimeType := runFlags.String("mime", "", "mimetype of the src file, detected if not set")
+	outFile := runFlags.String("out", "-", "file to save the result, '-' for stdout")
+	runFlags.Parse(args)
+
+	if *cmd == "" {
+		runFlags.Usage()
+		os.Exit(2)
 	}
 
-	if err := ufopServ.RegisterJobHandler("html2image.conf", &html2image.Html2Imager{}); err != nil {
-		log.Error(err)
+	ufopServ, servErr := newServer(*configFilePath)
+	if servErr != nil {
+		log.Error(servErr)
+		os.Exit(1)
 	}
 
-	if err := ufopServ.RegisterJobHandler("html2pdf.conf", &html2pdf.Html2Pdfer{}); err != nil {
-		log.Error(err)
+	runErr := ufopServ.Run(ufop.UfopRunOptions{
+		Cmd:         *cmd,
+		SrcFile:     *srcFile,
+		SrcMimeType: *srcMimeType,
+		OutFile:     *outFile,
+	})
+	if runErr != nil {
+		//show the details like the stderr of the converter for debugging
+		ufopErr := ufop.ToUfopError(runErr)
+		log.Error(fmt.Sprintf("%s, %s", ufopErr.Code, ufopErr.Message))
+		if len(ufopErr.Details) > 0 {
+			details, _ := json.MarshalIndent(ufopErr.Details, "", "    ")
+			log.Error(string(details))
+		}
+		os.Exit(1)
 	}
+}
 
-	if err := ufopServ.RegisterJobHandler("mkzip.conf", &mkzip.Mkzipper{}); err != nil {
-		log.Error(err)
-	}
+func main() {
+	log.SetOutput(os.Stdout)
+	setQiniuHosts()
 
-	if err := ufopServ.RegisterJobHandler("unzip.conf", &unzip.Unzipper{}); err != nil {
-		log.Error(err)
-	}
+	args := os.Args
+	argc := len(args)
 
-	if err := ufopServ.RegisterJobHandler("imagecomp.conf", &imagecomp.ImageComposer{}); err != nil {
-		log.Error(err)
+	var configFilePath string
+
+	switch {
+	case argc >= 2 && args[1] == "run":
+		run(args[2:])
+		return
+	case argc == 2:
+		configFilePath = args[1]
+	default:
+		help()
+		return
 	}
 
-	if err := ufopServ.RegisterJobHandler("roundpic.conf", &roundpic.RoundPicer{}); err != nil {
-		log.Error(err)
+	ufopServ, servErr := newServer(configFilePath)
+	if servErr != nil {
+		log.Error(servErr)
+		os.Exit(1)
 	}
 
 	//listen
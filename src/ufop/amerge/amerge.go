@@ -1,6 +1,7 @@
 package amerge
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,13 +10,13 @@ import (
 	"github.com/qiniu/log"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
-	"regexp"
 	"strings"
+	"time"
 	"ufop"
+	"ufop/cmdspec"
 	"ufop/utils"
 )
 
@@ -30,6 +31,14 @@ type AudioMerger struct {
 	maxSecondFileLength uint64
 }
 
+type AudioMergeOptions struct {
+	Format   string `cmd:"format"`
+	Mime     string `cmd:"mime"`
+	Bucket   string `cmd:"bucket"`
+	Url      string `cmd:"url"`
+	Duration string `cmd:"duration"`
+}
+
 type AudioMergerConfig struct {
 	//ak & sk
 	AccessKey string `json:"access_key"`
@@ -75,6 +84,21 @@ func (this *AudioMerger) InitConfig(jobConf string) (err error) {
 	return
 }
 
+func (this *AudioMerger) Syntax() string {
+	return amergeSpec.Syntax()
+}
+
+func (this *AudioMerger) Limits() map[string]interface{} {
+	return map[string]interface{}{
+		"amerge_max_first_file_length":  this.maxFirstFileLength,
+		"amerge_max_second_file_length": this.maxSecondFileLength,
+	}
+}
+
+func (this *AudioMerger) CheckReady() error {
+	return utils.CheckCommands("ffmpeg")
+}
+
 /*
 
 amerge
@@ -86,39 +110,31 @@ amerge
 
 */
 
-func (this *AudioMerger) parse(cmd string) (format string, mime string, bucket string, url string, duration string, err error) {
-	pattern := "^amerge/format/[a-zA-Z0-9]+/mime/[0-9a-zA-Z-_=]+/bucket/[0-9a-zA-Z-_=]+/url/[0-9a-zA-Z-_=]+(/duration/(first|shortest|longest)){0,1}$"
-	matched, _ := regexp.MatchString(pattern, cmd)
-	if !matched {
-		err = errors.New("invalid amerge command format")
-		return
-	}
+var amergeSpec = cmdspec.Spec{
+	Name: "amerge",
+	Params: []cmdspec.Param{
+		{Name: "format", Type: cmdspec.PARAM_STRING, Required: true, Pattern: "^[a-zA-Z0-9]+$"},
+		{Name: "mime", Type: cmdspec.PARAM_BASE64, Required: true},
+		{Name: "bucket", Type: cmdspec.PARAM_BASE64, Required: true},
+		{Name: "url", Type: cmdspec.PARAM_BASE64, Required: true},
+		{Name: "duration", Type: cmdspec.PARAM_ENUM, Values: []string{"first", "shortest", "longest"}, Default: "longest"},
+	},
+}
 
-	var decodeErr error
-	format = utils.GetParam(cmd, "format/[a-zA-Z0-9]+", "format")
-	mime, decodeErr = utils.GetParamDecoded(cmd, "mime/[0-9a-zA-Z-_=]+", "mime")
-	if decodeErr != nil {
-		err = errors.New("invalid amerge parameter 'mime'")
-		return
-	}
-	bucket, decodeErr = utils.GetParamDecoded(cmd, "bucket/[0-9a-zA-Z-_=]+", "bucket")
-	if decodeErr != nil {
-		err = errors.New("invalid amerge parameter 'bucket'")
-		return
-	}
-	url, decodeErr = utils.GetParamDecoded(cmd, "url/[0-9a-zA-Z-_=]+", "url")
-	if decodeErr != nil {
-		err = errors.New("invalid amerge parameter 'url'")
+func (this *AudioMerger) parse(cmd string) (format string, mime string, bucket string, url string, duration string, err error) {
+	options := AudioMergeOptions{}
+	if err = amergeSpec.Parse(cmd, &options); err != nil {
 		return
 	}
-	duration = utils.GetParam(cmd, "duration/(first|shortest|longest)", "duration")
-	if duration == "" {
-		duration = "longest"
-	}
+	format = options.Format
+	mime = options.Mime
+	bucket = options.Bucket
+	url = options.Url
+	duration = options.Duration
 	return
 }
 
-func (this *AudioMerger) Do(req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
+func (this *AudioMerger) DoContext(ctx context.Context, req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
 	//parse command
 	dstFormat, dstMime, secondFileBucket, secondFileUrl, dstDuration, pErr := this.parse(req.Cmd)
 	if pErr != nil {
@@ -128,42 +144,44 @@ func (this *AudioMerger) Do(req ufop.UfopRequest) (result interface{}, resultTyp
 
 	//check first file
 	if req.Src.Fsize > this.maxFirstFileLength {
-		err = errors.New("first file length exceeds the limit")
+		err = ufop.NewUfopError(ufop.E_SRC_TOO_LARGE, "first file length exceeds the limit").
+			WithDetail("limit", this.maxFirstFileLength)
 		return
 	}
 	if !strings.HasPrefix(req.Src.MimeType, "audio/") {
-		err = errors.New("first file mimetype not supported")
+		err = ufop.NewUfopError(ufop.E_SRC_UNSUPPORTED, "first file mimetype not supported")
 		return
 	}
 
 	secondFileUri, pErr := url.Parse(secondFileUrl)
 	if pErr != nil {
-		err = errors.New("second file resource url not valid")
+		err = ufop.NewUfopError(ufop.E_BAD_PARAM, "second file resource url not valid")
 		return
 	}
 	secondFileKey := strings.TrimPrefix(secondFileUri.Path, "/")
 	client := rs.New(this.mac)
 	sEntry, sErr := client.Stat(nil, secondFileBucket, secondFileKey)
 	if sErr != nil || sEntry.Hash == "" {
-		err = errors.New("second file not in the specified bucket")
+		err = ufop.NewUfopError(ufop.E_UPSTREAM_STORAGE, "second file not in the specified bucket")
 		return
 	}
 	//check second file
 	if uint64(sEntry.Fsize) > this.maxSecondFileLength {
-		err = errors.New("second file length exceeds the limit")
+		err = ufop.NewUfopError(ufop.E_SRC_TOO_LARGE, "second file length exceeds the limit").
+			WithDetail("limit", this.maxSecondFileLength)
 		return
 	}
 	if !strings.HasPrefix(sEntry.MimeType, "audio/") {
-		err = errors.New("second file mimetype not supported")
+		err = ufop.NewUfopError(ufop.E_SRC_UNSUPPORTED, "second file mimetype not supported")
 		return
 	}
 	//download first and second file
-	fResp, fRespErr := http.Get(req.Src.Url)
+	fResp, fRespErr := utils.HttpGet(ctx, req.Src.Url)
 	if fRespErr != nil || fResp.StatusCode != 200 {
 		if fRespErr != nil {
-			err = errors.New(fmt.Sprintf("retrieve first file resource data failed, %s", fRespErr.Error()))
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("retrieve first file resource data failed, %s", fRespErr.Error()))
 		} else {
-			err = errors.New(fmt.Sprintf("retrieve first file resource data failed, %s", fResp.Status))
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("retrieve first file resource data failed, %s", fResp.Status))
 			if fResp.Body != nil {
 				fResp.Body.Close()
 			}
@@ -173,12 +191,12 @@ func (this *AudioMerger) Do(req ufop.UfopRequest) (result interface{}, resultTyp
 
 	fTmpFp, fErr := ioutil.TempFile("", "first")
 	if fErr != nil {
-		err = errors.New(fmt.Sprintf("open first file temp file failed, %s", fErr.Error()))
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("open first file temp file failed, %s", fErr.Error()))
 		return
 	}
 	_, fCpErr := io.Copy(fTmpFp, fResp.Body)
 	if fCpErr != nil {
-		err = errors.New(fmt.Sprintf("save first temp file failed, %s", fCpErr.Error()))
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("save first temp file failed, %s", fCpErr.Error()))
 		return
 	}
 	//close first one
@@ -186,12 +204,12 @@ func (this *AudioMerger) Do(req ufop.UfopRequest) (result interface{}, resultTyp
 	fTmpFp.Close()
 	fResp.Body.Close()
 
-	sResp, sRespErr := http.Get(secondFileUrl)
+	sResp, sRespErr := utils.HttpGet(ctx, secondFileUrl)
 	if sRespErr != nil || sResp.StatusCode != 200 {
 		if sRespErr != nil {
-			err = errors.New(fmt.Sprintf("retrieve second file resource data failed, %s", sRespErr.Error()))
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("retrieve second file resource data failed, %s", sRespErr.Error()))
 		} else {
-			err = errors.New(fmt.Sprintf("retrieve second file resource data failed, %s", sResp.Status))
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("retrieve second file resource data failed, %s", sResp.Status))
 			if sResp.Body != nil {
 				sResp.Body.Close()
 			}
@@ -200,12 +218,12 @@ func (this *AudioMerger) Do(req ufop.UfopRequest) (result interface{}, resultTyp
 	}
 	sTmpFp, sErr := ioutil.TempFile("", "second")
 	if sErr != nil {
-		err = errors.New(fmt.Sprintf("open second file temp file failed, %s", sErr.Error()))
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("open second file temp file failed, %s", sErr.Error()))
 		return
 	}
 	_, sCpErr := io.Copy(sTmpFp, sResp.Body)
 	if sCpErr != nil {
-		err = errors.New(fmt.Sprintf("save second first tmp file failed, %s", sCpErr.Error()))
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("save second first tmp file failed, %s", sCpErr.Error()))
 		return
 	}
 	//close second one
@@ -216,7 +234,7 @@ func (this *AudioMerger) Do(req ufop.UfopRequest) (result interface{}, resultTyp
 	//do conversion
 	oTmpFp, oErr := ioutil.TempFile("", "output")
 	if oErr != nil {
-		err = errors.New(fmt.Sprintf("open output file temp file failed, %s", oErr.Error()))
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("open output file temp file failed, %s", oErr.Error()))
 		return
 	}
 	oTmpFname := oTmpFp.Name()
@@ -237,21 +255,22 @@ func (this *AudioMerger) Do(req ufop.UfopRequest) (result interface{}, resultTyp
 	}
 
 	//exec command
-	mergeCmd := exec.Command("ffmpeg", mergeCmdParams...)
+	mergeCmd := exec.CommandContext(ctx, "ffmpeg", mergeCmdParams...)
 
 	stdErrPipe, pipeErr := mergeCmd.StderrPipe()
 	if pipeErr != nil {
-		err = errors.New(fmt.Sprintf("open exec stderr pipe error, %s", pipeErr.Error()))
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("open exec stderr pipe error, %s", pipeErr.Error()))
 		return
 	}
+	execStart := time.Now()
 	if startErr := mergeCmd.Start(); startErr != nil {
-		err = errors.New(fmt.Sprintf("start ffmpeg command error, %s", startErr.Error()))
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("start ffmpeg command error, %s", startErr.Error()))
 		return
 	}
 
 	stdErrData, readErr := ioutil.ReadAll(stdErrPipe)
 	if readErr != nil {
-		err = errors.New(fmt.Sprintf("read ffmpeg command stderr error, %s", readErr.Error()))
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("read ffmpeg command stderr error, %s", readErr.Error()))
 		defer os.Remove(oTmpFname)
 		return
 	}
@@ -261,14 +280,18 @@ func (this *AudioMerger) Do(req ufop.UfopRequest) (result interface{}, resultTyp
 		log.Error(string(stdErrData))
 	}
 
-	if waitErr := mergeCmd.Wait(); waitErr != nil {
-		err = errors.New(fmt.Sprintf("wait ffmpeg to exit error, %s", waitErr))
+	waitErr := mergeCmd.Wait()
+	utils.ObserveExec(ctx, "ffmpeg", time.Since(execStart))
+	if waitErr != nil {
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("wait ffmpeg to exit error, %s", waitErr)).
+			WithDetail("stderr", string(stdErrData))
 		defer os.Remove(oTmpFname)
 		return
 	}
 
 	if oFileInfo, statErr := os.Stat(oTmpFname); statErr != nil || oFileInfo.Size() == 0 {
-		err = errors.New("audio merge with no valid output result")
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, "audio merge with no valid output result").
+			WithDetail("stderr", string(stdErrData))
 		defer os.Remove(oTmpFname)
 		return
 	}
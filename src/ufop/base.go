@@ -1,10 +1,17 @@
 package ufop
 
+import (
+	"context"
+	"io"
+)
+
 const (
 	RESULT_TYPE_JSON = iota
 	RESULT_TYPE_OCTECT_BYTES
 	RESULT_TYPE_OCTECT_FILE
 	RESULT_TYPE_OCTECT_URL
+	//the result is a UfopStreamResult
+	RESULT_TYPE_OCTECT_STREAM
 )
 
 const (
@@ -15,6 +22,11 @@ const (
 type UfopRequest struct {
 	Cmd string         `json:"cmd"`
 	Src UfopRequestSrc `json:"src"`
+
+	//run the job in background and return the job id at once
+	Async bool `json:"async,omitempty"`
+	//notify the job result to this url when async job finished
+	Callback string `json:"callback,omitempty"`
 }
 
 type UfopRequestSrc struct {
@@ -23,9 +35,11 @@ type UfopRequestSrc struct {
 	Fsize    uint64 `json:"fsize"`
 }
 
-type UfopError struct {
-	Request UfopRequest
-	Error   string
+//the result produced while it is written out, so the whole result is never held
+//in memory, the resources are released when WriteTo returns, the ctx of the
+//request is given again since the job may be finished before the result written
+type UfopStreamResult interface {
+	WriteTo(ctx context.Context, w io.Writer) error
 }
 
 type UfopJobHandler interface {
@@ -33,3 +47,30 @@ type UfopJobHandler interface {
 	InitConfig(jobConf string) error
 	Do(ufopReq UfopRequest) (interface{}, int, string, error)
 }
+
+//the ctx is cancelled when the client goes away or the handler timeout fires
+type UfopJobHandlerV2 interface {
+	Name() string
+	InitConfig(jobConf string) error
+	DoContext(ctx context.Context, ufopReq UfopRequest) (interface{}, int, string, error)
+}
+
+//handlers depending on external programs, checked by the readiness probe
+type UfopJobHandlerChecker interface {
+	CheckReady() error
+}
+
+//handlers describing the command syntax and the limits from the config
+type UfopJobHandlerDescriber interface {
+	Syntax() string
+	Limits() map[string]interface{}
+}
+
+//adapt the handlers which are not aware of the context
+type jobHandlerAdapter struct {
+	UfopJobHandler
+}
+
+func (this *jobHandlerAdapter) DoContext(ctx context.Context, ufopReq UfopRequest) (interface{}, int, string, error) {
+	return this.Do(ufopReq)
+}
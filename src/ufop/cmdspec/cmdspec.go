@@ -0,0 +1,357 @@
+package cmdspec
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"ufop"
+)
+
+/*
+
+declare the parameters of a fop command like
+
+html2pdf/gray/<0|1>/copies/<int>/title/<encoded title>
+
+and parse the command into a struct whose fields are tagged with `cmd:"<param name>"`
+
+*/
+
+type ParamType int
+
+const (
+	PARAM_INT ParamType = iota
+	PARAM_BOOL
+	PARAM_ENUM
+	PARAM_STRING
+	PARAM_BASE64
+	PARAM_GROUP
+)
+
+type Param struct {
+	Name     string
+	Type     ParamType
+	Required bool
+	//used when the parameter not set, not checked by the range or pattern
+	Default interface{}
+
+	//range of PARAM_INT
+	Min *int
+	Max *int
+
+	//values of PARAM_ENUM
+	Values []string
+
+	//pattern of PARAM_STRING, or the decoded value of PARAM_BASE64
+	Pattern string
+
+	//sub parameters of PARAM_GROUP, the first one starts a new item of the group,
+	//the field of the group must be a slice of struct
+	Params []Param
+}
+
+type Spec struct {
+	Name   string
+	Params []Param
+}
+
+func Limit(v int) *int {
+	return &v
+}
+
+//parse the cmd into the struct pointed by v
+func (this *Spec) Parse(cmd string, v interface{}) (err error) {
+	if cmd != this.Name && !strings.HasPrefix(cmd, this.Name+"/") {
+		err = this.formatError("command name must be '%s'", this.Name)
+		return
+	}
+
+	items := make([]string, 0)
+	if cmd != this.Name {
+		items = strings.Split(strings.TrimPrefix(cmd, this.Name+"/"), "/")
+	}
+	if len(items)%2 != 0 {
+		err = this.formatError("parameter '%s' has no value", items[len(items)-1])
+		return
+	}
+
+	//raw values of the parameters and the group items
+	values := make(map[string]string)
+	groupItems := make(map[string][]map[string]string)
+	var openGroup *Param
+
+	for i := 0; i < len(items); i += 2 {
+		key, value := items[i], items[i+1]
+		if value == "" {
+			err = this.formatError("parameter '%s' has no value", key)
+			return
+		}
+
+		param, group := this.lookup(key)
+		if param == nil {
+			err = this.formatError("unknown parameter '%s'", key)
+			return
+		}
+
+		if group == nil {
+			openGroup = nil
+			if _, ok := values[key]; ok {
+				err = this.formatError("duplicate parameter '%s'", key)
+				return
+			}
+			values[key] = value
+			continue
+		}
+
+		if key == group.Params[0].Name {
+			//start a new item of the group
+			openGroup = group
+			groupItems[group.Name] = append(groupItems[group.Name], map[string]string{key: value})
+			continue
+		}
+
+		if openGroup != group {
+			err = this.formatError("parameter '%s' must follow '%s'", key, group.Params[0].Name)
+			return
+		}
+		groupItem := groupItems[group.Name][len(groupItems[group.Name])-1]
+		if _, ok := groupItem[key]; ok {
+			err = this.formatError("duplicate parameter '%s' of '%s'", key, group.Params[0].Name)
+			return
+		}
+		groupItem[key] = value
+	}
+
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Ptr || target.Elem().Kind() != reflect.Struct {
+		panic("cmdspec: parse target must be a pointer to struct")
+	}
+	target = target.Elem()
+
+	for _, param := range this.Params {
+		field := fieldByTag(target, param.Name)
+		if param.Type == PARAM_GROUP {
+			if param.Required && len(groupItems[param.Name]) == 0 {
+				err = this.formatError("missing parameter '%s'", param.Params[0].Name)
+				return
+			}
+			for _, groupItem := range groupItems[param.Name] {
+				elem := reflect.New(field.Type().Elem()).Elem()
+				for _, subParam := range param.Params {
+					if err = this.setField(elem, subParam, groupItem); err != nil {
+						return
+					}
+				}
+				field.Set(reflect.Append(field, elem))
+			}
+			continue
+		}
+
+		if err = this.setField(target, param, values); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (this *Spec) setField(target reflect.Value, param Param, values map[string]string) (err error) {
+	field := fieldByTag(target, param.Name)
+	rawValue, ok := values[param.Name]
+	if !ok {
+		if param.Required {
+			err = this.formatError("missing parameter '%s'", param.Name)
+			return
+		}
+		if param.Default != nil {
+			setValue(field, param.Default)
+		}
+		return
+	}
+
+	value, convErr := this.convert(param, rawValue)
+	if convErr != nil {
+		err = convErr
+		return
+	}
+	setValue(field, value)
+	return
+}
+
+//pointer fields are left nil when the parameter not set
+func setValue(field reflect.Value, value interface{}) {
+	if field.Kind() == reflect.Ptr {
+		ptr := reflect.New(field.Type().Elem())
+		ptr.Elem().Set(reflect.ValueOf(value))
+		field.Set(ptr)
+		return
+	}
+	field.Set(reflect.ValueOf(value))
+}
+
+func (this *Spec) convert(param Param, rawValue string) (value interface{}, err error) {
+	switch param.Type {
+	case PARAM_INT:
+		intVal, pErr := strconv.Atoi(rawValue)
+		if pErr != nil {
+			err = this.paramError(param.Name, "must be an integer")
+			return
+		}
+		if param.Min != nil && intVal < *param.Min {
+			err = this.paramError(param.Name, fmt.Sprintf("must be >= %d", *param.Min))
+			return
+		}
+		if param.Max != nil && intVal > *param.Max {
+			err = this.paramError(param.Name, fmt.Sprintf("must be <= %d", *param.Max))
+			return
+		}
+		value = intVal
+	case PARAM_BOOL:
+		switch rawValue {
+		case "0":
+			value = false
+		case "1":
+			value = true
+		default:
+			err = this.paramError(param.Name, "must be 0 or 1")
+		}
+	case PARAM_ENUM:
+		for _, enumVal := range param.Values {
+			if rawValue == enumVal {
+				value = rawValue
+				return
+			}
+		}
+		err = this.paramError(param.Name, fmt.Sprintf("must be one of %s", strings.Join(param.Values, ", ")))
+	case PARAM_STRING:
+		if param.Pattern != "" {
+			if matched, _ := regexp.MatchString(param.Pattern, rawValue); !matched {
+				err = this.paramError(param.Name, fmt.Sprintf("must match '%s'", param.Pattern))
+				return
+			}
+		}
+		value = rawValue
+	case PARAM_BASE64:
+		decodedBytes, decodeErr := base64.URLEncoding.DecodeString(rawValue)
+		if decodeErr != nil {
+			err = this.paramError(param.Name, "must be urlsafe base64 encoded")
+			return
+		}
+		decoded := string(decodedBytes)
+		if param.Pattern != "" {
+			if matched, _ := regexp.MatchString(param.Pattern, decoded); !matched {
+				err = this.paramError(param.Name, fmt.Sprintf("decoded value must match '%s'", param.Pattern))
+				return
+			}
+		}
+		value = decoded
+	}
+	return
+}
+
+//find the param by name, the group is set when the param belongs to a group
+func (this *Spec) lookup(name string) (param *Param, group *Param) {
+	for i := range this.Params {
+		p := &this.Params[i]
+		if p.Type == PARAM_GROUP {
+			for j := range p.Params {
+				if p.Params[j].Name == name {
+					param = &p.Params[j]
+					group = p
+					return
+				}
+			}
+		} else if p.Name == name {
+			param = p
+			return
+		}
+	}
+	return
+}
+
+//the errors are E_BAD_PARAM ufop errors, with the param and the reason in the details
+func (this *Spec) formatError(format string, args ...interface{}) error {
+	reason := fmt.Sprintf(format, args...)
+	return ufop.NewUfopError(ufop.E_BAD_PARAM,
+		fmt.Sprintf("invalid %s command format, %s", this.Name, reason)).
+		WithDetail("reason", reason)
+}
+
+func (this *Spec) paramError(name, reason string) error {
+	return ufop.NewUfopError(ufop.E_BAD_PARAM,
+		fmt.Sprintf("invalid %s parameter '%s', %s", this.Name, name, reason)).
+		WithDetail("param", name).
+		WithDetail("reason", reason)
+}
+
+func fieldByTag(target reflect.Value, name string) reflect.Value {
+	targetType := target.Type()
+	for i := 0; i < targetType.NumField(); i++ {
+		if targetType.Field(i).Tag.Get("cmd") == name {
+			return target.Field(i)
+		}
+	}
+	panic(fmt.Sprintf("cmdspec: no field tagged with `cmd:\"%s\"` in %s", name, targetType))
+}
+
+//the command syntax, optional parameters are in [], repeated groups end with ...
+func (this *Spec) Syntax() string {
+	syntax := this.Name
+	for _, param := range this.Params {
+		if param.Type == PARAM_GROUP {
+			groupSyntax := ""
+			for i, subParam := range param.Params {
+				if i == 0 || subParam.Required {
+					groupSyntax += paramSyntax(subParam)
+				} else {
+					groupSyntax += "[" + paramSyntax(subParam) + "]"
+				}
+			}
+			syntax += groupSyntax + "..."
+			continue
+		}
+		if param.Required {
+			syntax += paramSyntax(param)
+		} else {
+			syntax += "[" + paramSyntax(param) + "]"
+		}
+	}
+	return syntax
+}
+
+func paramSyntax(param Param) string {
+	var valueSyntax string
+	switch param.Type {
+	case PARAM_INT:
+		valueSyntax = "int"
+		if param.Min != nil && param.Max != nil {
+			valueSyntax = fmt.Sprintf("int %d~%d", *param.Min, *param.Max)
+		} else if param.Min != nil {
+			valueSyntax = fmt.Sprintf("int >= %d", *param.Min)
+		} else if param.Max != nil {
+			valueSyntax = fmt.Sprintf("int <= %d", *param.Max)
+		}
+	case PARAM_BOOL:
+		valueSyntax = "0|1"
+	case PARAM_ENUM:
+		valueSyntax = strings.Join(param.Values, "|")
+	case PARAM_STRING:
+		valueSyntax = "string"
+	case PARAM_BASE64:
+		valueSyntax = "urlsafe base64 encoded"
+	}
+	if param.Default != nil {
+		if defaultVal, ok := param.Default.(bool); ok {
+			if defaultVal {
+				valueSyntax += ", default 1"
+			} else {
+				valueSyntax += ", default 0"
+			}
+		} else {
+			valueSyntax += fmt.Sprintf(", default %v", param.Default)
+		}
+	}
+	return fmt.Sprintf("/%s/<%s>", param.Name, valueSyntax)
+}
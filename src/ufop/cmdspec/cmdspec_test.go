@@ -0,0 +1,183 @@
+package cmdspec
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+	"ufop"
+)
+
+type testFile struct {
+	Url   string `cmd:"url"`
+	Alias string `cmd:"alias"`
+}
+
+type testOptions struct {
+	Copies int        `cmd:"copies"`
+	Gray   bool       `cmd:"gray"`
+	Format string     `cmd:"format"`
+	Radius string     `cmd:"radius"`
+	Title  string     `cmd:"title"`
+	Level  *int       `cmd:"level"`
+	Bucket *string    `cmd:"bucket"`
+	Files  []testFile `cmd:"url"`
+}
+
+var testSpec = Spec{
+	Name: "test",
+	Params: []Param{
+		{Name: "copies", Type: PARAM_INT, Min: Limit(1), Max: Limit(10), Default: 1},
+		{Name: "gray", Type: PARAM_BOOL, Default: false},
+		{Name: "format", Type: PARAM_ENUM, Values: []string{"zip", "tar"}, Default: "zip"},
+		{Name: "radius", Type: PARAM_STRING, Pattern: `^\d+%?$`},
+		{Name: "title", Type: PARAM_BASE64, Pattern: `^[^/]+$`},
+		{Name: "level", Type: PARAM_INT, Min: Limit(0)},
+		{Name: "bucket", Type: PARAM_BASE64},
+		{Name: "url", Type: PARAM_GROUP, Params: []Param{
+			{Name: "url", Type: PARAM_BASE64, Required: true},
+			{Name: "alias", Type: PARAM_BASE64},
+		}},
+	},
+}
+
+func encode(text string) string {
+	return base64.URLEncoding.EncodeToString([]byte(text))
+}
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func stringPtr(v string) *string {
+	return &v
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		cmd     string
+		options testOptions
+	}{
+		{"test", testOptions{Copies: 1, Format: "zip"}},
+		{"test/copies/3/gray/1/format/tar", testOptions{Copies: 3, Gray: true, Format: "tar"}},
+		{"test/radius/20%/level/0", testOptions{Copies: 1, Format: "zip", Radius: "20%", Level: intPtr(0)}},
+		//the base64 values may contain "/" and "?" after decoded, and "=" padding
+		{"test/title/" + encode("七牛 a?b") + "/bucket/" + encode("a"), testOptions{Copies: 1, Format: "zip",
+			Title: "七牛 a?b", Bucket: stringPtr("a")}},
+		{"test/bucket/-_8=", testOptions{Copies: 1, Format: "zip", Bucket: stringPtr("\xfb\xff")}},
+		//the groups in order, the params out of the groups between them
+		{"test/url/" + encode("http://a/1.jpg") + "/alias/" + encode("1.jpg") + "/copies/2/url/" + encode("http://a/2.jpg"),
+			testOptions{Copies: 2, Format: "zip", Files: []testFile{
+				{Url: "http://a/1.jpg", Alias: "1.jpg"},
+				{Url: "http://a/2.jpg"},
+			}}},
+	}
+	for _, test := range tests {
+		var options testOptions
+		if err := testSpec.Parse(test.cmd, &options); err != nil {
+			t.Errorf("Parse(%q) error, %s", test.cmd, err)
+			continue
+		}
+		if !reflect.DeepEqual(options, test.options) {
+			t.Errorf("Parse(%q) = %+v, want %+v", test.cmd, options, test.options)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		cmd     string
+		message string
+		//the param in the details, empty for the command format errors
+		param string
+	}{
+		{"other/copies/1", "invalid test command format, command name must be 'test'", ""},
+		{"tests", "invalid test command format, command name must be 'test'", ""},
+		{"test/copies", "invalid test command format, parameter 'copies' has no value", ""},
+		{"test/copies/", "invalid test command format, parameter 'copies' has no value", ""},
+		{"test/copies//gray/1", "invalid test command format, parameter 'copies' has no value", ""},
+		{"test/pages/1", "invalid test command format, unknown parameter 'pages'", ""},
+		{"test/copies/1/copies/2", "invalid test command format, duplicate parameter 'copies'", ""},
+		{"test/alias/" + encode("a"), "invalid test command format, parameter 'alias' must follow 'url'", ""},
+		{"test/url/" + encode("a") + "/copies/1/alias/" + encode("a"), "invalid test command format, parameter 'alias' must follow 'url'", ""},
+		{"test/url/" + encode("a") + "/alias/" + encode("a") + "/alias/" + encode("b"),
+			"invalid test command format, duplicate parameter 'alias' of 'url'", ""},
+
+		{"test/copies/a", "invalid test parameter 'copies', must be an integer", "copies"},
+		{"test/copies/1.5", "invalid test parameter 'copies', must be an integer", "copies"},
+		{"test/copies/0", "invalid test parameter 'copies', must be >= 1", "copies"},
+		{"test/copies/11", "invalid test parameter 'copies', must be <= 10", "copies"},
+		{"test/level/-1", "invalid test parameter 'level', must be >= 0", "level"},
+		{"test/gray/true", "invalid test parameter 'gray', must be 0 or 1", "gray"},
+		{"test/format/rar", "invalid test parameter 'format', must be one of zip, tar", "format"},
+		{"test/radius/20px", "invalid test parameter 'radius', must match '^\\d+%?$'", "radius"},
+
+		//the std base64 without the padding, or with "+" and "/" which splits the cmd
+		{"test/bucket/YQ", "invalid test parameter 'bucket', must be urlsafe base64 encoded", "bucket"},
+		{"test/bucket/+/8=", "invalid test command format, parameter '8=' has no value", ""},
+		{"test/bucket/-_8+", "invalid test parameter 'bucket', must be urlsafe base64 encoded", "bucket"},
+		{"test/bucket/YWJj!", "invalid test parameter 'bucket', must be urlsafe base64 encoded", "bucket"},
+		{"test/title/" + encode("a/b"), "invalid test parameter 'title', decoded value must match '^[^/]+$'", "title"},
+		{"test/url/YQ", "invalid test parameter 'url', must be urlsafe base64 encoded", "url"},
+	}
+	for _, test := range tests {
+		var options testOptions
+		err := testSpec.Parse(test.cmd, &options)
+		if err == nil {
+			t.Errorf("Parse(%q) should fail", test.cmd)
+			continue
+		}
+		ufopErr, ok := err.(*ufop.UfopError)
+		if !ok {
+			t.Errorf("Parse(%q) error is not an ufop error, %s", test.cmd, err)
+			continue
+		}
+		if ufopErr.Code != ufop.E_BAD_PARAM {
+			t.Errorf("Parse(%q) error code = %s, want %s", test.cmd, ufopErr.Code, ufop.E_BAD_PARAM)
+		}
+		if ufopErr.Message != test.message {
+			t.Errorf("Parse(%q) error = %q, want %q", test.cmd, ufopErr.Message, test.message)
+		}
+		if param, _ := ufopErr.Details["param"].(string); param != test.param {
+			t.Errorf("Parse(%q) error param = %q, want %q", test.cmd, param, test.param)
+		}
+	}
+}
+
+func TestParseRequired(t *testing.T) {
+	spec := Spec{
+		Name: "test",
+		Params: []Param{
+			{Name: "bucket", Type: PARAM_BASE64, Required: true},
+			{Name: "url", Type: PARAM_GROUP, Required: true, Params: []Param{
+				{Name: "url", Type: PARAM_BASE64, Required: true},
+				{Name: "alias", Type: PARAM_BASE64},
+			}},
+		},
+	}
+	tests := []struct {
+		cmd     string
+		message string
+	}{
+		{"test/url/" + encode("a"), "invalid test command format, missing parameter 'bucket'"},
+		{"test/bucket/" + encode("a"), "invalid test command format, missing parameter 'url'"},
+	}
+	for _, test := range tests {
+		var options struct {
+			Bucket string     `cmd:"bucket"`
+			Files  []testFile `cmd:"url"`
+		}
+		err := spec.Parse(test.cmd, &options)
+		if err == nil || err.Error() != test.message {
+			t.Errorf("Parse(%q) error = %v, want %q", test.cmd, err, test.message)
+		}
+	}
+}
+
+func TestSyntax(t *testing.T) {
+	syntax := "test[/copies/<int 1~10, default 1>][/gray/<0|1, default 0>][/format/<zip|tar, default zip>]" +
+		"[/radius/<string>][/title/<urlsafe base64 encoded>][/level/<int >= 0>][/bucket/<urlsafe base64 encoded>]" +
+		"/url/<urlsafe base64 encoded>[/alias/<urlsafe base64 encoded>]..."
+	if testSpec.Syntax() != syntax {
+		t.Errorf("Syntax() = %s, want %s", testSpec.Syntax(), syntax)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 )
 
 //default ufop config
@@ -14,6 +15,10 @@ var defaultUfopConfig UfopConfig = UfopConfig{
 	ReadTimeout:    1800,
 	WriteTimeout:   1800,
 	MaxHeaderBytes: 1 << 12,
+	AsyncWorkers:   4,
+	AsyncQueueSize: 100,
+	AsyncJobExpire: 3600,
+	RetryAfter:     5,
 }
 
 type UfopConfig struct {
@@ -27,6 +32,38 @@ type UfopConfig struct {
 
 	//make you ufop instance name unique
 	UfopPrefix string `json:"ufop_prefix"`
+
+	//async job mode
+	AsyncWorkers   int `json:"async_workers,omitempty"`
+	AsyncQueueSize int `json:"async_queue_size,omitempty"`
+	AsyncJobExpire int `json:"async_job_expire,omitempty"`
+
+	//seconds for the client to retry when the handler is busy
+	RetryAfter int `json:"retry_after,omitempty"`
+
+	//dir of the temp files of the jobs and the commands, default qufop under the system temp dir
+	TempDir string `json:"temp_dir,omitempty"`
+
+	//the handlers to enable and their settings, the key is the handler name without prefix
+	Handlers map[string]UfopHandlerConfig `json:"handlers,omitempty"`
+
+	//dir of the config file, used to find the handler config files
+	configDir string
+}
+
+type UfopHandlerConfig struct {
+	//config file of the handler, relative to the dir of the ufop config
+	ConfigFile string `json:"config_file,omitempty"`
+	//inline config of the handler, used when no config file specified
+	Config json.RawMessage `json:"config,omitempty"`
+
+	//max seconds a job can run, 0 means no limit
+	Timeout int `json:"timeout,omitempty"`
+
+	//max jobs running at the same time, 0 means no limit
+	MaxConcurrency int `json:"max_concurrency,omitempty"`
+	//max jobs waiting for running, more jobs are rejected with 503
+	QueueDepth int `json:"queue_depth,omitempty"`
 }
 
 func (this *UfopConfig) LoadFromFile(configFilePath string) (err error) {
@@ -42,6 +79,7 @@ func (this *UfopConfig) LoadFromFile(configFilePath string) (err error) {
 	if decodeErr != nil {
 		err = errors.New(fmt.Sprintf("Parse ufop config failed, %s", decodeErr))
 	}
+	this.configDir = filepath.Dir(configFilePath)
 	if this.ListenPort <= 0 {
 		this.ListenPort = defaultUfopConfig.ListenPort
 	}
@@ -51,5 +89,20 @@ func (this *UfopConfig) LoadFromFile(configFilePath string) (err error) {
 	if this.WriteTimeout <= 0 {
 		this.WriteTimeout = defaultUfopConfig.WriteTimeout
 	}
+	if this.AsyncWorkers <= 0 {
+		this.AsyncWorkers = defaultUfopConfig.AsyncWorkers
+	}
+	if this.AsyncQueueSize <= 0 {
+		this.AsyncQueueSize = defaultUfopConfig.AsyncQueueSize
+	}
+	if this.AsyncJobExpire <= 0 {
+		this.AsyncJobExpire = defaultUfopConfig.AsyncJobExpire
+	}
+	if this.RetryAfter <= 0 {
+		this.RetryAfter = defaultUfopConfig.RetryAfter
+	}
+	if this.TempDir == "" {
+		this.TempDir = filepath.Join(os.TempDir(), "qufop")
+	}
 	return
 }
@@ -0,0 +1,95 @@
+package ufop
+
+import (
+	"context"
+	"net/http"
+)
+
+//stable error codes returned to the client, the client can branch on them
+const (
+	E_BAD_REQUEST        = "E_BAD_REQUEST"
+	E_BAD_PARAM          = "E_BAD_PARAM"
+	E_NO_FOP             = "E_NO_FOP"
+	E_METHOD_NOT_ALLOWED = "E_METHOD_NOT_ALLOWED"
+	E_NOT_FOUND          = "E_NOT_FOUND"
+	E_SRC_TOO_LARGE      = "E_SRC_TOO_LARGE"
+	E_SRC_UNSUPPORTED    = "E_SRC_UNSUPPORTED"
+	E_SRC_INVALID        = "E_SRC_INVALID"
+	E_LIMIT_EXCEEDED     = "E_LIMIT_EXCEEDED"
+	E_SRC_BOMB           = "E_SRC_BOMB"
+	E_UPSTREAM_FETCH     = "E_UPSTREAM_FETCH"
+	E_UPSTREAM_STORAGE   = "E_UPSTREAM_STORAGE"
+	E_CONVERTER_FAILED   = "E_CONVERTER_FAILED"
+	E_TOO_MANY_JOBS      = "E_TOO_MANY_JOBS"
+	E_TIMEOUT            = "E_TIMEOUT"
+	E_CANCELLED          = "E_CANCELLED"
+	E_INTERNAL           = "E_INTERNAL"
+)
+
+var errorStatusCodes = map[string]int{
+	E_BAD_REQUEST:        http.StatusBadRequest,
+	E_BAD_PARAM:          http.StatusBadRequest,
+	E_NO_FOP:             http.StatusBadRequest,
+	E_METHOD_NOT_ALLOWED: http.StatusMethodNotAllowed,
+	E_NOT_FOUND:          http.StatusNotFound,
+	E_SRC_TOO_LARGE:      http.StatusRequestEntityTooLarge,
+	E_SRC_UNSUPPORTED:    http.StatusUnsupportedMediaType,
+	E_SRC_INVALID:        http.StatusBadRequest,
+	E_LIMIT_EXCEEDED:     http.StatusBadRequest,
+	E_SRC_BOMB:           http.StatusRequestEntityTooLarge,
+	E_UPSTREAM_FETCH:     http.StatusBadGateway,
+	E_UPSTREAM_STORAGE:   http.StatusBadGateway,
+	E_CONVERTER_FAILED:   http.StatusInternalServerError,
+	E_TOO_MANY_JOBS:      http.StatusServiceUnavailable,
+	E_TIMEOUT:            http.StatusGatewayTimeout,
+	E_CANCELLED:          499,
+	E_INTERNAL:           http.StatusInternalServerError,
+}
+
+type UfopError struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"error"`
+	ReqId   string                 `json:"reqid,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+
+	StatusCode int `json:"-"`
+}
+
+func NewUfopError(code string, message string) *UfopError {
+	statusCode, ok := errorStatusCodes[code]
+	if !ok {
+		statusCode = http.StatusInternalServerError
+	}
+	return &UfopError{
+		Code:       code,
+		Message:    message,
+		StatusCode: statusCode,
+	}
+}
+
+func (this *UfopError) Error() string {
+	return this.Message
+}
+
+//add the details, like the limit exceeded or the stderr of the converter
+func (this *UfopError) WithDetail(key string, value interface{}) *UfopError {
+	if this.Details == nil {
+		this.Details = make(map[string]interface{})
+	}
+	this.Details[key] = value
+	return this
+}
+
+//errors not created by NewUfopError are internal errors
+func ToUfopError(err error) *UfopError {
+	if ufopErr, ok := err.(*UfopError); ok {
+		return ufopErr
+	}
+	switch err {
+	case context.DeadlineExceeded:
+		return NewUfopError(E_TIMEOUT, err.Error())
+	case context.Canceled:
+		return NewUfopError(E_CANCELLED, err.Error())
+	}
+	return NewUfopError(E_INTERNAL, err.Error())
+}
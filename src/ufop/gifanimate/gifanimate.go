@@ -1 +1,618 @@
 package gifanimate
+
+//THE FRAMES ARE PROCESSED BY THE ImageMagick LIBRARY, THE webp AND apng
+//OUTPUT RELYS ON THE ffmpeg PROGRAM
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gographics/imagick/imagick"
+	"github.com/qiniu/api.v6/auth/digest"
+	"github.com/qiniu/api.v6/rs"
+	"github.com/qiniu/rpc"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"ufop"
+	"ufop/cmdspec"
+	"ufop/utils"
+)
+
+const (
+	GIFANIMATE_MAX_FRAME_COUNT     = 100
+	GIFANIMATE_MAX_FRAME_FILE_SIZE = 10 * 1024 * 1024
+	GIFANIMATE_MAX_SIZE            = 1024
+)
+
+const (
+	FORMAT_GIF  = "gif"
+	FORMAT_WEBP = "webp"
+	FORMAT_APNG = "apng"
+
+	FIT_CONTAIN = "contain"
+	FIT_COVER   = "cover"
+	FIT_FILL    = "fill"
+
+	//one palette shared by all the frames
+	PALETTE_GLOBAL = "global"
+	//one palette for each frame
+	PALETTE_LOCAL = "local"
+	//the 216 colors web safe palette
+	PALETTE_WEBSAFE = "websafe"
+)
+
+var formatMimes = map[string]string{
+	FORMAT_GIF:  "image/gif",
+	FORMAT_WEBP: "image/webp",
+	FORMAT_APNG: "image/png",
+}
+
+var frameMimeTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/bmp":  true,
+	"image/webp": true,
+}
+
+type GifAnimater struct {
+	mac              *digest.Mac
+	maxFrameCount    int
+	maxFrameFileSize int64
+	maxSize          int
+}
+
+type GifAnimaterConfig struct {
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+
+	GifAnimateMaxFrameCount    int   `json:"gifanimate_max_frame_count,omitempty"`
+	GifAnimateMaxFrameFileSize int64 `json:"gifanimate_max_frame_file_size,omitempty"`
+	GifAnimateMaxSize          int   `json:"gifanimate_max_size,omitempty"`
+}
+
+type GifAnimateOptions struct {
+	Bucket  string          `cmd:"bucket"`
+	Format  string          `cmd:"format"`
+	Delay   int             `cmd:"delay"`
+	Loop    int             `cmd:"loop"`
+	Width   int             `cmd:"width"`
+	Height  int             `cmd:"height"`
+	Fit     string          `cmd:"fit"`
+	BgColor string          `cmd:"bgcolor"`
+	Colors  int             `cmd:"colors"`
+	Palette string          `cmd:"palette"`
+	Dither  bool            `cmd:"dither"`
+	Frames  []GifAnimateUrl `cmd:"urls"`
+}
+
+type GifAnimateUrl struct {
+	Url   string `cmd:"url"`
+	Delay *int   `cmd:"frame-delay"`
+}
+
+func (this *GifAnimater) Name() string {
+	return "gifanimate"
+}
+
+func (this *GifAnimater) InitConfig(jobConf string) (err error) {
+	confFp, openErr := os.Open(jobConf)
+	if openErr != nil {
+		err = errors.New(fmt.Sprintf("Open gifanimate config failed, %s", openErr.Error()))
+		return
+	}
+
+	config := GifAnimaterConfig{}
+
+	decoder := json.NewDecoder(confFp)
+	decodeErr := decoder.Decode(&config)
+	if decodeErr != nil {
+		err = errors.New(fmt.Sprintf("Parse gifanimate config failed, %s", decodeErr.Error()))
+		return
+	}
+
+	if config.GifAnimateMaxFrameCount <= 0 {
+		this.maxFrameCount = GIFANIMATE_MAX_FRAME_COUNT
+	} else {
+		this.maxFrameCount = config.GifAnimateMaxFrameCount
+	}
+
+	if config.GifAnimateMaxFrameFileSize <= 0 {
+		this.maxFrameFileSize = GIFANIMATE_MAX_FRAME_FILE_SIZE
+	} else {
+		this.maxFrameFileSize = config.GifAnimateMaxFrameFileSize
+	}
+
+	if config.GifAnimateMaxSize <= 0 {
+		this.maxSize = GIFANIMATE_MAX_SIZE
+	} else {
+		this.maxSize = config.GifAnimateMaxSize
+	}
+
+	this.mac = &digest.Mac{config.AccessKey, []byte(config.SecretKey)}
+
+	//imagick is initialized once for the process, never terminated since the
+	//requests share it
+	imagick.Initialize()
+	return
+}
+
+func (this *GifAnimater) Syntax() string {
+	return gifanimateSpec.Syntax()
+}
+
+func (this *GifAnimater) Limits() map[string]interface{} {
+	return map[string]interface{}{
+		"gifanimate_max_frame_count":     this.maxFrameCount,
+		"gifanimate_max_frame_file_size": this.maxFrameFileSize,
+		"gifanimate_max_size":            this.maxSize,
+	}
+}
+
+//imagick is linked in and initialized by InitConfig, check the gif format is supported
+//by the ImageMagick library, and the ffmpeg program used by the webp and apng output
+func (this *GifAnimater) CheckReady() (err error) {
+	for _, format := range []string{"GIF", "PNG", "JPEG"} {
+		if len(imagick.QueryFormats(format)) == 0 {
+			err = errors.New(fmt.Sprintf("imagick format '%s' not supported", format))
+			return
+		}
+	}
+
+	err = utils.CheckCommands("ffmpeg")
+	return
+}
+
+var gifanimateSpec = cmdspec.Spec{
+	Name: "gifanimate",
+	Params: []cmdspec.Param{
+		{Name: "bucket", Type: cmdspec.PARAM_BASE64, Required: true},
+		{Name: "format", Type: cmdspec.PARAM_ENUM, Values: []string{FORMAT_GIF, FORMAT_WEBP, FORMAT_APNG}, Default: FORMAT_GIF},
+		{Name: "delay", Type: cmdspec.PARAM_INT, Min: cmdspec.Limit(1), Max: cmdspec.Limit(65535), Default: 10},
+		{Name: "loop", Type: cmdspec.PARAM_INT, Min: cmdspec.Limit(0), Max: cmdspec.Limit(65535), Default: 0},
+		{Name: "width", Type: cmdspec.PARAM_INT, Min: cmdspec.Limit(1)},
+		{Name: "height", Type: cmdspec.PARAM_INT, Min: cmdspec.Limit(1)},
+		{Name: "fit", Type: cmdspec.PARAM_ENUM, Values: []string{FIT_CONTAIN, FIT_COVER, FIT_FILL}, Default: FIT_CONTAIN},
+		{Name: "bgcolor", Type: cmdspec.PARAM_BASE64, Pattern: "^#[a-fA-F0-9]{6}$", Default: "#FFFFFF"},
+		{Name: "colors", Type: cmdspec.PARAM_INT, Min: cmdspec.Limit(2), Max: cmdspec.Limit(256), Default: 256},
+		{Name: "palette", Type: cmdspec.PARAM_ENUM, Values: []string{PALETTE_GLOBAL, PALETTE_LOCAL, PALETTE_WEBSAFE}, Default: PALETTE_GLOBAL},
+		{Name: "dither", Type: cmdspec.PARAM_BOOL, Default: true},
+		{Name: "urls", Type: cmdspec.PARAM_GROUP, Required: true, Params: []cmdspec.Param{
+			{Name: "url", Type: cmdspec.PARAM_BASE64},
+			{Name: "frame-delay", Type: cmdspec.PARAM_INT, Min: cmdspec.Limit(1), Max: cmdspec.Limit(65535)},
+		}},
+	},
+}
+
+/*
+
+gifanimate
+/bucket/<string>
+/format/<string>		optional, default gif, gif, webp or apng
+/delay/<int>			optional, default 10, in 1/100 second
+/loop/<int>				optional, default 0, loop forever
+/width/<int>			optional, default the width of the first frame
+/height/<int>			optional, default the height of the first frame
+/fit/<string>			optional, default contain, contain, cover or fill
+/bgcolor/<string>		optional, default #FFFFFF
+/colors/<int>			optional, default 256
+/palette/<string>		optional, default global, global, local or websafe
+/dither/<int>			optional, default 1
+/url/<string>/frame-delay/<int>
+/url/<string>
+
+*/
+func (this *GifAnimater) parse(cmd string) (options *GifAnimateOptions, err error) {
+	options = &GifAnimateOptions{}
+	if err = gifanimateSpec.Parse(cmd, options); err != nil {
+		return
+	}
+
+	if len(options.Frames) > this.maxFrameCount {
+		err = ufop.NewUfopError(ufop.E_LIMIT_EXCEEDED, fmt.Sprintf("only allow url count not larger than %d", this.maxFrameCount)).
+			WithDetail("limit", this.maxFrameCount)
+		return
+	}
+
+	if options.Width > this.maxSize || options.Height > this.maxSize {
+		err = ufop.NewUfopError(ufop.E_LIMIT_EXCEEDED, fmt.Sprintf("only allow width and height not larger than %d", this.maxSize)).
+			WithDetail("limit", this.maxSize)
+		return
+	}
+
+	return
+}
+
+func (this *GifAnimater) DoContext(ctx context.Context, req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
+	options, pErr := this.parse(req.Cmd)
+	if pErr != nil {
+		err = pErr
+		return
+	}
+
+	//check urls validity, all should in bucket
+	if err = this.stat(options); err != nil {
+		return
+	}
+
+	workDir, tmpErr := ioutil.TempDir("", "gifanimate_")
+	if tmpErr != nil {
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("create gifanimate temp dir failed, %s", tmpErr.Error()))
+		return
+	}
+	defer os.RemoveAll(workDir)
+
+	//download images by url
+	framePaths := make([]string, 0, len(options.Frames))
+	for index, frame := range options.Frames {
+		framePath := filepath.Join(workDir, fmt.Sprintf("src_%04d", index))
+		if _, dErr := utils.Download(ctx, frame.Url, framePath); dErr != nil {
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, dErr.Error()).WithDetail("url", frame.Url)
+			return
+		}
+		framePaths = append(framePaths, framePath)
+	}
+
+	animWand, aErr := this.frames(options, framePaths)
+	if aErr != nil {
+		err = aErr
+		return
+	}
+	defer animWand.Destroy()
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		err = ufop.NewUfopError(ufop.E_CANCELLED, fmt.Sprintf("gifanimate cancelled, %s", ctxErr.Error()))
+		return
+	}
+
+	//the result file is removed after written to the response
+	resultFp, createErr := ioutil.TempFile("", "gifanimate_result_")
+	if createErr != nil {
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("create gifanimate result file failed, %s", createErr.Error()))
+		return
+	}
+	resultPath := resultFp.Name()
+	resultFp.Close()
+
+	if options.Format == FORMAT_GIF {
+		err = this.writeGif(animWand, options, resultPath)
+	} else {
+		err = this.writeFfmpeg(ctx, animWand, options, workDir, resultPath)
+	}
+	if err != nil {
+		os.Remove(resultPath)
+		return
+	}
+
+	result = resultPath
+	resultType = ufop.RESULT_TYPE_OCTECT_FILE
+	contentType = formatMimes[options.Format]
+	return
+}
+
+//check the images exist in the bucket, and the file size and mimetype of them
+func (this *GifAnimater) stat(options *GifAnimateOptions) (err error) {
+	statItems := make([]rs.EntryPath, 0, len(options.Frames))
+	for _, frame := range options.Frames {
+		uri, pErr := url.Parse(frame.Url)
+		if pErr != nil || len(uri.Path) <= 1 {
+			err = ufop.NewUfopError(ufop.E_BAD_PARAM, fmt.Sprintf("invalid gifanimate parameter 'url', wrong '%s'", frame.Url)).
+				WithDetail("url", frame.Url)
+			return
+		}
+		statItems = append(statItems, rs.EntryPath{
+			options.Bucket, uri.Path[1:],
+		})
+	}
+
+	qclient := rs.New(this.mac)
+
+	statRet, statErr := qclient.BatchStat(nil, statItems)
+
+	if statErr != nil {
+		if sErr, ok := statErr.(*rpc.ErrorInfo); !ok {
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_STORAGE, fmt.Sprintf("batch stat error, %s", statErr.Error()))
+			return
+		} else {
+			if sErr.Err != "" {
+				err = ufop.NewUfopError(ufop.E_UPSTREAM_STORAGE, fmt.Sprintf("batch stat error, %s", sErr.Err))
+				return
+			}
+		}
+	}
+
+	for index := 0; index < len(statRet); index++ {
+		ret := statRet[index]
+		frameUrl := options.Frames[index].Url
+		if ret.Code != 200 {
+			if ret.Code == 612 {
+				err = ufop.NewUfopError(ufop.E_BAD_PARAM, fmt.Sprintf("batch stat '%s' error, no such file or directory", frameUrl)).
+					WithDetail("url", frameUrl)
+			} else if ret.Code == 631 {
+				err = ufop.NewUfopError(ufop.E_BAD_PARAM, fmt.Sprintf("batch stat '%s' error, no such bucket", frameUrl)).
+					WithDetail("url", frameUrl)
+			} else {
+				err = ufop.NewUfopError(ufop.E_UPSTREAM_STORAGE, fmt.Sprintf("batch stat '%s' error, %d", frameUrl, ret.Code)).
+					WithDetail("url", frameUrl)
+			}
+			return
+		}
+
+		if ret.Data.Fsize > this.maxFrameFileSize {
+			err = ufop.NewUfopError(ufop.E_SRC_TOO_LARGE, fmt.Sprintf("image file size of '%s' exceeds the limit", frameUrl)).
+				WithDetail("url", frameUrl).
+				WithDetail("limit", this.maxFrameFileSize)
+			return
+		}
+
+		if !frameMimeTypes[ret.Data.MimeType] {
+			err = ufop.NewUfopError(ufop.E_SRC_UNSUPPORTED, fmt.Sprintf("unsupported mimetype of '%s', '%s'", frameUrl, ret.Data.MimeType)).
+				WithDetail("url", frameUrl)
+			return
+		}
+	}
+
+	return
+}
+
+//read the frames, fit them to the same size and set the delays
+func (this *GifAnimater) frames(options *GifAnimateOptions, framePaths []string) (animWand *imagick.MagickWand, err error) {
+	animWand = imagick.NewMagickWand()
+
+	bgColor := imagick.NewPixelWand()
+	defer bgColor.Destroy()
+	bgColor.SetColor(options.BgColor)
+
+	var width, height uint
+	for index, framePath := range framePaths {
+		frameUrl := options.Frames[index].Url
+		srcWand := imagick.NewMagickWand()
+		if rErr := srcWand.ReadImage(framePath); rErr != nil {
+			srcWand.Destroy()
+			animWand.Destroy()
+			err = ufop.NewUfopError(ufop.E_SRC_INVALID, fmt.Sprintf("decode image of remote '%s' failed, %s", frameUrl, rErr.Error())).
+				WithDetail("url", frameUrl)
+			return
+		}
+
+		//only the first frame of the animated image is used
+		srcWand.SetFirstIterator()
+		frameWand := srcWand.GetImage()
+		srcWand.Destroy()
+
+		//the size of the animation decided by the first frame
+		if index == 0 {
+			width, height = this.size(options, frameWand.GetImageWidth(), frameWand.GetImageHeight())
+		}
+
+		fErr := fit(frameWand, options.Fit, width, height, bgColor)
+		if fErr == nil {
+			delay := options.Delay
+			if options.Frames[index].Delay != nil {
+				delay = *options.Frames[index].Delay
+			}
+			fErr = frameWand.SetImageDelay(uint(delay))
+		}
+		if fErr == nil {
+			fErr = animWand.AddImage(frameWand)
+		}
+		frameWand.Destroy()
+
+		if fErr != nil {
+			animWand.Destroy()
+			err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("process image of remote '%s' failed, %s", frameUrl, fErr.Error())).
+				WithDetail("url", frameUrl)
+			return
+		}
+	}
+
+	return
+}
+
+//the size of the animation, the missing side is scaled by the ratio of the first frame,
+//and the size of the first frame is limited by the max size
+func (this *GifAnimater) size(options *GifAnimateOptions, srcWidth, srcHeight uint) (width, height uint) {
+	ratio := float64(srcWidth) / float64(srcHeight)
+	switch {
+	case options.Width > 0 && options.Height > 0:
+		return uint(options.Width), uint(options.Height)
+	case options.Width > 0:
+		width = uint(options.Width)
+		height = uint(math.Max(1, math.Floor(float64(width)/ratio+0.5)))
+	case options.Height > 0:
+		height = uint(options.Height)
+		width = uint(math.Max(1, math.Floor(float64(height)*ratio+0.5)))
+	default:
+		width, height = srcWidth, srcHeight
+	}
+
+	maxSize := uint(this.maxSize)
+	if width > maxSize {
+		width = maxSize
+		height = uint(math.Max(1, math.Floor(float64(width)/ratio+0.5)))
+	}
+	if height > maxSize {
+		height = maxSize
+		width = uint(math.Max(1, math.Floor(float64(height)*ratio+0.5)))
+	}
+	return
+}
+
+//resize the frame to the size of the animation
+func fit(frameWand *imagick.MagickWand, mode string, width, height uint, bgColor *imagick.PixelWand) (err error) {
+	srcWidth := float64(frameWand.GetImageWidth())
+	srcHeight := float64(frameWand.GetImageHeight())
+
+	switch mode {
+	case FIT_FILL:
+		err = frameWand.ResizeImage(width, height, imagick.FILTER_LANCZOS, 1)
+	case FIT_CONTAIN:
+		scale := math.Min(float64(width)/srcWidth, float64(height)/srcHeight)
+		dstWidth := uint(math.Max(1, math.Floor(srcWidth*scale+0.5)))
+		dstHeight := uint(math.Max(1, math.Floor(srcHeight*scale+0.5)))
+		if err = frameWand.ResizeImage(dstWidth, dstHeight, imagick.FILTER_LANCZOS, 1); err != nil {
+			return
+		}
+		//pad to the center with the background color
+		if err = frameWand.SetImageBackgroundColor(bgColor); err != nil {
+			return
+		}
+		err = frameWand.ExtentImage(width, height, -int(width-dstWidth)/2, -int(height-dstHeight)/2)
+	case FIT_COVER:
+		scale := math.Max(float64(width)/srcWidth, float64(height)/srcHeight)
+		dstWidth := uint(math.Max(float64(width), math.Floor(srcWidth*scale+0.5)))
+		dstHeight := uint(math.Max(float64(height), math.Floor(srcHeight*scale+0.5)))
+		if err = frameWand.ResizeImage(dstWidth, dstHeight, imagick.FILTER_LANCZOS, 1); err != nil {
+			return
+		}
+		//crop the center
+		err = frameWand.CropImage(width, height, int(dstWidth-width)/2, int(dstHeight-height)/2)
+	}
+	if err != nil {
+		return
+	}
+
+	//reset the offset left by the crop, the gif frames are placed by it
+	err = frameWand.SetImagePage(width, height, 0, 0)
+	return
+}
+
+//reduce the colors by the palette and write the gif
+func (this *GifAnimater) writeGif(animWand *imagick.MagickWand, options *GifAnimateOptions, resultPath string) (err error) {
+	colors := uint(options.Colors)
+	switch options.Palette {
+	case PALETTE_GLOBAL:
+		err = animWand.QuantizeImages(colors, imagick.COLORSPACE_SRGB, 0, options.Dither, false)
+	case PALETTE_LOCAL:
+		animWand.ResetIterator()
+		for animWand.NextImage() {
+			if err = animWand.QuantizeImage(colors, imagick.COLORSPACE_SRGB, 0, options.Dither, false); err != nil {
+				break
+			}
+		}
+	case PALETTE_WEBSAFE:
+		paletteWand := imagick.NewMagickWand()
+		defer paletteWand.Destroy()
+		if err = paletteWand.ReadImage("netscape:"); err != nil {
+			break
+		}
+		ditherMethod := imagick.DITHER_METHOD_NO
+		if options.Dither {
+			ditherMethod = imagick.DITHER_METHOD_FLOYD_STEINBERG
+		}
+		animWand.ResetIterator()
+		for animWand.NextImage() {
+			if err = animWand.RemapImage(paletteWand, ditherMethod); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("reduce gif colors failed, %s", err.Error()))
+		return
+	}
+
+	animWand.ResetIterator()
+	for animWand.NextImage() {
+		if err = animWand.SetImageFormat("GIF"); err == nil {
+			err = animWand.SetImageIterations(uint(options.Loop))
+		}
+		if err != nil {
+			err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("set gif frame options failed, %s", err.Error()))
+			return
+		}
+	}
+
+	if wErr := animWand.WriteImages("gif:"+resultPath, true); wErr != nil {
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("create dst gif image failed, %s", wErr.Error()))
+		return
+	}
+	return
+}
+
+//write the frames as png files and encode them by ffmpeg, the delays of the frames
+//are kept by the concat demuxer
+func (this *GifAnimater) writeFfmpeg(ctx context.Context, animWand *imagick.MagickWand, options *GifAnimateOptions,
+	workDir, resultPath string) (err error) {
+	concatList := bytes.NewBufferString("ffconcat version 1.0\n")
+	var lastFrame string
+	index := 0
+	animWand.ResetIterator()
+	for animWand.NextImage() {
+		framePath := filepath.Join(workDir, fmt.Sprintf("frame_%04d.png", index))
+		if wErr := animWand.WriteImage("png32:" + framePath); wErr != nil {
+			err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("write frame %d failed, %s", index, wErr.Error()))
+			return
+		}
+		delay := options.Delay
+		if options.Frames[index].Delay != nil {
+			delay = *options.Frames[index].Delay
+		}
+		lastFrame = filepath.Base(framePath)
+		concatList.WriteString(fmt.Sprintf("file '%s'\nduration %.2f\n", lastFrame, float64(delay)/100))
+		index += 1
+	}
+	//the duration of the last frame is dropped without the repeated entry
+	concatList.WriteString(fmt.Sprintf("file '%s'\n", lastFrame))
+
+	concatPath := filepath.Join(workDir, "frames.txt")
+	if wErr := ioutil.WriteFile(concatPath, concatList.Bytes(), 0600); wErr != nil {
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("write frame list failed, %s", wErr.Error()))
+		return
+	}
+
+	cmdParams := []string{
+		"-y",
+		"-v", "error",
+		"-f", "concat",
+		"-i", concatPath,
+		"-vsync", "vfr",
+	}
+	switch options.Format {
+	case FORMAT_WEBP:
+		cmdParams = append(cmdParams,
+			"-c:v", "libwebp_anim",
+			"-lossless", "0",
+			"-loop", fmt.Sprintf("%d", options.Loop),
+			"-f", "webp",
+		)
+	case FORMAT_APNG:
+		cmdParams = append(cmdParams,
+			"-pix_fmt", "rgba",
+			"-plays", fmt.Sprintf("%d", options.Loop),
+			"-f", "apng",
+		)
+	}
+	cmdParams = append(cmdParams, resultPath)
+
+	encodeCmd := exec.CommandContext(ctx, "ffmpeg", cmdParams...)
+	stdErr := bytes.NewBuffer(nil)
+	encodeCmd.Stderr = stdErr
+
+	execStart := time.Now()
+	runErr := encodeCmd.Run()
+	utils.ObserveExec(ctx, "ffmpeg", time.Since(execStart))
+	if runErr != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ufop.NewUfopError(ufop.E_CANCELLED, fmt.Sprintf("gifanimate cancelled, %s", ctxErr.Error()))
+			return
+		}
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("create dst %s image failed, %s", options.Format, runErr.Error())).
+			WithDetail("stderr", strings.TrimSpace(stdErr.String()))
+		return
+	}
+
+	if resultInfo, statErr := os.Stat(resultPath); statErr != nil || resultInfo.Size() == 0 {
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("create dst %s image with no valid output result", options.Format)).
+			WithDetail("stderr", strings.TrimSpace(stdErr.String()))
+	}
+	return
+}
@@ -1,21 +1,20 @@
 package html2image
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/qiniu/log"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
-	"strconv"
 	"strings"
 	"time"
 	"ufop"
+	"ufop/cmdspec"
 	"ufop/utils"
 )
 
@@ -32,15 +31,15 @@ type Html2ImagerConfig struct {
 }
 
 type Html2ImageOptions struct {
-	CropH   int
-	CropW   int
-	CropX   int
-	CropY   int
-	Format  string
-	Height  int
-	Width   int
-	Quality int
-	Force   bool
+	CropH   int    `cmd:"croph"`
+	CropW   int    `cmd:"cropw"`
+	CropX   int    `cmd:"cropx"`
+	CropY   int    `cmd:"cropy"`
+	Format  string `cmd:"format"`
+	Height  int    `cmd:"height"`
+	Width   int    `cmd:"width"`
+	Quality int    `cmd:"quality"`
+	Force   bool   `cmd:"force"`
 }
 
 func (this *Html2Imager) Name() string {
@@ -71,123 +70,42 @@ func (this *Html2Imager) InitConfig(jobConf string) (err error) {
 	return
 }
 
-func (this *Html2Imager) parse(cmd string) (options *Html2ImageOptions, err error) {
-	pattern := `^html2image(/croph/\d+|/cropw/\d+|/cropx/\d+|/cropy/\d+|/format/(png|jpg|jpeg)|/height/\d+|/quality/\d+|/width/\d+|/force/[0|1]){0,9}$`
-	matched, _ := regexp.MatchString(pattern, cmd)
-	if !matched {
-		err = errors.New("invalid html2image command format")
-		return
-	}
-
-	options = &Html2ImageOptions{
-		Format: "jpg",
-	}
-
-	//croph
-	cropHStr := utils.GetParam(cmd, `croph/\d+`, "croph")
-	if cropHStr != "" {
-		cropH, _ := strconv.Atoi(cropHStr)
-		if cropH <= 0 {
-			err = errors.New("invalid html2image parameter 'croph'")
-			return
-		} else {
-			options.CropH = cropH
-		}
-	}
-
-	//cropw
-	cropWStr := utils.GetParam(cmd, `cropw/\d+`, "cropw")
-	if cropWStr != "" {
-		cropW, _ := strconv.Atoi(cropWStr)
-		if cropW <= 0 {
-			err = errors.New("invalid html2image parameter 'cropw'")
-			return
-		} else {
-			options.CropW = cropW
-		}
-	}
-
-	//cropx
-	cropXStr := utils.GetParam(cmd, `cropx/\d+`, "cropx")
-	fmt.Println(cropXStr)
-	if cropXStr != "" {
-		cropX, _ := strconv.Atoi(cropXStr)
-		if cropX <= 0 {
-			err = errors.New("invalid html2image parameter 'cropx'")
-			return
-		} else {
-			options.CropX = cropX
-		}
-	}
-
-	//cropy
-	cropYStr := utils.GetParam(cmd, `cropy/\d+`, "cropy")
-	if cropYStr != "" {
-		cropY, _ := strconv.Atoi(cropYStr)
-		if cropY <= 0 {
-			err = errors.New("invalid html2image parameter 'cropy'")
-			return
-		} else {
-			options.CropY = cropY
-		}
-	}
-
-	//format
-	formatStr := utils.GetParam(cmd, "format/(png|jpg|jpeg)", "format")
-	if formatStr != "" {
-		options.Format = formatStr
-	}
-
-	//height
-	heightStr := utils.GetParam(cmd, `height/\d+`, "height")
-	if heightStr != "" {
-		height, _ := strconv.Atoi(heightStr)
-		if height <= 0 {
-			err = errors.New("invalid html2image parameter 'height'")
-			return
-		} else {
-			options.Height = height
-		}
-	}
+func (this *Html2Imager) Syntax() string {
+	return html2imageSpec.Syntax()
+}
 
-	//width
-	widthStr := utils.GetParam(cmd, `width/\d+`, "width")
-	if widthStr != "" {
-		width, _ := strconv.Atoi(widthStr)
-		if width <= 0 {
-			err = errors.New("invalid html2image parameter 'width'")
-			return
-		} else {
-			options.Width = width
-		}
+func (this *Html2Imager) Limits() map[string]interface{} {
+	return map[string]interface{}{
+		"html2image_max_page_size": this.maxPageSize,
 	}
+}
 
-	//quality
-	qualityStr := utils.GetParam(cmd, `quality/\d+`, "quality")
-	if qualityStr != "" {
-		quality, _ := strconv.Atoi(qualityStr)
-		if quality > 100 || quality <= 0 {
-			err = errors.New("invalid html2image parameter 'quality'")
-			return
-		} else {
-			options.Quality = quality
-		}
-	}
+func (this *Html2Imager) CheckReady() error {
+	return utils.CheckCommands("wkhtmltoimage")
+}
 
-	//force
-	forceStr := utils.GetParam(cmd, "force/[0|1]", "force")
-	if forceStr != "" {
-		force, _ := strconv.Atoi(forceStr)
-		if force == 1 {
-			options.Force = true
-		}
-	}
+var html2imageSpec = cmdspec.Spec{
+	Name: "html2image",
+	Params: []cmdspec.Param{
+		{Name: "croph", Type: cmdspec.PARAM_INT, Min: cmdspec.Limit(1)},
+		{Name: "cropw", Type: cmdspec.PARAM_INT, Min: cmdspec.Limit(1)},
+		{Name: "cropx", Type: cmdspec.PARAM_INT, Min: cmdspec.Limit(1)},
+		{Name: "cropy", Type: cmdspec.PARAM_INT, Min: cmdspec.Limit(1)},
+		{Name: "format", Type: cmdspec.PARAM_ENUM, Values: []string{"png", "jpg", "jpeg"}, Default: "jpg"},
+		{Name: "height", Type: cmdspec.PARAM_INT, Min: cmdspec.Limit(1)},
+		{Name: "width", Type: cmdspec.PARAM_INT, Min: cmdspec.Limit(1)},
+		{Name: "quality", Type: cmdspec.PARAM_INT, Min: cmdspec.Limit(1), Max: cmdspec.Limit(100)},
+		{Name: "force", Type: cmdspec.PARAM_BOOL},
+	},
+}
 
+func (this *Html2Imager) parse(cmd string) (options *Html2ImageOptions, err error) {
+	options = &Html2ImageOptions{}
+	err = html2imageSpec.Parse(cmd, options)
 	return
-
 }
 
-func (this *Html2Imager) Do(req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
+func (this *Html2Imager) DoContext(ctx context.Context, req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
 	options, pErr := this.parse(req.Cmd)
 	if pErr != nil {
 		err = pErr
@@ -196,23 +114,24 @@ func (this *Html2Imager) Do(req ufop.UfopRequest) (result interface{}, resultTyp
 
 	//if not text format, error it
 	if !strings.HasPrefix(req.Src.MimeType, "text/") {
-		err = errors.New("unsupported file mime type, only text/* allowed")
+		err = ufop.NewUfopError(ufop.E_SRC_UNSUPPORTED, "unsupported file mime type, only text/* allowed")
 		return
 	}
 
 	//if file size exceeds, error it
 	if req.Src.Fsize > this.maxPageSize {
-		err = errors.New("page file length exceeds the limit")
+		err = ufop.NewUfopError(ufop.E_SRC_TOO_LARGE, "page file length exceeds the limit").
+			WithDetail("limit", this.maxPageSize)
 		return
 	}
 
 	//get page file content save it into temp dir
-	resp, respErr := http.Get(req.Src.Url)
+	resp, respErr := utils.HttpGet(ctx, req.Src.Url)
 	if respErr != nil || resp.StatusCode != 200 {
 		if respErr != nil {
-			err = errors.New(fmt.Sprintf("retrieve page file resource data failed, %s", respErr.Error()))
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("retrieve page file resource data failed, %s", respErr.Error()))
 		} else {
-			err = errors.New(fmt.Sprintf("retrieve page file resource data failed, %s", resp.Status))
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("retrieve page file resource data failed, %s", resp.Status))
 			if resp.Body != nil {
 				resp.Body.Close()
 			}
@@ -233,12 +152,12 @@ func (this *Html2Imager) Do(req ufop.UfopRequest) (result interface{}, resultTyp
 
 	localPageTmpFp, openErr := os.OpenFile(localPageTmpFpath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0655)
 	if openErr != nil {
-		err = errors.New(fmt.Sprintf("open page file temp file failed, %s", openErr.Error()))
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("open page file temp file failed, %s", openErr.Error()))
 		return
 	}
 	_, cpErr := io.Copy(localPageTmpFp, resp.Body)
 	if cpErr != nil {
-		err = errors.New(fmt.Sprintf("save page file content to tmp file failed, %s", cpErr.Error()))
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("save page file content to tmp file failed, %s", cpErr.Error()))
 		return
 	}
 
@@ -292,22 +211,23 @@ func (this *Html2Imager) Do(req ufop.UfopRequest) (result interface{}, resultTyp
 	cmdParams = append(cmdParams, localPageTmpFpath, resultTmpFpath)
 
 	//cmd
-	convertCmd := exec.Command("wkhtmltoimage", cmdParams...)
+	convertCmd := exec.CommandContext(ctx, "wkhtmltoimage", cmdParams...)
 
 	stdErrPipe, pipeErr := convertCmd.StderrPipe()
 	if pipeErr != nil {
-		err = errors.New(fmt.Sprintf("open exec stderr pipe error, %s", pipeErr.Error()))
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("open exec stderr pipe error, %s", pipeErr.Error()))
 		return
 	}
 
+	execStart := time.Now()
 	if startErr := convertCmd.Start(); startErr != nil {
-		err = errors.New(fmt.Sprintf("start html2image command error, %s", startErr.Error()))
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("start html2image command error, %s", startErr.Error()))
 		return
 	}
 
 	stdErrData, readErr := ioutil.ReadAll(stdErrPipe)
 	if readErr != nil {
-		err = errors.New(fmt.Sprintf("read html2image command stderr error, %s", readErr.Error()))
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("read html2image command stderr error, %s", readErr.Error()))
 		defer os.Remove(resultTmpFpath)
 		return
 	}
@@ -317,14 +237,18 @@ func (this *Html2Imager) Do(req ufop.UfopRequest) (result interface{}, resultTyp
 		log.Error(string(stdErrData))
 	}
 
-	if waitErr := convertCmd.Wait(); waitErr != nil {
-		err = errors.New(fmt.Sprintf("wait html2image to exit error, %s", waitErr.Error()))
+	waitErr := convertCmd.Wait()
+	utils.ObserveExec(ctx, "wkhtmltoimage", time.Since(execStart))
+	if waitErr != nil {
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("wait html2image to exit error, %s", waitErr.Error())).
+			WithDetail("stderr", string(stdErrData))
 		defer os.Remove(resultTmpFpath)
 		return
 	}
 
 	if oFileInfo, statErr := os.Stat(resultTmpFpath); statErr != nil || oFileInfo.Size() == 0 {
-		err = errors.New("html2image with no valid output result")
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, "html2image with no valid output result").
+			WithDetail("stderr", string(stdErrData))
 		defer os.Remove(resultTmpFpath)
 		return
 	}
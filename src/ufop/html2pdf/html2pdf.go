@@ -1,21 +1,20 @@
 package html2pdf
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/qiniu/log"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
-	"strconv"
 	"strings"
 	"time"
 	"ufop"
+	"ufop/cmdspec"
 	"ufop/utils"
 )
 
@@ -35,13 +34,13 @@ type Html2PdferConfig struct {
 }
 
 type Html2PdfOptions struct {
-	Gray        bool
-	LowQuality  bool
-	Orientation string
-	Size        string
-	Title       string
-	Collate     bool
-	Copies      int
+	Gray        bool   `cmd:"gray"`
+	LowQuality  bool   `cmd:"low"`
+	Orientation string `cmd:"orient"`
+	Size        string `cmd:"size"`
+	Title       string `cmd:"title"`
+	Collate     bool   `cmd:"collate"`
+	Copies      int    `cmd:"copies"`
 }
 
 func (this *Html2Pdfer) Name() string {
@@ -78,80 +77,41 @@ func (this *Html2Pdfer) InitConfig(jobConf string) (err error) {
 	return
 }
 
-func (this *Html2Pdfer) parse(cmd string) (options *Html2PdfOptions, err error) {
-	pattern := `^html2pdf(/gray/[0|1]|/low/[0|1]|/orient/(Portrait|Landscape)|/size/[A-B][0-8]|/title/[0-9a-zA-Z-_=]+|/collate/[0|1]|/copies/\d+){0,7}$`
-	matched, _ := regexp.MatchString(pattern, cmd)
-	if !matched {
-		err = errors.New("invalid html2pdf command format")
-		return
-	}
-
-	var decodeErr error
-
-	//get optional parameters
-
-	options = &Html2PdfOptions{
-		Collate: true,
-		Copies:  1,
-	}
-
-	//get gray
-	grayStr := utils.GetParam(cmd, "gray/[0|1]", "gray")
-	if grayStr != "" {
-		grayInt, _ := strconv.Atoi(grayStr)
-		if grayInt == 1 {
-			options.Gray = true
-		}
-	}
+func (this *Html2Pdfer) Syntax() string {
+	return html2pdfSpec.Syntax()
+}
 
-	//get low quality
-	lowStr := utils.GetParam(cmd, "low/[0|1]", "low")
-	if lowStr != "" {
-		lowInt, _ := strconv.Atoi(lowStr)
-		if lowInt == 1 {
-			options.LowQuality = true
-		}
+func (this *Html2Pdfer) Limits() map[string]interface{} {
+	return map[string]interface{}{
+		"html2pdf_max_page_size": this.maxPageSize,
+		"html2pdf_max_copies":    this.maxCopies,
 	}
+}
 
-	//orient
-	options.Orientation = utils.GetParam(cmd, "orient/(Portrait|Landscape)", "orient")
-
-	//size
-	options.Size = utils.GetParam(cmd, "size/[A-B][0-8]", "size")
-
-	//title
-	title, decodeErr := utils.GetParamDecoded(cmd, "title/[0-9a-zA-Z-_=]+", "title")
-	if decodeErr != nil {
-		err = errors.New("invalid html2pdf parameter 'title'")
-		return
-	}
-	options.Title = title
-
-	//collate
-	collateStr := utils.GetParam(cmd, "collate/[0|1]", "collate")
-	if collateStr != "" {
-		collateInt, _ := strconv.Atoi(collateStr)
-		if collateInt == 0 {
-			options.Collate = false
-		}
-	}
+func (this *Html2Pdfer) CheckReady() error {
+	return utils.CheckCommands("wkhtmltopdf")
+}
 
-	//copies
-	copiesStr := utils.GetParam(cmd, `copies/\d+`, "copies")
-	if copiesStr != "" {
-		copiesInt, _ := strconv.Atoi(copiesStr)
-		if copiesInt <= 0 {
-			err = errors.New("invalid html2pdf parameter 'copies'")
-			return
-		} else {
-			options.Copies = copiesInt
-		}
-	}
+var html2pdfSpec = cmdspec.Spec{
+	Name: "html2pdf",
+	Params: []cmdspec.Param{
+		{Name: "gray", Type: cmdspec.PARAM_BOOL},
+		{Name: "low", Type: cmdspec.PARAM_BOOL},
+		{Name: "orient", Type: cmdspec.PARAM_ENUM, Values: []string{"Portrait", "Landscape"}},
+		{Name: "size", Type: cmdspec.PARAM_STRING, Pattern: "^[A-B][0-8]$"},
+		{Name: "title", Type: cmdspec.PARAM_BASE64},
+		{Name: "collate", Type: cmdspec.PARAM_BOOL, Default: true},
+		{Name: "copies", Type: cmdspec.PARAM_INT, Min: cmdspec.Limit(1), Default: 1},
+	},
+}
 
+func (this *Html2Pdfer) parse(cmd string) (options *Html2PdfOptions, err error) {
+	options = &Html2PdfOptions{}
+	err = html2pdfSpec.Parse(cmd, options)
 	return
 }
 
-func (this *Html2Pdfer) Do(req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
+func (this *Html2Pdfer) DoContext(ctx context.Context, req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
 	options, pErr := this.parse(req.Cmd)
 	if pErr != nil {
 		err = pErr
@@ -160,28 +120,30 @@ func (this *Html2Pdfer) Do(req ufop.UfopRequest) (result interface{}, resultType
 
 	//if not text format, error it
 	if !strings.HasPrefix(req.Src.MimeType, "text/") {
-		err = errors.New("unsupported file mime type, only text/* allowed")
+		err = ufop.NewUfopError(ufop.E_SRC_UNSUPPORTED, "unsupported file mime type, only text/* allowed")
 		return
 	}
 
 	//if file size exceeds, error it
 	if req.Src.Fsize > this.maxPageSize {
-		err = errors.New("page file length exceeds the limit")
+		err = ufop.NewUfopError(ufop.E_SRC_TOO_LARGE, "page file length exceeds the limit").
+			WithDetail("limit", this.maxPageSize)
 		return
 	}
 
 	if options.Copies > this.maxCopies {
-		err = errors.New("pdf copies exceeds the limit")
+		err = ufop.NewUfopError(ufop.E_LIMIT_EXCEEDED, "pdf copies exceeds the limit").
+			WithDetail("limit", this.maxCopies)
 		return
 	}
 
 	//get page file content save it into temp dir
-	resp, respErr := http.Get(req.Src.Url)
+	resp, respErr := utils.HttpGet(ctx, req.Src.Url)
 	if respErr != nil || resp.StatusCode != 200 {
 		if respErr != nil {
-			err = errors.New(fmt.Sprintf("retrieve page file resource data failed, %s", respErr.Error()))
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("retrieve page file resource data failed, %s", respErr.Error()))
 		} else {
-			err = errors.New(fmt.Sprintf("retrieve page file resource data failed, %s", resp.Status))
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("retrieve page file resource data failed, %s", resp.Status))
 			if resp.Body != nil {
 				resp.Body.Close()
 			}
@@ -202,12 +164,12 @@ func (this *Html2Pdfer) Do(req ufop.UfopRequest) (result interface{}, resultType
 
 	localPageTmpFp, openErr := os.OpenFile(localPageTmpFpath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0655)
 	if openErr != nil {
-		err = errors.New(fmt.Sprintf("open page file temp file failed, %s", openErr.Error()))
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("open page file temp file failed, %s", openErr.Error()))
 		return
 	}
 	_, cpErr := io.Copy(localPageTmpFp, resp.Body)
 	if cpErr != nil {
-		err = errors.New(fmt.Sprintf("save page file content to tmp file failed, %s", cpErr.Error()))
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("save page file content to tmp file failed, %s", cpErr.Error()))
 		return
 	}
 
@@ -253,22 +215,23 @@ func (this *Html2Pdfer) Do(req ufop.UfopRequest) (result interface{}, resultType
 	cmdParams = append(cmdParams, localPageTmpFpath, resultTmpFpath)
 
 	//cmd
-	convertCmd := exec.Command("wkhtmltopdf", cmdParams...)
+	convertCmd := exec.CommandContext(ctx, "wkhtmltopdf", cmdParams...)
 
 	stdErrPipe, pipeErr := convertCmd.StderrPipe()
 	if pipeErr != nil {
-		err = errors.New(fmt.Sprintf("open exec stderr pipe error, %s", pipeErr.Error()))
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("open exec stderr pipe error, %s", pipeErr.Error()))
 		return
 	}
 
+	execStart := time.Now()
 	if startErr := convertCmd.Start(); startErr != nil {
-		err = errors.New(fmt.Sprintf("start html2pdf command error, %s", startErr.Error()))
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("start html2pdf command error, %s", startErr.Error()))
 		return
 	}
 
 	stdErrData, readErr := ioutil.ReadAll(stdErrPipe)
 	if readErr != nil {
-		err = errors.New(fmt.Sprintf("read html2pdf command stderr error, %s", readErr.Error()))
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("read html2pdf command stderr error, %s", readErr.Error()))
 		defer os.Remove(resultTmpFpath)
 		return
 	}
@@ -278,14 +241,18 @@ func (this *Html2Pdfer) Do(req ufop.UfopRequest) (result interface{}, resultType
 		log.Error(string(stdErrData))
 	}
 
-	if waitErr := convertCmd.Wait(); waitErr != nil {
-		err = errors.New(fmt.Sprintf("wait html2pdf to exit error, %s", waitErr.Error()))
+	waitErr := convertCmd.Wait()
+	utils.ObserveExec(ctx, "wkhtmltopdf", time.Since(execStart))
+	if waitErr != nil {
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("wait html2pdf to exit error, %s", waitErr.Error())).
+			WithDetail("stderr", string(stdErrData))
 		defer os.Remove(resultTmpFpath)
 		return
 	}
 
 	if oFileInfo, statErr := os.Stat(resultTmpFpath); statErr != nil || oFileInfo.Size() == 0 {
-		err = errors.New("html2pdf with no valid output result")
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, "html2pdf with no valid output result").
+			WithDetail("stderr", string(stdErrData))
 		defer os.Remove(resultTmpFpath)
 		return
 	}
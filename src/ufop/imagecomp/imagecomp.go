@@ -2,7 +2,7 @@ package imagecomp
 
 import (
 	"bytes"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,10 +17,10 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"time"
 	"ufop"
+	"ufop/cmdspec"
 	"ufop/utils"
 )
 
@@ -73,6 +73,53 @@ func (this *ImageComposer) InitConfig(jobConf string) (err error) {
 	return
 }
 
+func (this *ImageComposer) Syntax() string {
+	return imagecompSpec.Syntax()
+}
+
+func (this *ImageComposer) Limits() map[string]interface{} {
+	return map[string]interface{}{
+		"imagecomp_max_url_count": IMAGECOMP_MAX_URL_COUNT,
+	}
+}
+
+type ImageCompOptions struct {
+	Bucket  string         `cmd:"bucket"`
+	Format  string         `cmd:"format"`
+	Rows    int            `cmd:"rows"`
+	Cols    int            `cmd:"cols"`
+	HAlign  string         `cmd:"halign"`
+	VAlign  string         `cmd:"valign"`
+	Order   int            `cmd:"order"`
+	Alpha   *int           `cmd:"alpha"`
+	BgColor string         `cmd:"bgcolor"`
+	Margin  int            `cmd:"margin"`
+	Urls    []ImageCompUrl `cmd:"urls"`
+}
+
+type ImageCompUrl struct {
+	Url string `cmd:"url"`
+}
+
+var imagecompSpec = cmdspec.Spec{
+	Name: "imagecomp",
+	Params: []cmdspec.Param{
+		{Name: "bucket", Type: cmdspec.PARAM_BASE64, Required: true},
+		{Name: "format", Type: cmdspec.PARAM_ENUM, Values: []string{"png", "jpg", "jpeg"}, Default: "jpg"},
+		{Name: "rows", Type: cmdspec.PARAM_INT, Min: cmdspec.Limit(0)},
+		{Name: "cols", Type: cmdspec.PARAM_INT, Min: cmdspec.Limit(0)},
+		{Name: "halign", Type: cmdspec.PARAM_ENUM, Values: []string{H_ALIGN_LEFT, H_ALIGN_RIGHT, H_ALIGN_CENTER}, Default: H_ALIGN_LEFT},
+		{Name: "valign", Type: cmdspec.PARAM_ENUM, Values: []string{V_ALIGN_TOP, V_ALIGN_BOTTOM, V_ALIGN_MIDDLE}, Default: V_ALIGN_TOP},
+		{Name: "order", Type: cmdspec.PARAM_INT, Min: cmdspec.Limit(IMAGECOMP_ORDER_BY_ROW), Max: cmdspec.Limit(IMAGECOMP_ORDER_BY_COL), Default: IMAGECOMP_ORDER_BY_COL},
+		{Name: "alpha", Type: cmdspec.PARAM_INT, Min: cmdspec.Limit(0), Max: cmdspec.Limit(255)},
+		{Name: "bgcolor", Type: cmdspec.PARAM_BASE64, Pattern: "^#[a-fA-F0-9]{6}$"},
+		{Name: "margin", Type: cmdspec.PARAM_INT, Min: cmdspec.Limit(0)},
+		{Name: "urls", Type: cmdspec.PARAM_GROUP, Required: true, Params: []cmdspec.Param{
+			{Name: "url", Type: cmdspec.PARAM_BASE64},
+		}},
+	},
+}
+
 /*
 
 imagecomp
@@ -92,59 +139,20 @@ imagecomp
 */
 func (this *ImageComposer) parse(cmd string) (bucket, format, halign, valign string,
 	rows, cols, order int, bgColor color.Color, margin int, urls []map[string]string, err error) {
-	pattern := `^imagecomp/bucket/[0-9a-zA-Z-_=]+(/format/(png|jpg|jpeg)|/halign/(left|right|center)|/valign/(top|bottom|middle)|/rows/\d+|/cols/\d+|/order/(0|1)|/alpha/\d+|/margin/\d+|/bgcolor/[0-9a-zA-Z-_=]+){0,9}(/url/[0-9a-zA-Z-_=]+)+$`
-
-	matched, _ := regexp.MatchString(pattern, cmd)
-	if !matched {
-		err = errors.New("invalid imagecomp command format")
-		return
-	}
-
-	var decodeErr error
-
-	//bucket
-	bucket, decodeErr = utils.GetParamDecoded(cmd, "bucket/[0-9a-zA-Z-_=]+", "bucket")
-	if decodeErr != nil {
-		err = errors.New("invalid imagecomp parameter 'bucket'")
+	options := ImageCompOptions{}
+	if err = imagecompSpec.Parse(cmd, &options); err != nil {
 		return
 	}
 
-	//format
-	format = "jpg"
-	if v := utils.GetParam(cmd, "format/(png|jpg|jpeg)", "format"); v != "" {
-		format = v
-	}
-
+	bucket = options.Bucket
+	format = options.Format
 	//check later by url count
-	//rows
-	rows = 0
-	if rowsStr := utils.GetParam(cmd, `rows/\d+`, "rows"); rowsStr != "" {
-		rows, _ = strconv.Atoi(rowsStr)
-	}
-
-	//cols
-	cols = 0
-	if colsStr := utils.GetParam(cmd, `cols/\d+`, "cols"); colsStr != "" {
-		cols, _ = strconv.Atoi(colsStr)
-	}
-
-	//halign
-	halign = H_ALIGN_LEFT
-	if v := utils.GetParam(cmd, "halign/(left|right|center)", "halign"); v != "" {
-		halign = v
-	}
-
-	//valign
-	valign = V_ALIGN_TOP
-	if v := utils.GetParam(cmd, "valign/(top|bottom|middle)", "valign"); v != "" {
-		valign = v
-	}
-
-	//order
-	order = IMAGECOMP_ORDER_BY_COL
-	if orderStr := utils.GetParam(cmd, "order/(0|1)", "order"); orderStr != "" {
-		order, _ = strconv.Atoi(orderStr)
-	}
+	rows = options.Rows
+	cols = options.Cols
+	halign = options.HAlign
+	valign = options.VAlign
+	order = options.Order
+	margin = options.Margin
 
 	//alpha
 	alpha := 255
@@ -153,66 +161,40 @@ func (this *ImageComposer) parse(cmd string) (bucket, format, halign, valign str
 		alpha = 0
 	}
 
-	if alphaStr := utils.GetParam(cmd, `alpha/\d+`, "alpha"); alphaStr != "" {
-		alpha, _ = strconv.Atoi(alphaStr)
-	}
-
-	if alpha < 0 || alpha > 255 {
-		err = errors.New("invalid imagecomp parameter 'alhpa', should between [0,255]")
-		return
+	if options.Alpha != nil {
+		alpha = *options.Alpha
 	}
 
 	//bgcolor, default white
 	bgColor = color.RGBA{0xFF, 0xFF, 0xFF, uint8(alpha)}
 
-	var bgColorStr string
-	bgColorStr, decodeErr = utils.GetParamDecoded(cmd, "bgcolor/[0-9a-zA-Z-_=]+", "bgcolor")
-	if decodeErr != nil {
-		err = errors.New("invalid imagecomp parameter 'bgcolor'")
-		return
-	} else {
-		if bgColorStr != "" {
-			colorPattern := `^#[a-fA-F0-9]{6}$`
-			if matched, _ := regexp.Match(colorPattern, []byte(bgColorStr)); !matched {
-				err = errors.New("invalid imagecomp parameter 'bgcolor', should in format '#FFFFFF'")
-				return
-			}
-
-			bgColorStr = bgColorStr[1:]
+	if options.BgColor != "" {
+		bgColorStr := options.BgColor[1:]
 
-			redPart := bgColorStr[0:2]
-			greenPart := bgColorStr[2:4]
-			bluePart := bgColorStr[4:6]
+		redPart := bgColorStr[0:2]
+		greenPart := bgColorStr[2:4]
+		bluePart := bgColorStr[4:6]
 
-			redInt, _ := strconv.ParseInt(redPart, 16, 64)
-			greenInt, _ := strconv.ParseInt(greenPart, 16, 64)
-			blueInt, _ := strconv.ParseInt(bluePart, 16, 64)
+		redInt, _ := strconv.ParseInt(redPart, 16, 64)
+		greenInt, _ := strconv.ParseInt(greenPart, 16, 64)
+		blueInt, _ := strconv.ParseInt(bluePart, 16, 64)
 
-			bgColor = color.RGBA{
-				uint8(redInt),
-				uint8(greenInt),
-				uint8(blueInt),
-				uint8(alpha),
-			}
+		bgColor = color.RGBA{
+			uint8(redInt),
+			uint8(greenInt),
+			uint8(blueInt),
+			uint8(alpha),
 		}
 	}
 
-	//margin
-	margin = 0
-	if marginStr := utils.GetParam(cmd, `margin/\d+`, "margin"); marginStr != "" {
-		margin, _ = strconv.Atoi(marginStr)
-	}
-
 	//urls
 	urls = make([]map[string]string, 0)
-	urlsPattern := regexp.MustCompile("url/[0-9a-zA-Z-_=]+")
-	urlStrings := urlsPattern.FindAllString(cmd, -1)
-	for _, urlString := range urlStrings {
-		urlBytes, _ := base64.URLEncoding.DecodeString(urlString[4:])
-		urlStr := string(urlBytes)
+	for _, imageUrl := range options.Urls {
+		urlStr := imageUrl.Url
 		uri, pErr := url.Parse(urlStr)
 		if pErr != nil {
-			err = errors.New(fmt.Sprintf("invalid imagecomp parameter 'url', wrong '%s'", urlStr))
+			err = ufop.NewUfopError(ufop.E_BAD_PARAM, fmt.Sprintf("invalid imagecomp parameter 'url', wrong '%s'", urlStr)).
+				WithDetail("url", urlStr)
 			return
 		}
 
@@ -226,7 +208,8 @@ func (this *ImageComposer) parse(cmd string) (bucket, format, halign, valign str
 	urlCount := len(urls)
 
 	if urlCount > IMAGECOMP_MAX_URL_COUNT {
-		err = errors.New(fmt.Sprintf("only allow url count not larger than %d", IMAGECOMP_MAX_URL_COUNT))
+		err = ufop.NewUfopError(ufop.E_LIMIT_EXCEEDED, fmt.Sprintf("only allow url count not larger than %d", IMAGECOMP_MAX_URL_COUNT)).
+			WithDetail("limit", IMAGECOMP_MAX_URL_COUNT)
 		return
 	}
 
@@ -235,7 +218,7 @@ func (this *ImageComposer) parse(cmd string) (bucket, format, halign, valign str
 		rows = urlCount / cols
 	} else if rows == 0 && cols != 0 {
 		if cols > urlCount {
-			err = errors.New("cols larger than url count error")
+			err = ufop.NewUfopError(ufop.E_BAD_PARAM, "cols larger than url count error")
 			return
 		}
 		if urlCount%cols == 0 {
@@ -245,7 +228,7 @@ func (this *ImageComposer) parse(cmd string) (bucket, format, halign, valign str
 		}
 	} else if rows != 0 && cols == 0 {
 		if rows > urlCount {
-			err = errors.New("rows larger than url count error")
+			err = ufop.NewUfopError(ufop.E_BAD_PARAM, "rows larger than url count error")
 			return
 		}
 		if urlCount%rows == 0 {
@@ -255,7 +238,7 @@ func (this *ImageComposer) parse(cmd string) (bucket, format, halign, valign str
 		}
 	} else {
 		if urlCount > rows*cols {
-			err = errors.New("url count larger than rows*cols error")
+			err = ufop.NewUfopError(ufop.E_BAD_PARAM, "url count larger than rows*cols error")
 			return
 		}
 
@@ -263,12 +246,12 @@ func (this *ImageComposer) parse(cmd string) (bucket, format, halign, valign str
 			switch order {
 			case IMAGECOMP_ORDER_BY_ROW:
 				if urlCount < (rows-1)*cols+1 {
-					err = errors.New("url count less than (rows-1)*cols+1 error")
+					err = ufop.NewUfopError(ufop.E_BAD_PARAM, "url count less than (rows-1)*cols+1 error")
 					return
 				}
 			case IMAGECOMP_ORDER_BY_COL:
 				if urlCount < rows*(cols-1)+1 {
-					err = errors.New("url count less than rows*(cols-1)+1 error")
+					err = ufop.NewUfopError(ufop.E_BAD_PARAM, "url count less than rows*(cols-1)+1 error")
 					return
 				}
 			}
@@ -278,7 +261,7 @@ func (this *ImageComposer) parse(cmd string) (bucket, format, halign, valign str
 	return
 }
 
-func (this *ImageComposer) Do(req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
+func (this *ImageComposer) DoContext(ctx context.Context, req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
 	bucket, format, halign, valign, rows, cols, order, bgColor, margin, urls, pErr := this.parse(req.Cmd)
 	if pErr != nil {
 		err = pErr
@@ -310,11 +293,11 @@ func (this *ImageComposer) Do(req ufop.UfopRequest) (result interface{}, resultT
 
 	if statErr != nil {
 		if sErr, ok := statErr.(*rpc.ErrorInfo); !ok {
-			err = errors.New(fmt.Sprintf("batch stat error, %s", statErr.Error()))
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_STORAGE, fmt.Sprintf("batch stat error, %s", statErr.Error()))
 			return
 		} else {
 			if sErr.Err != "" {
-				err = errors.New(fmt.Sprintf("batch stat error, %s", sErr.Err))
+				err = ufop.NewUfopError(ufop.E_UPSTREAM_STORAGE, fmt.Sprintf("batch stat error, %s", sErr.Err))
 				return
 			}
 		}
@@ -324,11 +307,14 @@ func (this *ImageComposer) Do(req ufop.UfopRequest) (result interface{}, resultT
 		ret := statRet[index]
 		if ret.Code != 200 {
 			if ret.Code == 612 {
-				err = errors.New(fmt.Sprintf("batch stat '%s' error, no such file or directory", statUrls[index]))
+				err = ufop.NewUfopError(ufop.E_BAD_PARAM, fmt.Sprintf("batch stat '%s' error, no such file or directory", statUrls[index])).
+					WithDetail("url", statUrls[index])
 			} else if ret.Code == 631 {
-				err = errors.New(fmt.Sprintf("batch stat '%s' error, no such bucket", statUrls[index]))
+				err = ufop.NewUfopError(ufop.E_BAD_PARAM, fmt.Sprintf("batch stat '%s' error, no such bucket", statUrls[index])).
+					WithDetail("url", statUrls[index])
 			} else {
-				err = errors.New(fmt.Sprintf("batch stat '%s' error, %d", statUrls[index], ret.Code))
+				err = ufop.NewUfopError(ufop.E_UPSTREAM_STORAGE, fmt.Sprintf("batch stat '%s' error, %d", statUrls[index], ret.Code)).
+					WithDetail("url", statUrls[index])
 			}
 			return
 		}
@@ -342,14 +328,15 @@ func (this *ImageComposer) Do(req ufop.UfopRequest) (result interface{}, resultT
 		iUrl := urlItem["url"]
 		iLocalName := fmt.Sprintf("imagecomp_tmp_%s_%d", utils.Md5Hex(iUrl), time.Now().UnixNano())
 		iLocalPath := filepath.Join(os.TempDir(), iLocalName)
-		dContentType, dErr := utils.Download(iUrl, iLocalPath)
+		dContentType, dErr := utils.Download(ctx, iUrl, iLocalPath)
 		if dErr != nil {
-			err = dErr
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, dErr.Error()).WithDetail("url", iUrl)
 			return
 		}
 
 		if !(dContentType == "image/png" || dContentType == "image/jpeg") {
-			err = errors.New(fmt.Sprintf("unsupported mimetype of '%s', '%s'", iUrl, dContentType))
+			err = ufop.NewUfopError(ufop.E_SRC_UNSUPPORTED, fmt.Sprintf("unsupported mimetype of '%s', '%s'", iUrl, dContentType)).
+				WithDetail("url", iUrl)
 			return
 		}
 
@@ -380,7 +367,7 @@ func (this *ImageComposer) Do(req ufop.UfopRequest) (result interface{}, resultT
 		iContentType := localImgPathTypeMap[iLocalPath]
 		imgFp, openErr := os.Open(iLocalPath)
 		if openErr != nil {
-			err = errors.New(fmt.Sprintf("open local image of remote '%s' failed, %s", remoteImgUrls[iLocalPath], openErr.Error()))
+			err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("open local image of remote '%s' failed, %s", remoteImgUrls[iLocalPath], openErr.Error()))
 			return
 		}
 		localImgFps = append(localImgFps, imgFp)
@@ -391,17 +378,20 @@ func (this *ImageComposer) Do(req ufop.UfopRequest) (result interface{}, resultT
 		if iContentType == "image/png" {
 			imgObj, dErr = png.Decode(imgFp)
 			if dErr != nil {
-				err = errors.New(fmt.Sprintf("decode png image of remote '%s' failed, %s", remoteImgUrls[iLocalPath], dErr.Error()))
+				err = ufop.NewUfopError(ufop.E_SRC_INVALID, fmt.Sprintf("decode png image of remote '%s' failed, %s", remoteImgUrls[iLocalPath], dErr.Error())).
+					WithDetail("url", remoteImgUrls[iLocalPath])
 				return
 			}
 		} else if iContentType == "image/jpeg" {
 			imgObj, dErr = jpeg.Decode(imgFp)
 			if dErr != nil {
-				err = errors.New(fmt.Sprintf("decode jpeg image of remote '%s' failed, %s", remoteImgUrls[iLocalPath], dErr.Error()))
+				err = ufop.NewUfopError(ufop.E_SRC_INVALID, fmt.Sprintf("decode jpeg image of remote '%s' failed, %s", remoteImgUrls[iLocalPath], dErr.Error())).
+					WithDetail("url", remoteImgUrls[iLocalPath])
 				return
 			}
 		} else {
-			err = errors.New(fmt.Sprintf("unsupported src image format '%s' of url '%s'", iContentType, remoteImgUrls[iLocalPath]))
+			err = ufop.NewUfopError(ufop.E_SRC_UNSUPPORTED, fmt.Sprintf("unsupported src image format '%s' of url '%s'", iContentType, remoteImgUrls[iLocalPath])).
+				WithDetail("url", remoteImgUrls[iLocalPath])
 			return
 		}
 
@@ -535,7 +525,7 @@ func (this *ImageComposer) Do(req ufop.UfopRequest) (result interface{}, resultT
 	case "image/png":
 		eErr := png.Encode(buffer, dstImage)
 		if eErr != nil {
-			err = errors.New(fmt.Sprintf("create dst png image failed, %s", eErr))
+			err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("create dst png image failed, %s", eErr))
 			return
 		}
 
@@ -544,7 +534,7 @@ func (this *ImageComposer) Do(req ufop.UfopRequest) (result interface{}, resultT
 			Quality: 100,
 		})
 		if eErr != nil {
-			err = errors.New(fmt.Sprintf("create dst jpeg image failed, %s", eErr))
+			err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("create dst jpeg image failed, %s", eErr))
 			return
 		}
 	}
@@ -0,0 +1,292 @@
+package ufop
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/qiniu/log"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+	"ufop/utils"
+)
+
+const (
+	JOB_STATUS_PENDING = "pending"
+	JOB_STATUS_RUNNING = "running"
+	JOB_STATUS_DONE    = "done"
+	JOB_STATUS_FAILED  = "failed"
+)
+
+const (
+	JOB_CALLBACK_TIMEOUT = 30 * time.Second
+	JOB_CLEAN_INTERVAL   = 60 * time.Second
+)
+
+var ErrJobQueueFull = errors.New("async job queue is full")
+
+type UfopJob struct {
+	Id         string      `json:"id"`
+	Cmd        string      `json:"cmd"`
+	ReqId      string      `json:"reqid,omitempty"`
+	Status     string      `json:"status"`
+	Progress   int         `json:"progress"`
+	Code       string      `json:"code,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Result     interface{} `json:"result,omitempty"`
+	ResultUrl  string      `json:"result_url,omitempty"`
+	CreateTime int64       `json:"create_time"`
+	StartTime  int64       `json:"start_time,omitempty"`
+	FinishTime int64       `json:"finish_time,omitempty"`
+
+	req         UfopRequest
+	result      interface{}
+	resultType  int
+	contentType string
+}
+
+type jobManager struct {
+	lock   sync.RWMutex
+	jobs   map[string]*UfopJob
+	expire time.Duration
+	do     func(ctx context.Context, ufopReq UfopRequest, slot *jobSlot) (interface{}, int, string, error)
+
+	//jobs submitted but not finished
+	pending    int
+	maxPending int
+	//running slots shared by all the handlers
+	workers chan struct{}
+	//signaled when a worker is released, with the lock
+	workerFreed *sync.Cond
+}
+
+func newJobManager(workers, queueSize int, expire time.Duration,
+	do func(ctx context.Context, ufopReq UfopRequest, slot *jobSlot) (interface{}, int, string, error)) *jobManager {
+	m := jobManager{}
+	m.jobs = make(map[string]*UfopJob, 0)
+	m.expire = expire
+	m.do = do
+	m.maxPending = workers + queueSize
+	m.workers = make(chan struct{}, workers)
+	m.workerFreed = sync.NewCond(&m.lock)
+	return &m
+}
+
+//start the cleaner of the expired jobs
+func (this *jobManager) Start() {
+	go this.clean()
+}
+
+//the job waits for a slot of its handler limiter before taking a worker,
+//so a busy handler does not block the jobs of the other handlers
+func (this *jobManager) Submit(reqId string, ufopReq UfopRequest, handlerLimiter *limiter) (snapshot UfopJob, err error) {
+	jobId, idErr := newRandomId()
+	if idErr != nil {
+		err = errors.New(fmt.Sprintf("create job id error, %s", idErr.Error()))
+		return
+	}
+
+	//the secret params of the cmd are hidden, the real cmd is in req
+	job := &UfopJob{
+		Id:         jobId,
+		Cmd:        redactCmd(ufopReq.Cmd),
+		ReqId:      reqId,
+		Status:     JOB_STATUS_PENDING,
+		CreateTime: time.Now().Unix(),
+		req:        ufopReq,
+	}
+
+	snapshot = *job
+
+	this.lock.Lock()
+	if this.pending >= this.maxPending {
+		this.lock.Unlock()
+		err = ErrJobQueueFull
+		return
+	}
+	this.pending += 1
+	this.jobs[jobId] = job
+	this.lock.Unlock()
+
+	go this.run(job, handlerLimiter)
+	return
+}
+
+//get a snapshot of the job, safe to encode while the job is running
+func (this *jobManager) Get(jobId string) (job UfopJob, ok bool) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	var v *UfopJob
+	if v, ok = this.jobs[jobId]; ok {
+		job = *v
+	}
+	return
+}
+
+//the job holds the slot of its handler only while it runs, the handler slot is
+//given back to the sync requests when all the workers are busy
+func (this *jobManager) run(job *UfopJob, handlerLimiter *limiter) {
+	ctx := utils.WithProgressObserver(context.Background(), &jobProgress{this, job})
+	slot := &jobSlot{limiter: handlerLimiter}
+	running := false
+
+	var result interface{}
+	var resultType int
+	var contentType string
+	var err error
+	//the panic of the handler fails the job instead of the process
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error(fmt.Sprintf("[%s] async job '%s' panic, %v\n%s", job.ReqId, job.Id, r, debug.Stack()))
+			err = NewUfopError(E_INTERNAL, fmt.Sprintf("async job panic, %v", r))
+		}
+		if running {
+			this.releaseWorker()
+		}
+		slot.Release()
+		this.finish(job, result, resultType, contentType, err)
+	}()
+
+	for !running {
+		if acquireErr := handlerLimiter.Acquire(ctx); acquireErr != nil {
+			err = NewUfopError(E_CANCELLED, fmt.Sprintf("wait for job slot error, %s", acquireErr.Error()))
+			return
+		}
+		slot.held = true
+
+		this.lock.Lock()
+		select {
+		case this.workers <- struct{}{}:
+			running = true
+			job.Status = JOB_STATUS_RUNNING
+			job.StartTime = time.Now().Unix()
+		default:
+			handlerLimiter.Yield()
+			slot.held = false
+			this.workerFreed.Wait()
+		}
+		this.lock.Unlock()
+	}
+
+	result, resultType, contentType, err = this.do(ctx, job.req, slot)
+	//the result is fetched later, keep the stream in a file
+	if err == nil && resultType == RESULT_TYPE_OCTECT_STREAM {
+		result, err = saveStreamResult(ctx, result)
+		resultType = RESULT_TYPE_OCTECT_FILE
+	}
+}
+
+func (this *jobManager) releaseWorker() {
+	this.lock.Lock()
+	<-this.workers
+	this.workerFreed.Broadcast()
+	this.lock.Unlock()
+}
+
+//set the final status of the job and post it to the callback url
+func (this *jobManager) finish(job *UfopJob, result interface{}, resultType int, contentType string, err error) {
+	this.lock.Lock()
+	this.pending -= 1
+	job.FinishTime = time.Now().Unix()
+	if err != nil {
+		log.Error(fmt.Sprintf("[%s] async job '%s' of cmd '%s' failed, %s", job.ReqId, job.Id, job.Cmd, err.Error()))
+		job.Status = JOB_STATUS_FAILED
+		job.Code = ToUfopError(err).Code
+		job.Error = err.Error()
+	} else {
+		job.Status = JOB_STATUS_DONE
+		job.Progress = 100
+		job.result = result
+		job.resultType = resultType
+		job.contentType = contentType
+		if resultType == RESULT_TYPE_JSON {
+			job.Result = result
+		} else {
+			job.ResultUrl = fmt.Sprintf("/jobs/%s/result", job.Id)
+		}
+	}
+	snapshot := *job
+	this.lock.Unlock()
+
+	if job.req.Callback != "" {
+		this.notify(job.req.Callback, &snapshot)
+	}
+}
+
+//the progress in percent reported by the handler, it never goes back and is 100
+//only when the job is done
+type jobProgress struct {
+	manager *jobManager
+	job     *UfopJob
+}
+
+func (this *jobProgress) ObserveProgress(done, total int) {
+	progress := done * 100 / total
+	if progress > 99 {
+		progress = 99
+	}
+	this.manager.lock.Lock()
+	if progress > this.job.Progress {
+		this.job.Progress = progress
+	}
+	this.manager.lock.Unlock()
+}
+
+//post the final job status to the callback url
+func (this *jobManager) notify(callbackUrl string, job *UfopJob) {
+	data, err := json.Marshal(job)
+	if err != nil {
+		log.Error("encode job callback body error,", err)
+		return
+	}
+
+	client := http.Client{
+		Timeout: JOB_CALLBACK_TIMEOUT,
+	}
+	resp, respErr := client.Post(callbackUrl, "application/json", bytes.NewReader(data))
+	if respErr != nil {
+		log.Error(fmt.Sprintf("callback job '%s' to '%s' error, %s", job.Id, callbackUrl, respErr.Error()))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Error(fmt.Sprintf("callback job '%s' to '%s' error, %s", job.Id, callbackUrl, resp.Status))
+	}
+}
+
+//remove the finished jobs and their result files after they expire
+func (this *jobManager) clean() {
+	for range time.Tick(JOB_CLEAN_INTERVAL) {
+		deadline := time.Now().Add(-this.expire).Unix()
+		this.lock.Lock()
+		for jobId, job := range this.jobs {
+			if job.FinishTime == 0 || job.FinishTime > deadline {
+				continue
+			}
+			if job.resultType == RESULT_TYPE_OCTECT_FILE {
+				if filePath, ok := job.result.(string); ok {
+					os.Remove(filePath)
+				}
+			}
+			delete(this.jobs, jobId)
+		}
+		this.lock.Unlock()
+	}
+}
+
+//the job id and the request id
+func newRandomId() (id string, err error) {
+	idBytes := make([]byte, 12)
+	if _, err = rand.Read(idBytes); err != nil {
+		return
+	}
+	id = hex.EncodeToString(idBytes)
+	return
+}
@@ -0,0 +1,115 @@
+package ufop
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var errLimiterFull = errors.New("too many jobs of the fop, please retry later")
+
+//limit the running jobs of a handler, and the jobs waiting for a slot
+//a nil limiter means no limit
+type limiter struct {
+	slots chan struct{}
+
+	lock       sync.Mutex
+	pending    int
+	maxPending int
+}
+
+func newLimiter(maxConcurrency, queueDepth int) *limiter {
+	l := limiter{}
+	l.slots = make(chan struct{}, maxConcurrency)
+	l.maxPending = maxConcurrency + queueDepth
+	return &l
+}
+
+//take a place in the queue, false if the queue is full
+func (this *limiter) Enter() bool {
+	if this == nil {
+		return true
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.pending >= this.maxPending {
+		return false
+	}
+	this.pending += 1
+	return true
+}
+
+//leave the queue without running
+func (this *limiter) Leave() {
+	if this == nil {
+		return
+	}
+	this.lock.Lock()
+	this.pending -= 1
+	this.lock.Unlock()
+}
+
+//wait for a running slot, must be called after Enter
+func (this *limiter) Acquire(ctx context.Context) error {
+	if this == nil {
+		return nil
+	}
+	select {
+	case this.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		this.Leave()
+		return ctx.Err()
+	}
+}
+
+//give the running slot back but keep the place in the queue, Acquire again to run
+func (this *limiter) Yield() {
+	if this == nil {
+		return
+	}
+	<-this.slots
+}
+
+//release the running slot and leave the queue
+func (this *limiter) Release() {
+	if this == nil {
+		return
+	}
+	<-this.slots
+	this.Leave()
+}
+
+//the slot held by a job, the pipeline releases the slot of a stage before taking
+//the slot of the next stage, so a job never holds two slots and the pipelines like
+//a|b and b|a never wait for each other, a nil slot means no limit
+type jobSlot struct {
+	limiter *limiter
+	held    bool
+}
+
+//take a place in the queue and wait for a running slot of the limiter, the slot
+//held is released first unless it is of the same limiter
+func (this *jobSlot) Acquire(ctx context.Context, l *limiter) error {
+	if this == nil || (this.held && this.limiter == l) {
+		return nil
+	}
+	this.Release()
+	if !l.Enter() {
+		return errLimiterFull
+	}
+	if err := l.Acquire(ctx); err != nil {
+		return err
+	}
+	this.limiter = l
+	this.held = true
+	return nil
+}
+
+func (this *jobSlot) Release() {
+	if this == nil || !this.held {
+		return
+	}
+	this.limiter.Release()
+	this.held = false
+}
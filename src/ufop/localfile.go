@@ -0,0 +1,113 @@
+package ufop
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+//serve the local files by a loopback http server, so the local files
+//can be used as the Src.Url of the handlers which download the resource
+type localFileServer struct {
+	listener net.Listener
+
+	lock  sync.RWMutex
+	files map[string]localFile
+	seq   int
+}
+
+type localFile struct {
+	path     string
+	mimeType string
+}
+
+func newLocalFileServer() (serv *localFileServer, err error) {
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		err = errors.New(fmt.Sprintf("listen local file server error, %s", listenErr.Error()))
+		return
+	}
+
+	serv = &localFileServer{
+		listener: listener,
+		files:    make(map[string]localFile),
+	}
+	go http.Serve(listener, serv)
+	return
+}
+
+//add the local file and get the src of the ufop request, the mimetype is detected
+//by the file extension or the file content if not specified
+func (this *localFileServer) Add(filePath, mimeType string) (src UfopRequestSrc, err error) {
+	fileInfo, statErr := os.Stat(filePath)
+	if statErr != nil {
+		err = errors.New(fmt.Sprintf("stat local file error, %s", statErr.Error()))
+		return
+	}
+	if !fileInfo.Mode().IsRegular() {
+		err = errors.New(fmt.Sprintf("local file '%s' is not a regular file", filePath))
+		return
+	}
+
+	if mimeType == "" {
+		if mimeType, err = detectMimeType(filePath); err != nil {
+			return
+		}
+	}
+
+	this.lock.Lock()
+	this.seq += 1
+	name := fmt.Sprintf("%d/%s", this.seq, filepath.Base(filePath))
+	this.files[name] = localFile{filePath, mimeType}
+	this.lock.Unlock()
+
+	src = UfopRequestSrc{
+		Url:      fmt.Sprintf("http://%s/%s", this.listener.Addr().String(), name),
+		MimeType: mimeType,
+		Fsize:    uint64(fileInfo.Size()),
+	}
+	return
+}
+
+func (this *localFileServer) Close() {
+	this.listener.Close()
+}
+
+func (this *localFileServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	this.lock.RLock()
+	file, ok := this.files[strings.TrimPrefix(req.URL.Path, "/")]
+	this.lock.RUnlock()
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", file.mimeType)
+	http.ServeFile(w, req, file.path)
+}
+
+func detectMimeType(filePath string) (mimeType string, err error) {
+	if mimeType = mime.TypeByExtension(filepath.Ext(filePath)); mimeType != "" {
+		//drop the parameters like charset, the handlers check the plain type
+		mimeType = strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0])
+		return
+	}
+
+	fp, openErr := os.Open(filePath)
+	if openErr != nil {
+		err = errors.New(fmt.Sprintf("open local file error, %s", openErr.Error()))
+		return
+	}
+	defer fp.Close()
+
+	head := make([]byte, 512)
+	n, _ := fp.Read(head)
+	mimeType = strings.TrimSpace(strings.SplitN(http.DetectContentType(head[:n]), ";", 2)[0])
+	return
+}
@@ -0,0 +1,261 @@
+package ufop
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OUTCOME_SUCCESS  = "success"
+	OUTCOME_ERROR    = "error"
+	OUTCOME_REJECTED = "rejected"
+)
+
+//interval to walk the temp dir for the disk usage
+const TEMP_DISK_SAMPLE_INTERVAL = time.Second * 30
+
+//seconds
+var metricsDurationBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800}
+
+type histogram struct {
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func (this *histogram) observe(v float64) {
+	if this.counts == nil {
+		this.counts = make([]int64, len(metricsDurationBuckets))
+	}
+	for i, bound := range metricsDurationBuckets {
+		if v <= bound {
+			this.counts[i] += 1
+		}
+	}
+	this.sum += v
+	this.count += 1
+}
+
+//metrics of the ufop jobs in prometheus text format,
+//the handler label is the fop name registered with the ufop prefix
+type ufopMetrics struct {
+	lock sync.Mutex
+
+	requests      map[string]map[string]int64
+	durations     map[string]*histogram
+	downloadBytes map[string]int64
+	responseBytes map[string]int64
+	inFlight      map[string]int64
+	execDurations map[string]map[string]*histogram
+	//sampled in the background
+	tempDiskBytes int64
+}
+
+func newUfopMetrics() *ufopMetrics {
+	m := ufopMetrics{}
+	m.requests = make(map[string]map[string]int64)
+	m.durations = make(map[string]*histogram)
+	m.downloadBytes = make(map[string]int64)
+	m.responseBytes = make(map[string]int64)
+	m.inFlight = make(map[string]int64)
+	m.execDurations = make(map[string]map[string]*histogram)
+	return &m
+}
+
+func (this *ufopMetrics) jobStarted(handler string) {
+	this.lock.Lock()
+	this.inFlight[handler] += 1
+	this.lock.Unlock()
+}
+
+func (this *ufopMetrics) jobFinished(handler string, duration time.Duration, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.inFlight[handler] -= 1
+	if err != nil {
+		this.countRequest(handler, OUTCOME_ERROR)
+	} else {
+		this.countRequest(handler, OUTCOME_SUCCESS)
+	}
+	if _, ok := this.durations[handler]; !ok {
+		this.durations[handler] = &histogram{}
+	}
+	this.durations[handler].observe(duration.Seconds())
+}
+
+func (this *ufopMetrics) jobRejected(handler string) {
+	this.lock.Lock()
+	this.countRequest(handler, OUTCOME_REJECTED)
+	this.lock.Unlock()
+}
+
+func (this *ufopMetrics) countRequest(handler, outcome string) {
+	if _, ok := this.requests[handler]; !ok {
+		this.requests[handler] = make(map[string]int64)
+	}
+	this.requests[handler][outcome] += 1
+}
+
+func (this *ufopMetrics) addResponseBytes(handler string, n int64) {
+	this.lock.Lock()
+	this.responseBytes[handler] += n
+	this.lock.Unlock()
+}
+
+//observer of a single job, passed to the handler by the context
+type jobObserver struct {
+	metrics *ufopMetrics
+	handler string
+}
+
+func (this *jobObserver) ObserveDownload(n int64) {
+	this.metrics.lock.Lock()
+	this.metrics.downloadBytes[this.handler] += n
+	this.metrics.lock.Unlock()
+}
+
+func (this *jobObserver) ObserveExec(command string, duration time.Duration) {
+	this.metrics.lock.Lock()
+	defer this.metrics.lock.Unlock()
+	if _, ok := this.metrics.execDurations[this.handler]; !ok {
+		this.metrics.execDurations[this.handler] = make(map[string]*histogram)
+	}
+	if _, ok := this.metrics.execDurations[this.handler][command]; !ok {
+		this.metrics.execDurations[this.handler][command] = &histogram{}
+	}
+	this.metrics.execDurations[this.handler][command].observe(duration.Seconds())
+}
+
+//count the bytes written to the client
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (this *countingResponseWriter) Write(p []byte) (n int, err error) {
+	n, err = this.ResponseWriter.Write(p)
+	this.written += int64(n)
+	return
+}
+
+func (this *ufopMetrics) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	writeMetricsHeader(w, "ufop_requests_total", "counter", "Ufop requests by handler and outcome.")
+	for _, handler := range sortedKeys(this.requests) {
+		outcomes := this.requests[handler]
+		for _, outcome := range sortedKeys(outcomes) {
+			fmt.Fprintf(w, "ufop_requests_total{handler=%q,outcome=%q} %d\n", handler, outcome, outcomes[outcome])
+		}
+	}
+
+	writeMetricsHeader(w, "ufop_request_duration_seconds", "histogram", "Ufop job latency by handler.")
+	for _, handler := range sortedKeys(this.durations) {
+		writeHistogram(w, "ufop_request_duration_seconds", fmt.Sprintf("handler=%q", handler), this.durations[handler])
+	}
+
+	writeMetricsHeader(w, "ufop_download_bytes_total", "counter", "Bytes downloaded from the resource urls by handler.")
+	for _, handler := range sortedKeys(this.downloadBytes) {
+		fmt.Fprintf(w, "ufop_download_bytes_total{handler=%q} %d\n", handler, this.downloadBytes[handler])
+	}
+
+	writeMetricsHeader(w, "ufop_response_bytes_total", "counter", "Bytes returned to the client by handler.")
+	for _, handler := range sortedKeys(this.responseBytes) {
+		fmt.Fprintf(w, "ufop_response_bytes_total{handler=%q} %d\n", handler, this.responseBytes[handler])
+	}
+
+	writeMetricsHeader(w, "ufop_jobs_in_flight", "gauge", "Ufop jobs running by handler.")
+	for _, handler := range sortedKeys(this.inFlight) {
+		fmt.Fprintf(w, "ufop_jobs_in_flight{handler=%q} %d\n", handler, this.inFlight[handler])
+	}
+
+	writeMetricsHeader(w, "ufop_subprocess_duration_seconds", "histogram", "Runtime of the external commands by handler.")
+	for _, handler := range sortedKeys(this.execDurations) {
+		commands := this.execDurations[handler]
+		for _, command := range sortedKeys(commands) {
+			writeHistogram(w, "ufop_subprocess_duration_seconds",
+				fmt.Sprintf("handler=%q,command=%q", handler, command), commands[command])
+		}
+	}
+
+	writeMetricsHeader(w, "ufop_temp_disk_bytes", "gauge", "Bytes used by the files in the temp dir of the service.")
+	fmt.Fprintf(w, "ufop_temp_disk_bytes %d\n", this.tempDiskBytes)
+}
+
+func writeMetricsHeader(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func writeHistogram(w io.Writer, name, labels string, h *histogram) {
+	for i, bound := range metricsDurationBuckets {
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+func sortedKeys(m interface{}) (keys []string) {
+	switch v := m.(type) {
+	case map[string]int64:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]*histogram:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]map[string]int64:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]map[string]*histogram:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return
+}
+
+//walk the temp dir of this service periodically, out of the lock and the scrapes
+func (this *ufopMetrics) sampleTempDisk(tmpDir string) {
+	go func() {
+		for {
+			usage := tempDiskUsage(tmpDir)
+			this.lock.Lock()
+			this.tempDiskBytes = usage
+			this.lock.Unlock()
+			time.Sleep(TEMP_DISK_SAMPLE_INTERVAL)
+		}
+	}()
+}
+
+func tempDiskUsage(tmpDir string) (usage int64) {
+	filepath.Walk(tmpDir, func(path string, info os.FileInfo, err error) error {
+		//skip the files removed or not readable while walking
+		if err != nil {
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			usage += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+//get the handler label of the fop cmd, the first fop of the pipeline
+func fopOf(cmd string) string {
+	return strings.SplitN(pipelineCmds(cmd)[0], "/", 2)[0]
+}
@@ -0,0 +1,341 @@
+package mkzip
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	FORMAT_ZIP    = "zip"
+	FORMAT_TAR    = "tar"
+	FORMAT_TAR_GZ = "tar.gz"
+)
+
+var formatContentTypes = map[string]string{
+	FORMAT_ZIP:    "application/zip",
+	FORMAT_TAR:    "application/x-tar",
+	FORMAT_TAR_GZ: "application/gzip",
+}
+
+//the compression method of the entries, only for zip
+const (
+	//store the compressed media like jpg or mp4, deflate the others
+	METHOD_AUTO    = "auto"
+	METHOD_STORE   = "store"
+	METHOD_DEFLATE = "deflate"
+)
+
+//the media compressed already, deflate makes them no smaller
+var compressedMimeTypes = map[string]bool{
+	"image/jpeg":                   true,
+	"image/png":                    true,
+	"image/gif":                    true,
+	"image/webp":                   true,
+	"audio/mpeg":                   true,
+	"audio/mp4":                    true,
+	"audio/aac":                    true,
+	"audio/ogg":                    true,
+	"application/zip":              true,
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+}
+
+var compressedExts = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+	".mp3": true, ".m4a": true, ".aac": true, ".ogg": true,
+	".mp4": true, ".mov": true, ".mkv": true, ".flv": true, ".webm": true,
+	".zip": true, ".gz": true, ".bz2": true, ".xz": true, ".7z": true, ".rar": true,
+}
+
+//the method of auto decided by the mimetype in the bucket, or the extension of the alias
+func autoMethod(mimeType, alias string) string {
+	if strings.HasPrefix(mimeType, "video/") || compressedMimeTypes[mimeType] ||
+		compressedExts[strings.ToLower(path.Ext(alias))] {
+		return METHOD_STORE
+	}
+	return METHOD_DEFLATE
+}
+
+//write the entries of the archive in the format
+type archiveWriter interface {
+	writeDir(name string, modTime time.Time) error
+	writeFile(name string, modTime time.Time, method string, filePath string, fileSize int64) error
+	Close() error
+}
+
+//the level is the deflate level of zip or the gzip level of tar.gz, the names and the
+//comment of zip are encoded already, nonUTF8 is set when they are not utf8, the files
+//of zip are encrypted when the password is set
+func newArchiveWriter(w io.Writer, format string, level int, comment string, nonUTF8 bool,
+	password []byte, encryption string) (writer archiveWriter, err error) {
+	switch format {
+	case FORMAT_ZIP:
+		zipWriter := zip.NewWriter(w)
+		zipWriter.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, level)
+		})
+		if comment != "" {
+			if err = zipWriter.SetComment(comment); err != nil {
+				return
+			}
+		}
+		writer = &zipArchiveWriter{
+			zipWriter:  zipWriter,
+			nonUTF8:    nonUTF8,
+			level:      level,
+			password:   password,
+			encryption: encryption,
+		}
+	case FORMAT_TAR, FORMAT_TAR_GZ:
+		tarArchive := &tarArchiveWriter{}
+		if format == FORMAT_TAR_GZ {
+			if tarArchive.gzipWriter, err = gzip.NewWriterLevel(w, level); err != nil {
+				return
+			}
+			w = tarArchive.gzipWriter
+		}
+		tarArchive.tarWriter = tar.NewWriter(w)
+		//the pax names must be utf8, the gnu names are the raw bytes
+		if nonUTF8 {
+			tarArchive.format = tar.FormatGNU
+		}
+		//the comment is kept in the pax global header
+		if comment != "" {
+			err = tarArchive.tarWriter.WriteHeader(&tar.Header{
+				Typeflag:   tar.TypeXGlobalHeader,
+				PAXRecords: map[string]string{"comment": comment},
+			})
+			if err != nil {
+				return
+			}
+		}
+		writer = tarArchive
+	default:
+		err = errors.New(fmt.Sprintf("unsupported archive format '%s'", format))
+	}
+	return
+}
+
+type zipArchiveWriter struct {
+	zipWriter *zip.Writer
+	nonUTF8   bool
+	level     int
+	//aes256 or zipcrypto
+	password   []byte
+	encryption string
+}
+
+func (this *zipArchiveWriter) writeDir(name string, modTime time.Time) (err error) {
+	_, err = this.zipWriter.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: modTime,
+		NonUTF8:  this.nonUTF8,
+	})
+	return
+}
+
+func (this *zipArchiveWriter) writeFile(name string, modTime time.Time, method string, filePath string, fileSize int64) (err error) {
+	header := zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modTime,
+		NonUTF8:  this.nonUTF8,
+	}
+	if method == METHOD_STORE {
+		header.Method = zip.Store
+	}
+	if len(this.password) > 0 {
+		err = this.writeEncryptedFile(&header, filePath, fileSize)
+		return
+	}
+	fw, fErr := this.zipWriter.CreateHeader(&header)
+	if fErr != nil {
+		err = fErr
+		return
+	}
+	err = copyFile(fw, filePath)
+	return
+}
+
+//the entry is compressed and encrypted to a temp file first, the sizes and the crc
+//are written in the local header, the data descriptor is not supported by the
+//decryption of some old readers
+func (this *zipArchiveWriter) writeEncryptedFile(header *zip.FileHeader, filePath string, fileSize int64) (err error) {
+	var crc uint32
+	if this.encryption == ENCRYPTION_ZIPCRYPTO {
+		if crc, err = fileCRC32(filePath); err != nil {
+			return
+		}
+	}
+
+	encFp, tmpErr := ioutil.TempFile("", "mkzip_enc_")
+	if tmpErr != nil {
+		err = tmpErr
+		return
+	}
+	defer os.Remove(encFp.Name())
+	defer encFp.Close()
+
+	var encWriter io.WriteCloser
+	if this.encryption == ENCRYPTION_ZIPCRYPTO {
+		encWriter, err = newZipCryptoWriter(encFp, this.password, crc)
+	} else {
+		encWriter, err = newAesWriter(encFp, this.password)
+	}
+	if err != nil {
+		return
+	}
+	if header.Method == zip.Deflate {
+		flateWriter, fErr := flate.NewWriter(encWriter, this.level)
+		if fErr != nil {
+			err = fErr
+			return
+		}
+		if err = copyFile(flateWriter, filePath); err != nil {
+			return
+		}
+		if err = flateWriter.Close(); err != nil {
+			return
+		}
+	} else if err = copyFile(encWriter, filePath); err != nil {
+		return
+	}
+	if err = encWriter.Close(); err != nil {
+		return
+	}
+	encSize, seekErr := encFp.Seek(0, io.SeekCurrent)
+	if seekErr != nil {
+		err = seekErr
+		return
+	}
+	if _, err = encFp.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	//the fields set by CreateHeader are set here for CreateRaw
+	header.Flags |= 0x1
+	if !this.nonUTF8 {
+		header.Flags |= 0x800
+	}
+	header.CreatorVersion = 20
+	header.ReaderVersion = 20
+	header.ModifiedDate, header.ModifiedTime = msDosTime(header.Modified)
+	header.Extra = append(header.Extra, extTimeExtra(header.Modified)...)
+	header.CRC32 = crc
+	header.CompressedSize64 = uint64(encSize)
+	header.UncompressedSize64 = uint64(fileSize)
+	if this.encryption != ENCRYPTION_ZIPCRYPTO {
+		header.CreatorVersion = 51
+		header.ReaderVersion = 51
+		header.Extra = append(header.Extra, aesExtra(header.Method)...)
+		header.Method = ZIP_METHOD_AES
+	}
+
+	fw, fErr := this.zipWriter.CreateRaw(header)
+	if fErr != nil {
+		err = fErr
+		return
+	}
+	_, err = io.Copy(fw, encFp)
+	return
+}
+
+func (this *zipArchiveWriter) Close() error {
+	return this.zipWriter.Close()
+}
+
+type tarArchiveWriter struct {
+	tarWriter  *tar.Writer
+	gzipWriter *gzip.Writer
+	format     tar.Format
+}
+
+func (this *tarArchiveWriter) writeDir(name string, modTime time.Time) error {
+	return this.tarWriter.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name,
+		Mode:     0755,
+		ModTime:  modTime,
+		Format:   this.format,
+	})
+}
+
+func (this *tarArchiveWriter) writeFile(name string, modTime time.Time, method string, filePath string, fileSize int64) (err error) {
+	err = this.tarWriter.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     fileSize,
+		ModTime:  modTime,
+		Format:   this.format,
+	})
+	if err != nil {
+		return
+	}
+	err = copyFile(this.tarWriter, filePath)
+	return
+}
+
+func (this *tarArchiveWriter) Close() (err error) {
+	if err = this.tarWriter.Close(); err != nil {
+		return
+	}
+	if this.gzipWriter != nil {
+		err = this.gzipWriter.Close()
+	}
+	return
+}
+
+func fileCRC32(filePath string) (crc uint32, err error) {
+	crcHash := crc32.NewIEEE()
+	if err = copyFile(crcHash, filePath); err != nil {
+		return
+	}
+	crc = crcHash.Sum32()
+	return
+}
+
+//the same as the archive/zip, the local time is kept
+func msDosTime(t time.Time) (fDate uint16, fTime uint16) {
+	fDate = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	fTime = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	return
+}
+
+//the extended timestamp of info-zip, written by the CreateHeader of archive/zip
+func extTimeExtra(t time.Time) []byte {
+	extra := make([]byte, 9)
+	binary.LittleEndian.PutUint16(extra[0:], 0x5455)
+	binary.LittleEndian.PutUint16(extra[2:], 5)
+	extra[4] = 1
+	binary.LittleEndian.PutUint32(extra[5:], uint32(t.Unix()))
+	return extra
+}
+
+func copyFile(w io.Writer, filePath string) (err error) {
+	srcFp, openErr := os.Open(filePath)
+	if openErr != nil {
+		err = openErr
+		return
+	}
+	defer srcFp.Close()
+	_, err = io.Copy(w, srcFp)
+	return
+}
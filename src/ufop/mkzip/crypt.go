@@ -0,0 +1,183 @@
+package mkzip
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+//the encryption of the zip entries with the password
+const (
+	//winzip AE-2, supported by 7-zip, winzip, winrar and the macos archive utility
+	ENCRYPTION_AES256 = "aes256"
+	//the traditional pkware encryption, weak but supported by the windows explorer
+	ENCRYPTION_ZIPCRYPTO = "zipcrypto"
+)
+
+const (
+	//the method in the header of the aes entries, the real one is in the extra field
+	ZIP_METHOD_AES uint16 = 99
+	ZIP_EXTRA_AES  uint16 = 0x9901
+	//aes-256 of the winzip spec
+	AES_STRENGTH     byte = 3
+	AES_KEY_LENGTH   int  = 32
+	AES_SALT_LENGTH  int  = 16
+	AES_VERIFIER_LEN int  = 2
+	AES_MAC_LENGTH   int  = 10
+	AES_PBKDF2_ITER  int  = 1000
+
+	ZIPCRYPTO_HEADER_LENGTH int = 12
+)
+
+//the extra field of the aes entry, the version 2 (AE-2) keeps no crc
+func aesExtra(method uint16) []byte {
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra[0:], ZIP_EXTRA_AES)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], 2)
+	copy(extra[6:], "AE")
+	extra[8] = AES_STRENGTH
+	binary.LittleEndian.PutUint16(extra[9:], method)
+	return extra
+}
+
+//the salt and the password verifier are written first, then the data encrypted by
+//aes-ctr, the authentication code of the encrypted data is written by Close
+type aesWriter struct {
+	w   io.Writer
+	mac hash.Hash
+
+	block   cipher.Block
+	counter [aes.BlockSize]byte
+	stream  [aes.BlockSize]byte
+	//the bytes of the stream used
+	used int
+}
+
+func newAesWriter(w io.Writer, password []byte) (writer *aesWriter, err error) {
+	salt := make([]byte, AES_SALT_LENGTH)
+	if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+		return
+	}
+	keys := pbkdf2Sha1(password, salt, AES_PBKDF2_ITER, 2*AES_KEY_LENGTH+AES_VERIFIER_LEN)
+	block, bErr := aes.NewCipher(keys[:AES_KEY_LENGTH])
+	if bErr != nil {
+		err = bErr
+		return
+	}
+	if _, err = w.Write(salt); err != nil {
+		return
+	}
+	if _, err = w.Write(keys[2*AES_KEY_LENGTH:]); err != nil {
+		return
+	}
+	writer = &aesWriter{
+		w:     w,
+		mac:   hmac.New(sha1.New, keys[AES_KEY_LENGTH:2*AES_KEY_LENGTH]),
+		block: block,
+		used:  aes.BlockSize,
+	}
+	return
+}
+
+//the counter of winzip is little endian and starts from 1
+func (this *aesWriter) Write(p []byte) (n int, err error) {
+	buf := make([]byte, len(p))
+	for index := range p {
+		if this.used == aes.BlockSize {
+			for cdx := range this.counter {
+				this.counter[cdx]++
+				if this.counter[cdx] != 0 {
+					break
+				}
+			}
+			this.block.Encrypt(this.stream[:], this.counter[:])
+			this.used = 0
+		}
+		buf[index] = p[index] ^ this.stream[this.used]
+		this.used++
+	}
+	this.mac.Write(buf)
+	return this.w.Write(buf)
+}
+
+func (this *aesWriter) Close() (err error) {
+	_, err = this.w.Write(this.mac.Sum(nil)[:AES_MAC_LENGTH])
+	return
+}
+
+//the key derivation of winzip, pbkdf2 with hmac-sha1
+func pbkdf2Sha1(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+	key := make([]byte, 0, keyLen+sha1.Size)
+	buf := make([]byte, 4)
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf, block)
+		prf.Write(buf)
+		u := prf.Sum(nil)
+		t := make([]byte, len(u))
+		copy(t, u)
+		for n := 1; n < iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for index := range t {
+				t[index] ^= u[index]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+//the traditional pkware encryption, the 12 bytes header is written first, its last
+//byte is the high byte of the crc to check the password
+type zipCryptoWriter struct {
+	w    io.Writer
+	keys [3]uint32
+}
+
+func newZipCryptoWriter(w io.Writer, password []byte, crc uint32) (writer *zipCryptoWriter, err error) {
+	writer = &zipCryptoWriter{
+		w:    w,
+		keys: [3]uint32{0x12345678, 0x23456789, 0x34567890},
+	}
+	for _, b := range password {
+		writer.update(b)
+	}
+	header := make([]byte, ZIPCRYPTO_HEADER_LENGTH)
+	if _, err = io.ReadFull(rand.Reader, header[:ZIPCRYPTO_HEADER_LENGTH-1]); err != nil {
+		return
+	}
+	header[ZIPCRYPTO_HEADER_LENGTH-1] = byte(crc >> 24)
+	_, err = writer.Write(header)
+	return
+}
+
+func (this *zipCryptoWriter) update(b byte) {
+	this.keys[0] = crc32.IEEETable[byte(this.keys[0])^b] ^ (this.keys[0] >> 8)
+	this.keys[1] = (this.keys[1]+this.keys[0]&0xff)*134775813 + 1
+	this.keys[2] = crc32.IEEETable[byte(this.keys[2])^byte(this.keys[1]>>24)] ^ (this.keys[2] >> 8)
+}
+
+func (this *zipCryptoWriter) Write(p []byte) (n int, err error) {
+	buf := make([]byte, len(p))
+	for index, b := range p {
+		temp := uint16(this.keys[2]) | 2
+		buf[index] = b ^ byte((temp*(temp^1))>>8)
+		this.update(b)
+	}
+	return this.w.Write(buf)
+}
+
+func (this *zipCryptoWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,182 @@
+package mkzip
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"testing"
+)
+
+//the vectors of rfc 6070, without the one of 16777216 iterations
+func TestPbkdf2Sha1(t *testing.T) {
+	tests := []struct {
+		password string
+		salt     string
+		iter     int
+		keyLen   int
+		key      string
+	}{
+		{"password", "salt", 1, 20, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{"password", "salt", 2, 20, "ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957"},
+		{"password", "salt", 4096, 20, "4b007901b765489abead49d926f721d065a429c1"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, 25,
+			"3d2eec4fe41c849b80c8d83662c0e44a8b291a964cf2f07038"},
+		{"pass\x00word", "sa\x00lt", 4096, 16, "56fa6aa75548099dcc37d7f03425e0c3"},
+	}
+	for _, test := range tests {
+		key := hex.EncodeToString(pbkdf2Sha1([]byte(test.password), []byte(test.salt), test.iter, test.keyLen))
+		if key != test.key {
+			t.Errorf("pbkdf2Sha1(%q, %q, %d, %d) = %s, want %s", test.password, test.salt, test.iter, test.keyLen, key, test.key)
+		}
+	}
+}
+
+//the data of the lengths around the aes block and the ctr counter
+var cryptTestData = [][]byte{
+	{},
+	[]byte("a"),
+	[]byte("0123456789abcdef"),
+	bytes.Repeat([]byte("qiniu ufop "), 1000),
+}
+
+func TestAesRoundTrip(t *testing.T) {
+	for _, password := range []string{"password", "七牛", ""} {
+		for _, data := range cryptTestData {
+			encrypted := new(bytes.Buffer)
+			writer, err := newAesWriter(encrypted, []byte(password))
+			if err != nil {
+				t.Fatal(err)
+			}
+			//written in pieces like the flate writer
+			for start := 0; start < len(data); start += 7 {
+				end := start + 7
+				if end > len(data) {
+					end = len(data)
+				}
+				if _, err = writer.Write(data[start:end]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			decrypted, dErr := aesDecrypt(encrypted.Bytes(), []byte(password))
+			if dErr != nil {
+				t.Errorf("decrypt %d bytes with password %q error, %s", len(data), password, dErr)
+			} else if !bytes.Equal(decrypted, data) {
+				t.Errorf("decrypt %d bytes with password %q mismatches", len(data), password)
+			}
+			if _, dErr = aesDecrypt(encrypted.Bytes(), []byte(password+"x")); dErr == nil {
+				t.Errorf("decrypt %d bytes with the wrong password should fail", len(data))
+			}
+		}
+	}
+}
+
+func TestZipCryptoRoundTrip(t *testing.T) {
+	for _, password := range []string{"password", "\xc6\xdf\xc5\xa3", ""} {
+		for _, data := range cryptTestData {
+			crc := crc32.ChecksumIEEE(data)
+			encrypted := new(bytes.Buffer)
+			writer, err := newZipCryptoWriter(encrypted, []byte(password), crc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = writer.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if err = writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if encrypted.Len() != ZIPCRYPTO_HEADER_LENGTH+len(data) {
+				t.Errorf("zipcrypto length of %d bytes is %d", len(data), encrypted.Len())
+			}
+
+			decrypted, dErr := zipCryptoDecrypt(encrypted.Bytes(), []byte(password), crc)
+			if dErr != nil {
+				t.Errorf("decrypt %d bytes with password %q error, %s", len(data), password, dErr)
+			} else if !bytes.Equal(decrypted, data) {
+				t.Errorf("decrypt %d bytes with password %q mismatches", len(data), password)
+			}
+		}
+	}
+}
+
+//the reader of the winzip aes spec: salt, password verifier, the data encrypted by
+//aes-ctr with the little endian counter from 1, and the hmac-sha1 of the encrypted data
+func aesDecrypt(encrypted, password []byte) (data []byte, err error) {
+	if len(encrypted) < AES_SALT_LENGTH+AES_VERIFIER_LEN+AES_MAC_LENGTH {
+		err = errors.New("too short")
+		return
+	}
+	salt := encrypted[:AES_SALT_LENGTH]
+	verifier := encrypted[AES_SALT_LENGTH : AES_SALT_LENGTH+AES_VERIFIER_LEN]
+	body := encrypted[AES_SALT_LENGTH+AES_VERIFIER_LEN : len(encrypted)-AES_MAC_LENGTH]
+	mac := encrypted[len(encrypted)-AES_MAC_LENGTH:]
+
+	keys := pbkdf2Sha1(password, salt, AES_PBKDF2_ITER, 2*AES_KEY_LENGTH+AES_VERIFIER_LEN)
+	if !bytes.Equal(keys[2*AES_KEY_LENGTH:], verifier) {
+		err = errors.New("bad password verifier")
+		return
+	}
+	macHash := hmac.New(sha1.New, keys[AES_KEY_LENGTH:2*AES_KEY_LENGTH])
+	macHash.Write(body)
+	if !hmac.Equal(macHash.Sum(nil)[:AES_MAC_LENGTH], mac) {
+		err = errors.New("bad authentication code")
+		return
+	}
+
+	block, bErr := aes.NewCipher(keys[:AES_KEY_LENGTH])
+	if bErr != nil {
+		err = bErr
+		return
+	}
+	data = make([]byte, len(body))
+	counter := make([]byte, aes.BlockSize)
+	stream := make([]byte, aes.BlockSize)
+	for start := 0; start < len(body); start += aes.BlockSize {
+		for index := range counter {
+			counter[index]++
+			if counter[index] != 0 {
+				break
+			}
+		}
+		block.Encrypt(stream, counter)
+		for index := start; index < len(body) && index < start+aes.BlockSize; index++ {
+			data[index] = body[index] ^ stream[index-start]
+		}
+	}
+	return
+}
+
+//the reader of the pkware appnote, the last byte of the decrypted header is the high
+//byte of the crc
+func zipCryptoDecrypt(encrypted, password []byte, crc uint32) (data []byte, err error) {
+	keys := [3]uint32{0x12345678, 0x23456789, 0x34567890}
+	update := func(b byte) {
+		keys[0] = crc32.Update(^keys[0], crc32.IEEETable, []byte{b}) ^ 0xffffffff
+		keys[1] = (keys[1]+keys[0]&0xff)*134775813 + 1
+		keys[2] = crc32.Update(^keys[2], crc32.IEEETable, []byte{byte(keys[1] >> 24)}) ^ 0xffffffff
+	}
+	for _, b := range password {
+		update(b)
+	}
+
+	plain := make([]byte, len(encrypted))
+	for index, c := range encrypted {
+		temp := uint16(keys[2]) | 2
+		plain[index] = c ^ byte((temp*(temp^1))>>8)
+		update(plain[index])
+	}
+	if len(plain) < ZIPCRYPTO_HEADER_LENGTH || plain[ZIPCRYPTO_HEADER_LENGTH-1] != byte(crc>>24) {
+		err = errors.New("bad password check byte")
+		return
+	}
+	data = plain[ZIPCRYPTO_HEADER_LENGTH:]
+	return
+}
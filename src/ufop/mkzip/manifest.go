@@ -0,0 +1,127 @@
+package mkzip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"ufop"
+	"ufop/utils"
+)
+
+const (
+	MKZIP_MAX_MANIFEST_LENGTH int64 = 10 * 1024 * 1024 //10MB
+)
+
+//download the manifest at the src url, which lists the files to zip
+func (this *Mkzipper) readManifest(ctx context.Context, src ufop.UfopRequestSrc) (files []MkzipFile, err error) {
+	if src.Url == "" {
+		err = ufop.NewUfopError(ufop.E_BAD_PARAM, "no mkzip manifest in the src")
+		return
+	}
+
+	resResp, respErr := utils.HttpGet(ctx, src.Url)
+	if respErr != nil || resResp.StatusCode != 200 {
+		if respErr != nil {
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("retrieve mkzip manifest failed, %s", respErr.Error()))
+		} else {
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("retrieve mkzip manifest failed, %s", resResp.Status))
+			if resResp.Body != nil {
+				resResp.Body.Close()
+			}
+		}
+		return
+	}
+	defer resResp.Body.Close()
+
+	manifestBuffer := new(bytes.Buffer)
+	written, cpErr := io.Copy(manifestBuffer, io.LimitReader(resResp.Body, MKZIP_MAX_MANIFEST_LENGTH+1))
+	if cpErr != nil {
+		err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("read mkzip manifest failed, %s", cpErr.Error()))
+		return
+	}
+	if written > MKZIP_MAX_MANIFEST_LENGTH {
+		err = ufop.NewUfopError(ufop.E_SRC_TOO_LARGE, "mkzip manifest length exceeds the limit").
+			WithDetail("limit", MKZIP_MAX_MANIFEST_LENGTH)
+		return
+	}
+
+	files, err = parseManifest(manifestBuffer.Bytes())
+	return
+}
+
+//the manifest is a json list like [{"url":"<url>","alias":"<alias>"}], or the text
+//lines of <url>,<alias>, the alias is optional, the empty lines and the lines
+//starting with # are skipped. The line is split on the last comma since the urls
+//may contain commas, the alias containing commas is quoted like "a,b.jpg"
+func parseManifest(data []byte) (files []MkzipFile, err error) {
+	data = bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))
+	files = make([]MkzipFile, 0)
+
+	if bytes.HasPrefix(data, []byte("[")) {
+		if jErr := json.Unmarshal(data, &files); jErr != nil {
+			err = ufop.NewUfopError(ufop.E_SRC_INVALID, fmt.Sprintf("invalid mkzip manifest, %s", jErr.Error()))
+			return
+		}
+		for index, file := range files {
+			if file.Url == "" {
+				err = ufop.NewUfopError(ufop.E_SRC_INVALID, "invalid mkzip manifest, missing url").
+					WithDetail("index", index)
+				return
+			}
+		}
+	} else {
+		for index, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			file, lErr := parseManifestLine(line)
+			if lErr != nil {
+				err = ufop.NewUfopError(ufop.E_SRC_INVALID, fmt.Sprintf("invalid mkzip manifest, %s", lErr.Error())).
+					WithDetail("line", index+1)
+				return
+			}
+			if file.Url == "" {
+				err = ufop.NewUfopError(ufop.E_SRC_INVALID, "invalid mkzip manifest, missing url").
+					WithDetail("line", index+1)
+				return
+			}
+			files = append(files, file)
+		}
+	}
+
+	if len(files) == 0 {
+		err = ufop.NewUfopError(ufop.E_SRC_INVALID, "empty mkzip manifest")
+	}
+	return
+}
+
+//the quoted alias starts at the first ", the urls never contain the raw quotes, and
+//"" in it is a quote like csv
+func parseManifestLine(line string) (file MkzipFile, err error) {
+	if strings.HasSuffix(line, "\"") {
+		quoteIndex := strings.Index(line, "\"")
+		url := strings.TrimSpace(line[:quoteIndex])
+		quoted := line[quoteIndex:]
+		if !strings.HasSuffix(url, ",") || len(quoted) < 2 ||
+			strings.Contains(strings.Replace(quoted[1:len(quoted)-1], "\"\"", "", -1), "\"") {
+			err = errors.New("bad quoted alias")
+			return
+		}
+		file.Url = strings.TrimSpace(strings.TrimSuffix(url, ","))
+		file.Alias = strings.Replace(quoted[1:len(quoted)-1], "\"\"", "\"", -1)
+		return
+	}
+
+	if commaIndex := strings.LastIndex(line, ","); commaIndex >= 0 {
+		file.Url = strings.TrimSpace(line[:commaIndex])
+		file.Alias = strings.TrimSpace(line[commaIndex+1:])
+	} else {
+		file.Url = line
+	}
+	return
+}
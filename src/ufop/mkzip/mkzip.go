@@ -1,41 +1,58 @@
 package mkzip
 
 import (
-	"archive/zip"
-	"bytes"
-	"encoding/base64"
+	"compress/flate"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/qiniu/api.v6/auth/digest"
 	"github.com/qiniu/api.v6/rs"
 	"github.com/qiniu/rpc"
-	"io/ioutil"
-	"net/http"
 	"net/url"
 	"os"
-	"regexp"
 	"strings"
+	"time"
 	"ufop"
+	"ufop/cmdspec"
 	"ufop/utils"
 )
 
 /*
 
-mkzip/bucket/<encoded bucket>/encoding/<encoded encoding[gbk|utf8]>
+mkzip/bucket/<encoded bucket>/encoding/<encoded encoding[utf8|gbk|big5|shiftjis|euckr|cp437]>
 /url/<encoded url>/alias/<encoded alias>/url/<encoded url>/alias/<encoded alias>
+/saveas/<encoded bucket:key>
+
+mkzip/bucket/<encoded bucket>/manifest/1
+
+/format/<zip|tar|tar.gz>/compression/<auto|store|deflate>/level/<1-9>/comment/<encoded comment>
+and /method/<auto|store|deflate> after the url to set the compression of the file
+
+/password/<encoded password>/encryption/<aes256|zipcrypto> to encrypt the files of zip
+
+read the urls and aliases from the manifest at the src url instead
+
+save the zip to the bucket if saveas is set
 
 */
 const (
 	MKZIP_MAX_FILE_LENGTH int64 = 100 * 1024 * 1024 //100MB
 	MKZIP_MAX_FILE_COUNT  int   = 100               //100
 	MKZIP_MAX_FILE_LIMIT  int   = 1000              //1000
+	//the manifest is not limited by the length of the cmd
+	MKZIP_MAX_MANIFEST_FILE_COUNT int = 10000
+	//the files stat by each batch
+	MKZIP_BATCH_STAT_SIZE int = 1000
 )
 
 type Mkzipper struct {
-	mac           *digest.Mac
-	maxFileLength int64
-	maxFileCount  int
+	mac             *digest.Mac
+	maxFileLength   int64
+	maxFileCount    int
+	prefetchWorkers int
+
+	maxManifestFileCount int
 }
 
 type MkzipperConfig struct {
@@ -45,12 +62,76 @@ type MkzipperConfig struct {
 
 	MkzipMaxFileLength int64 `json:"mkzip_max_file_length,omitempty"`
 	MkzipMaxFileCount  int   `json:"mkzip_max_file_count,omitempty"`
+	//the file count of the manifest mode, instead of mkzip_max_file_count
+	MkzipMaxManifestFileCount int `json:"mkzip_max_manifest_file_count,omitempty"`
+	//the sources fetched at the same time
+	MkzipPrefetchWorkers int `json:"mkzip_prefetch_workers,omitempty"`
+}
+
+type MkzipOptions struct {
+	Bucket   string      `cmd:"bucket"`
+	Encoding string      `cmd:"encoding"`
+	Files    []MkzipFile `cmd:"files"`
+	//bucket:key to save the zip
+	SaveAs string `cmd:"saveas"`
+	//read the files from the manifest at the src url
+	Manifest bool `cmd:"manifest"`
+
+	Format string `cmd:"format"`
+	//the default method of the files
+	Compression string `cmd:"compression"`
+	Level       *int   `cmd:"level"`
+	Comment     string `cmd:"comment"`
+
+	//encrypt the files of zip
+	Password   string `cmd:"password"`
+	Encryption string `cmd:"encryption"`
+}
+
+//the json manifest is a list of the files
+type MkzipFile struct {
+	Url    string `cmd:"url" json:"url"`
+	Alias  string `cmd:"alias" json:"alias,omitempty"`
+	Method string `cmd:"method" json:"method,omitempty"`
 }
 
+var mkzipSpec = cmdspec.Spec{
+	Name: "mkzip",
+	Params: []cmdspec.Param{
+		{Name: "bucket", Type: cmdspec.PARAM_BASE64, Required: true},
+		//the same charsets as unzip
+		{Name: "encoding", Type: cmdspec.PARAM_BASE64, Pattern: "^(" + strings.Join(utils.Charsets, "|") + ")$"},
+		//required when not using the manifest
+		{Name: "files", Type: cmdspec.PARAM_GROUP, Params: []cmdspec.Param{
+			{Name: "url", Type: cmdspec.PARAM_BASE64},
+			{Name: "alias", Type: cmdspec.PARAM_BASE64},
+			{Name: "method", Type: cmdspec.PARAM_ENUM, Values: methods},
+		}},
+		{Name: "saveas", Type: cmdspec.PARAM_BASE64, Pattern: "^[^:]+:.+$"},
+		{Name: "manifest", Type: cmdspec.PARAM_BOOL},
+		{Name: "format", Type: cmdspec.PARAM_ENUM, Values: []string{FORMAT_ZIP, FORMAT_TAR, FORMAT_TAR_GZ}, Default: FORMAT_ZIP},
+		{Name: "compression", Type: cmdspec.PARAM_ENUM, Values: methods, Default: METHOD_DEFLATE},
+		{Name: "level", Type: cmdspec.PARAM_INT, Min: cmdspec.Limit(1), Max: cmdspec.Limit(9)},
+		{Name: "comment", Type: cmdspec.PARAM_BASE64},
+		{Name: "password", Type: cmdspec.PARAM_BASE64},
+		//aes256 by default when the password is set
+		{Name: "encryption", Type: cmdspec.PARAM_ENUM, Values: []string{ENCRYPTION_AES256, ENCRYPTION_ZIPCRYPTO}},
+	},
+}
+
+var methods = []string{METHOD_AUTO, METHOD_STORE, METHOD_DEFLATE}
+
 type ZipFile struct {
 	url   string
 	key   string
 	alias string
+	//the alias encoded
+	name string
+	//store or deflate, auto is decided by the mimetype
+	method   string
+	mimeType string
+	//the put time in the bucket
+	modTime time.Time
 }
 
 func (this *Mkzipper) Name() string {
@@ -78,73 +159,86 @@ func (this *Mkzipper) InitConfig(jobConf string) (err error) {
 		this.maxFileCount = config.MkzipMaxFileCount
 	}
 
+	if config.MkzipMaxManifestFileCount <= 0 {
+		this.maxManifestFileCount = MKZIP_MAX_MANIFEST_FILE_COUNT
+	} else {
+		this.maxManifestFileCount = config.MkzipMaxManifestFileCount
+	}
+
 	if config.MkzipMaxFileLength <= 0 {
 		this.maxFileLength = MKZIP_MAX_FILE_LENGTH
 	} else {
 		this.maxFileLength = config.MkzipMaxFileLength
 	}
 
+	if config.MkzipPrefetchWorkers <= 0 {
+		this.prefetchWorkers = MKZIP_PREFETCH_WORKERS
+	} else {
+		this.prefetchWorkers = config.MkzipPrefetchWorkers
+	}
+
 	this.mac = &digest.Mac{config.AccessKey, []byte(config.SecretKey)}
 
 	return
 }
 
-func (this *Mkzipper) parse(cmd string) (bucket string, encoding string, zipFiles []ZipFile, err error) {
-	pattern := "^mkzip/bucket/[0-9a-zA-Z-_=]+(/encoding/[0-9a-zA-Z-_=]+){0,1}(/url/[0-9a-zA-Z-_=]+(/alias/[0-9a-zA-Z-_=]+){0,1})+$"
-	matched, _ := regexp.MatchString(pattern, cmd)
-	if !matched {
-		err = errors.New("invalid mkzip command format")
-		return
+func (this *Mkzipper) Syntax() string {
+	return mkzipSpec.Syntax()
+}
+
+func (this *Mkzipper) Limits() map[string]interface{} {
+	return map[string]interface{}{
+		"mkzip_max_file_length":         this.maxFileLength,
+		"mkzip_max_file_count":          this.maxFileCount,
+		"mkzip_max_manifest_file_count": this.maxManifestFileCount,
+		"mkzip_prefetch_workers":        this.prefetchWorkers,
 	}
+}
 
-	var decodeErr error
-	//get bucket
-	bucket, decodeErr = utils.GetParamDecoded(cmd, "bucket/[0-9a-zA-Z-_=]+", "bucket")
-	if decodeErr != nil {
-		err = errors.New("invalid mkzip paramter 'bucket'")
+func (this *Mkzipper) parse(cmd string) (options *MkzipOptions, err error) {
+	options = &MkzipOptions{}
+	if err = mkzipSpec.Parse(cmd, options); err != nil {
 		return
 	}
-	//get encoding
-	encoding, decodeErr = utils.GetParamDecoded(cmd, "encoding/[0-9a-zA-Z-_=]+", "encoding")
-	if decodeErr != nil {
-		err = errors.New("invalid mkzip parameter 'encoding'")
-		return
+
+	if options.Encoding == "" {
+		options.Encoding = utils.CHARSET_UTF8
 	}
+
+	//the files are listed either in the cmd or in the manifest
+	if !options.Manifest && len(options.Files) == 0 {
+		err = ufop.NewUfopError(ufop.E_BAD_PARAM, "invalid mkzip command format, missing parameter 'url'").
+			WithDetail("reason", "missing parameter 'url'")
+	} else if options.Manifest && len(options.Files) > 0 {
+		err = ufop.NewUfopError(ufop.E_BAD_PARAM, "invalid mkzip command format, parameter 'url' conflicts with 'manifest'").
+			WithDetail("reason", "parameter 'url' conflicts with 'manifest'")
+	} else if options.Encryption != "" && options.Password == "" {
+		err = ufop.NewUfopError(ufop.E_BAD_PARAM, "invalid mkzip command format, parameter 'encryption' requires 'password'").
+			WithDetail("reason", "parameter 'encryption' requires 'password'")
+	} else if options.Password != "" && options.Format != FORMAT_ZIP {
+		err = ufop.NewUfopError(ufop.E_BAD_PARAM, "invalid mkzip parameter 'password', only supported by zip").
+			WithDetail("param", "password").
+			WithDetail("reason", "only supported by zip")
+	}
+	if err == nil && options.Password != "" && options.Encryption == "" {
+		options.Encryption = ENCRYPTION_AES256
+	}
+	return
+}
+
+//check the urls and aliases of the files
+func (this *Mkzipper) zipFiles(files []MkzipFile) (zipFiles []ZipFile, err error) {
 	//get url & alias
-	urlAliasRegx := regexp.MustCompile("url/[0-9a-zA-Z-_=]+(/alias/[0-9a-zA-Z-_=]+){0,1}")
-	urlAliasPairs := urlAliasRegx.FindAllString(cmd, -1)
 	paliasMap := make(map[string]string, 0)
-	for _, urlAliasPair := range urlAliasPairs {
-		urlAliasItems := strings.Split(urlAliasPair, "/")
+	for _, file := range files {
 		zipFile := ZipFile{}
-		var purl string
-		var palias string
+		purl := file.Url
+		palias := file.Alias
 		var key string
-		switch len(urlAliasItems) {
-		case 2:
-			urlBytes, decodeErr := base64.URLEncoding.DecodeString(urlAliasItems[1])
-			if decodeErr != nil {
-				err = errors.New("invalid mkzip parameter 'url'")
-				return
-			}
-			purl = string(urlBytes)
-		case 4:
-			urlBytes, decodeErr := base64.URLEncoding.DecodeString(urlAliasItems[1])
-			if decodeErr != nil {
-				err = errors.New("invalid mkzip parameter 'url'")
-				return
-			}
-			aliasBytes, decodeErr := base64.URLEncoding.DecodeString(urlAliasItems[3])
-			if decodeErr != nil {
-				err = errors.New("invalid mkzip parameter 'alias'")
-				return
-			}
-			purl = string(urlBytes)
-			palias = string(aliasBytes)
-		}
 		uri, parseErr := url.Parse(purl)
 		if parseErr != nil {
-			err = errors.New("mkzip parameter 'url' format error")
+			err = ufop.NewUfopError(ufop.E_BAD_PARAM, "mkzip parameter 'url' format error").
+				WithDetail("url", purl)
 			return
 		}
 
@@ -159,16 +253,28 @@ func (this *Mkzipper) parse(cmd string) (bucket string, encoding string, zipFile
 		}
 
 		if key == "" {
-			err = errors.New("invalid mkzip resource url")
+			err = ufop.NewUfopError(ufop.E_BAD_PARAM, "invalid mkzip resource url").
+				WithDetail("url", purl)
 			return
 		}
 		if _, ok := paliasMap[palias]; ok {
-			err = errors.New("duplicate mkzip resource alias")
+			err = ufop.NewUfopError(ufop.E_BAD_PARAM, "duplicate mkzip resource alias").
+				WithDetail("alias", palias)
 			return
 		}
 		paliasMap[palias] = palias
 
+		//the manifest is not checked by the spec
+		switch file.Method {
+		case "", METHOD_AUTO, METHOD_STORE, METHOD_DEFLATE:
+		default:
+			err = ufop.NewUfopError(ufop.E_BAD_PARAM, fmt.Sprintf("invalid mkzip method '%s'", file.Method)).
+				WithDetail("url", purl)
+			return
+		}
+
 		//set zip file
+		zipFile.method = file.Method
 		zipFile.alias = palias
 		zipFile.url = purl
 		zipFile.key = key
@@ -177,115 +283,175 @@ func (this *Mkzipper) parse(cmd string) (bucket string, encoding string, zipFile
 	return
 }
 
-func (this *Mkzipper) Do(req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
+func (this *Mkzipper) DoContext(ctx context.Context, req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
 	//parse command
-	bucket, encoding, zipFiles, pErr := this.parse(req.Cmd)
+	options, pErr := this.parse(req.Cmd)
 	if pErr != nil {
 		err = pErr
 		return
 	}
+	encoding := options.Encoding
+
+	files := options.Files
+	if options.Manifest {
+		if files, err = this.readManifest(ctx, req.Src); err != nil {
+			return
+		}
+	}
+	zipFiles, zErr := this.zipFiles(files)
+	if zErr != nil {
+		err = zErr
+		return
+	}
 
 	//check file count
-	if len(zipFiles) > this.maxFileCount {
-		err = errors.New("zip file count exceeds the limit")
+	maxFileCount := this.maxFileCount
+	if options.Manifest {
+		maxFileCount = this.maxManifestFileCount
+	}
+	if len(zipFiles) > maxFileCount {
+		err = ufop.NewUfopError(ufop.E_LIMIT_EXCEEDED, "zip file count exceeds the limit").
+			WithDetail("limit", maxFileCount)
 		return
 	}
-	if len(zipFiles) > MKZIP_MAX_FILE_LIMIT {
-		err = errors.New("only support items less than 1000")
+	//the manifest is not limited by the length of the cmd
+	if !options.Manifest && len(zipFiles) > MKZIP_MAX_FILE_LIMIT {
+		err = ufop.NewUfopError(ufop.E_LIMIT_EXCEEDED, "only support items less than 1000").
+			WithDetail("limit", MKZIP_MAX_FILE_LIMIT)
 		return
 	}
 	//check whether file in bucket and exceeds the limit
-	statItems := make([]rs.EntryPath, 0)
-	statUrls := make([]string, 0)
-	for _, zipFile := range zipFiles {
-		entryPath := rs.EntryPath{
-			bucket, zipFile.key,
-		}
-		statItems = append(statItems, entryPath)
-		statUrls = append(statUrls, zipFile.url)
+	if err = this.stat(options.Bucket, zipFiles); err != nil {
+		return
 	}
-	qclient := rs.New(this.mac)
 
-	statRet, statErr := qclient.BatchStat(nil, statItems)
+	for index := range zipFiles {
+		if zipFiles[index].method == "" {
+			zipFiles[index].method = options.Compression
+		}
+		if zipFiles[index].method == METHOD_AUTO {
+			zipFiles[index].method = autoMethod(zipFiles[index].mimeType, zipFiles[index].alias)
+		}
+	}
 
-	if statErr != nil {
-		if _, ok := statErr.(*rpc.ErrorInfo); !ok {
-			err = errors.New(fmt.Sprintf("batch stat error, %s", statErr.Error()))
+	//convert encoding, before anything is written
+	comment, cErr := utils.EncodeString(options.Comment, encoding)
+	if cErr != nil {
+		err = ufop.NewUfopError(ufop.E_BAD_PARAM, fmt.Sprintf("unsupported encoding %s of comment, %s", encoding, cErr))
+		return
+	}
+	//the length of the zip comment is 2 bytes
+	if options.Format == FORMAT_ZIP && len(comment) > 0xffff {
+		err = ufop.NewUfopError(ufop.E_BAD_PARAM, "invalid mkzip parameter 'comment', too long").
+			WithDetail("param", "comment").
+			WithDetail("reason", "too long")
+		return
+	}
+	for index := range zipFiles {
+		fname, tErr := utils.EncodeString(zipFiles[index].alias, encoding)
+		if tErr != nil {
+			err = ufop.NewUfopError(ufop.E_BAD_PARAM, fmt.Sprintf("unsupported encoding %s, %s", encoding, tErr)).
+				WithDetail("alias", zipFiles[index].alias)
 			return
 		}
+		zipFiles[index].name = fname
 	}
-
-	for index := 0; index < len(statRet); index++ {
-		ret := statRet[index]
-		if ret.Code != 200 {
-			if ret.Code == 612 {
-				err = errors.New(fmt.Sprintf("batch stat '%s' error, no such file or directory", statUrls[index]))
-			} else if ret.Code == 631 {
-				err = errors.New(fmt.Sprintf("batch stat '%s' error, no such bucket", statUrls[index]))
-			} else {
-				err = errors.New(fmt.Sprintf("batch stat '%s' error, %d", statUrls[index], ret.Code))
-			}
+	//the aes password is utf8 as 7-zip and winzip, the zipcrypto password is in the
+	//charset of the windows explorer, the same as the names
+	var password []byte
+	if options.Encryption == ENCRYPTION_AES256 {
+		password = []byte(options.Password)
+	} else if options.Encryption == ENCRYPTION_ZIPCRYPTO {
+		encPassword, pErr := utils.EncodeString(options.Password, encoding)
+		if pErr != nil {
+			err = ufop.NewUfopError(ufop.E_BAD_PARAM, fmt.Sprintf("unsupported encoding %s of password, %s", encoding, pErr))
 			return
 		}
+		password = []byte(encPassword)
 	}
 
-	//retrieve resource and create zip file
-	var tErr error
-	zipBuffer := new(bytes.Buffer)
-	zipWriter := zip.NewWriter(zipBuffer)
-
-	for _, zipFile := range zipFiles {
-		//convert encoding
-		fname := zipFile.alias
-		if encoding == "gbk" {
-			fname, tErr = utils.Utf82Gbk(fname)
-			if tErr != nil {
-				err = errors.New(fmt.Sprintf("unsupported encoding gbk, %s", tErr))
-				return
-			}
-		}
+	level := flate.DefaultCompression
+	if options.Level != nil {
+		level = *options.Level
+	}
+	stream := &mkzipStream{
+		zipFiles:      zipFiles,
+		encoding:      encoding,
+		maxFileLength: this.maxFileLength,
+		workers:       this.prefetchWorkers,
+		format:        options.Format,
+		level:         level,
+		comment:       comment,
+		password:      password,
+		encryption:    options.Encryption,
+	}
+	if options.SaveAs != "" {
+		result, err = this.save(ctx, stream, options.SaveAs)
+		resultType = ufop.RESULT_TYPE_JSON
+		contentType = ufop.CONTENT_TYPE_JSON
+		return
+	}
 
-		//create each zip file writer
-		fw, fErr := zipWriter.Create(fname)
-		if fErr != nil {
-			err = errors.New(fmt.Sprintf("create zip file error, %s", fErr))
-			return
+	//write result, the zip is produced while written
+	result = stream
+	resultType = ufop.RESULT_TYPE_OCTECT_STREAM
+	contentType = formatContentTypes[options.Format]
+	return
+}
+
+//stat the files by batches, the lengths in the stat are checked first, then the
+//bytes fetched
+func (this *Mkzipper) stat(bucket string, zipFiles []ZipFile) (err error) {
+	qclient := rs.New(this.mac)
+	for start := 0; start < len(zipFiles); start += MKZIP_BATCH_STAT_SIZE {
+		end := start + MKZIP_BATCH_STAT_SIZE
+		if end > len(zipFiles) {
+			end = len(zipFiles)
 		}
-		//read data and write
-		resResp, respErr := http.Get(zipFile.url)
-		if respErr != nil || resResp.StatusCode != 200 {
-			if respErr != nil {
-				err = errors.New("get zip file resource error, " + respErr.Error())
-			} else {
-				err = errors.New(fmt.Sprintf("get zip file resource error, %s", resResp.Status))
-				if resResp.Body != nil {
-					resResp.Body.Close()
-				}
+
+		statItems := make([]rs.EntryPath, 0, end-start)
+		statUrls := make([]string, 0, end-start)
+		for _, zipFile := range zipFiles[start:end] {
+			entryPath := rs.EntryPath{
+				bucket, zipFile.key,
 			}
-			return
+			statItems = append(statItems, entryPath)
+			statUrls = append(statUrls, zipFile.url)
 		}
-		respData, readErr := ioutil.ReadAll(resResp.Body)
-		if readErr != nil {
-			err = errors.New(fmt.Sprintf("read zip file resource content error, %s", readErr))
-			return
+
+		statRet, statErr := qclient.BatchStat(nil, statItems)
+		if statErr != nil {
+			if _, ok := statErr.(*rpc.ErrorInfo); !ok {
+				err = ufop.NewUfopError(ufop.E_UPSTREAM_STORAGE, fmt.Sprintf("batch stat error, %s", statErr.Error()))
+				return
+			}
 		}
-		resResp.Body.Close()
 
-		_, writeErr := fw.Write(respData)
-		if writeErr != nil {
-			err = errors.New(fmt.Sprintf("write zip file content error, %s", writeErr))
-			return
+		for index := 0; index < len(statRet); index++ {
+			ret := statRet[index]
+			if ret.Code != 200 {
+				if ret.Code == 612 {
+					err = ufop.NewUfopError(ufop.E_BAD_PARAM, fmt.Sprintf("batch stat '%s' error, no such file or directory", statUrls[index])).
+						WithDetail("url", statUrls[index])
+				} else if ret.Code == 631 {
+					err = ufop.NewUfopError(ufop.E_BAD_PARAM, fmt.Sprintf("batch stat '%s' error, no such bucket", statUrls[index])).
+						WithDetail("url", statUrls[index])
+				} else {
+					err = ufop.NewUfopError(ufop.E_UPSTREAM_STORAGE, fmt.Sprintf("batch stat '%s' error, %d", statUrls[index], ret.Code)).
+						WithDetail("url", statUrls[index])
+				}
+				return
+			}
+			//the put time is in 100ns, the seconds are kept as tar
+			zipFiles[start+index].mimeType = ret.Data.MimeType
+			zipFiles[start+index].modTime = time.Unix(ret.Data.PutTime/10000000, 0)
+			if ret.Data.Fsize > this.maxFileLength {
+				err = ufop.NewUfopError(ufop.E_LIMIT_EXCEEDED, "zip file length exceeds the limit").
+					WithDetail("limit", this.maxFileLength).
+					WithDetail("url", statUrls[index])
+				return
+			}
 		}
 	}
-	//close zip file
-	if cErr := zipWriter.Close(); cErr != nil {
-		err = errors.New(fmt.Sprintf("close zip file error, %s", cErr))
-		return
-	}
-
-	//write result
-	result = zipBuffer.Bytes()
-	resultType = ufop.RESULT_TYPE_OCTECT_BYTES
-	contentType = "application/zip"
 	return
 }
@@ -0,0 +1,89 @@
+package mkzip
+
+import (
+	"context"
+	"fmt"
+	"github.com/qiniu/api.v6/conf"
+	fio "github.com/qiniu/api.v6/io"
+	rio "github.com/qiniu/api.v6/resumable/io"
+	"github.com/qiniu/api.v6/rs"
+	"io/ioutil"
+	"os"
+	"strings"
+	"ufop"
+)
+
+const (
+	//larger zip files are uploaded by the resumable put
+	MKZIP_RPUT_THRESHOLD int64 = 4 * 1024 * 1024
+)
+
+//the result when the zip is saved to the bucket
+type MkzipSaveResult struct {
+	Key  string `json:"key"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+//write the zip to a temp file and upload it to the bucket:key of saveas,
+//the file of the same key is overwritten like the saveas of the fops
+func (this *Mkzipper) save(ctx context.Context, stream *mkzipStream, saveAs string) (saveResult MkzipSaveResult, err error) {
+	items := strings.SplitN(saveAs, ":", 2)
+	bucket, key := items[0], items[1]
+
+	zipFp, tmpErr := ioutil.TempFile("", "mkzip_zip_")
+	if tmpErr != nil {
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("create zip temp file error, %s", tmpErr))
+		return
+	}
+	defer os.Remove(zipFp.Name())
+
+	wErr := stream.WriteTo(ctx, zipFp)
+	zipFp.Close()
+	if wErr != nil {
+		err = wErr
+		return
+	}
+	zipStat, statErr := os.Stat(zipFp.Name())
+	if statErr != nil {
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("stat zip temp file error, %s", statErr))
+		return
+	}
+
+	//set up host
+	conf.UP_HOST = "http://up.qiniu.com"
+	putPolicy := rs.PutPolicy{
+		Scope: bucket + ":" + key,
+	}
+	uptoken := putPolicy.Token(this.mac)
+
+	var hash string
+	var putErr error
+	if zipStat.Size() <= MKZIP_RPUT_THRESHOLD {
+		var fputRet fio.PutRet
+		putErr = fio.PutFile(nil, &fputRet, uptoken, key, zipFp.Name(), nil)
+		hash = fputRet.Hash
+	} else {
+		rputSettings := rio.Settings{
+			ChunkSize: 4 * 1024 * 1024,
+			Workers:   1,
+		}
+		rio.SetSettings(&rputSettings)
+		var rputRet rio.PutRet
+		putErr = rio.PutFile(nil, &rputRet, uptoken, key, zipFp.Name(), nil)
+		hash = rputRet.Hash
+	}
+	if putErr != nil {
+		err = ufop.NewUfopError(ufop.E_UPSTREAM_STORAGE, fmt.Sprintf("save zip file to bucket error, %s", putErr)).
+			WithDetail("bucket", bucket).
+			WithDetail("key", key)
+		return
+	}
+
+	saveResult = MkzipSaveResult{
+		Key:  key,
+		Hash: hash,
+		Size: zipStat.Size(),
+	}
+	return
+}
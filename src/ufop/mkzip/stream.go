@@ -0,0 +1,187 @@
+package mkzip
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"ufop"
+	"ufop/utils"
+)
+
+const (
+	MKZIP_PREFETCH_WORKERS int = 4
+)
+
+//the zip written to the response as it is produced, the sources are prefetched to
+//the temp files by a pool of workers, while the entries are written in the order
+//declared, at most so many sources as the workers are fetched but not written
+type mkzipStream struct {
+	zipFiles      []ZipFile
+	encoding      string
+	maxFileLength int64
+	workers       int
+
+	//zip, tar or tar.gz
+	format string
+	//the deflate or gzip level
+	level int
+	//the comment encoded
+	comment string
+	//the password encoded, the files of zip are encrypted when it is set
+	password   []byte
+	encryption string
+}
+
+//the source fetched to a temp file, done is closed when the fetch finished
+type prefetch struct {
+	filePath string
+	fileSize int64
+	err      error
+	done     chan bool
+}
+
+func (this *mkzipStream) WriteTo(ctx context.Context, w io.Writer) (err error) {
+	fetchCtx, cancel := context.WithCancel(ctx)
+	prefetches := make([]*prefetch, len(this.zipFiles))
+	for index := range prefetches {
+		prefetches[index] = &prefetch{done: make(chan bool)}
+	}
+
+	//the slot is taken in the declared order and released when the entry is written
+	slots := make(chan bool, this.workers)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for index, zipFile := range this.zipFiles {
+			select {
+			case slots <- true:
+			case <-fetchCtx.Done():
+				return
+			}
+			wg.Add(1)
+			go func(pf *prefetch, zipFile ZipFile) {
+				defer wg.Done()
+				pf.filePath, pf.fileSize, pf.err = this.fetch(fetchCtx, zipFile)
+				close(pf.done)
+			}(prefetches[index], zipFile)
+		}
+	}()
+
+	//stop the fetches and remove the temp files not written
+	defer func() {
+		cancel()
+		wg.Wait()
+		for _, pf := range prefetches {
+			if pf.filePath != "" {
+				os.Remove(pf.filePath)
+			}
+		}
+	}()
+
+	archive, aErr := newArchiveWriter(w, this.format, this.level, this.comment, this.encoding != utils.CHARSET_UTF8,
+		this.password, this.encryption)
+	if aErr != nil {
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("create zip file error, %s", aErr))
+		return
+	}
+	//the directories written already
+	dirs := make(map[string]bool)
+	for index, zipFile := range this.zipFiles {
+		pf := prefetches[index]
+		select {
+		case <-pf.done:
+		case <-ctx.Done():
+			err = ufop.NewUfopError(ufop.E_CANCELLED, fmt.Sprintf("write zip file cancelled, %s", ctx.Err()))
+			return
+		}
+		if pf.err != nil {
+			err = pf.err
+			return
+		}
+
+		if err = this.writeDirs(archive, dirs, zipFile); err != nil {
+			return
+		}
+		wErr := archive.writeFile(zipFile.name, zipFile.modTime, zipFile.method, pf.filePath, pf.fileSize)
+		if wErr != nil {
+			err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("write zip file content error, %s", wErr))
+			return
+		}
+		os.Remove(pf.filePath)
+		pf.filePath = ""
+		<-slots
+		utils.ObserveProgress(ctx, index+1, len(this.zipFiles))
+	}
+
+	//close zip file
+	if cErr := archive.Close(); cErr != nil {
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("close zip file error, %s", cErr))
+	}
+	return
+}
+
+//write the parent directories of the alias containing "/" before the first file in them
+func (this *mkzipStream) writeDirs(archive archiveWriter, dirs map[string]bool, zipFile ZipFile) (err error) {
+	for index := 1; index < len(zipFile.name); index++ {
+		if zipFile.name[index] != '/' {
+			continue
+		}
+		dir := zipFile.name[:index+1]
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		if dErr := archive.writeDir(dir, zipFile.modTime); dErr != nil {
+			err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("create zip directory error, %s", dErr))
+			return
+		}
+	}
+	return
+}
+
+//download the source to a temp file, at most maxFileLength bytes are read
+func (this *mkzipStream) fetch(ctx context.Context, zipFile ZipFile) (filePath string, fileSize int64, err error) {
+	resResp, respErr := utils.HttpGet(ctx, zipFile.url)
+	if respErr != nil || resResp.StatusCode != 200 {
+		if respErr != nil {
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, "get zip file resource error, "+respErr.Error()).
+				WithDetail("url", zipFile.url)
+		} else {
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("get zip file resource error, %s", resResp.Status)).
+				WithDetail("url", zipFile.url)
+			if resResp.Body != nil {
+				resResp.Body.Close()
+			}
+		}
+		return
+	}
+	defer resResp.Body.Close()
+
+	tmpFp, tmpErr := ioutil.TempFile("", "mkzip_src_")
+	if tmpErr != nil {
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("create zip file temp file error, %s", tmpErr))
+		return
+	}
+	defer tmpFp.Close()
+
+	written, cpErr := io.Copy(tmpFp, io.LimitReader(resResp.Body, this.maxFileLength+1))
+	if cpErr != nil {
+		err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("read zip file resource content error, %s", cpErr)).
+			WithDetail("url", zipFile.url)
+	} else if written > this.maxFileLength {
+		err = ufop.NewUfopError(ufop.E_LIMIT_EXCEEDED, "zip file length exceeds the limit").
+			WithDetail("limit", this.maxFileLength).
+			WithDetail("url", zipFile.url)
+	}
+	if err != nil {
+		os.Remove(tmpFp.Name())
+		return
+	}
+	filePath = tmpFp.Name()
+	fileSize = written
+	return
+}
@@ -240,7 +240,7 @@ func (this *OSSImager) parse(cmd string, operations *[]OSSImageOperation) (bucke
 	cmdParam := strings.TrimPrefix(strings.TrimPrefix(cmd, this.Name()), "/")
 	items := strings.Split(cmdParam, "@")
 	if len(items) < 2 {
-		err = errors.New("invalid rewrite url")
+		err = ufop.NewUfopError(ufop.E_BAD_PARAM, "invalid rewrite url")
 		return
 	}
 
@@ -274,7 +274,7 @@ func (this *OSSImager) Do(req ufop.UfopRequest) (result interface{}, resultType
 	var srcDomain string
 	var cdnDomain string
 	if v, ok := this.domainMapping[bucket]; !ok {
-		err = errors.New("invalid bucket specified")
+		err = ufop.NewUfopError(ufop.E_BAD_PARAM, "invalid bucket specified")
 		return
 	} else {
 		srcDomain = v.SrcDomain
@@ -282,12 +282,12 @@ func (this *OSSImager) Do(req ufop.UfopRequest) (result interface{}, resultType
 	}
 
 	if srcDomain == "" {
-		err = errors.New("invalid src domain")
+		err = ufop.NewUfopError(ufop.E_INTERNAL, "invalid src domain")
 		return
 	}
 
 	if cdnDomain == "" {
-		err = errors.New("invalid cdn domain")
+		err = ufop.NewUfopError(ufop.E_INTERNAL, "invalid cdn domain")
 		return
 	}
 
@@ -0,0 +1,196 @@
+package ufop
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"ufop/utils"
+)
+
+const (
+	PIPELINE_SEPARATOR = "|"
+)
+
+//split the cmd like html2image/format/png|roundpic/radius/20 into the fop cmds
+func pipelineCmds(cmd string) []string {
+	return strings.Split(cmd, PIPELINE_SEPARATOR)
+}
+
+//the progress of the stage is its part of the pipeline progress
+type stageProgress struct {
+	ctx   context.Context
+	index int
+	count int
+}
+
+func (this *stageProgress) ObserveProgress(done, total int) {
+	utils.ObserveProgress(this.ctx, this.index*total+done, this.count*total)
+}
+
+//run the fops one by one, the result of each fop is saved to the local disk and
+//served to the next fop by a loopback url, only the result of the last fop is returned,
+//the slot of the first fop is taken by the caller, the slots of the other fops are
+//taken before they run
+func (this *UfopServer) handleJob(ctx context.Context, ufopReq UfopRequest, slot *jobSlot) (interface{}, int, string, error) {
+	cmds := pipelineCmds(ufopReq.Cmd)
+	if len(cmds) == 1 {
+		return this.handleFop(ctx, ufopReq)
+	}
+
+	for _, cmd := range cmds {
+		if cmd == "" {
+			return nil, 0, "", NewUfopError(E_BAD_PARAM, "empty fop in the pipeline")
+		}
+	}
+
+	fileServ, servErr := newLocalFileServer()
+	if servErr != nil {
+		return nil, 0, "", NewUfopError(E_INTERNAL, servErr.Error())
+	}
+	defer fileServ.Close()
+
+	//intermediate results removed when the pipeline finished
+	tmpFiles := make([]string, 0)
+	defer func() {
+		for _, tmpFile := range tmpFiles {
+			os.Remove(tmpFile)
+		}
+	}()
+
+	stageReq := ufopReq
+	for index, cmd := range cmds {
+		if index > 0 {
+			fop := fopOf(cmd)
+			if slotErr := slot.Acquire(ctx, this.jobLimiters[fop]); slotErr != nil {
+				if slotErr == errLimiterFull {
+					this.metrics.jobRejected(fop)
+					slotErr = NewUfopError(E_TOO_MANY_JOBS, slotErr.Error())
+				} else {
+					slotErr = NewUfopError(E_CANCELLED, fmt.Sprintf("wait for job slot error, %s", slotErr.Error()))
+				}
+				return nil, 0, "", ToUfopError(slotErr).
+					WithDetail("stage", index+1).
+					WithDetail("cmd", redactCmd(cmd))
+			}
+		}
+		stageReq.Cmd = cmd
+		stageCtx := utils.WithProgressObserver(ctx, &stageProgress{ctx, index, len(cmds)})
+		result, resultType, contentType, err := this.handleFop(stageCtx, stageReq)
+		if err != nil {
+			return nil, 0, "", ToUfopError(err).
+				WithDetail("stage", index+1).
+				WithDetail("cmd", redactCmd(cmd))
+		}
+
+		if index == len(cmds)-1 {
+			//the stream may read the src served by the pipeline, which is closed on return
+			if resultType == RESULT_TYPE_OCTECT_STREAM {
+				resultFile, saveErr := saveStreamResult(ctx, result)
+				if saveErr != nil {
+					return nil, 0, "", ToUfopError(saveErr).
+						WithDetail("stage", index+1).
+						WithDetail("cmd", redactCmd(cmd))
+				}
+				return resultFile, RESULT_TYPE_OCTECT_FILE, contentType, nil
+			}
+			return result, resultType, contentType, nil
+		}
+
+		resultFile, saveErr := saveStageResult(ctx, result, resultType, contentType)
+		if resultFile != "" {
+			tmpFiles = append(tmpFiles, resultFile)
+		}
+		if saveErr != nil {
+			return nil, 0, "", ToUfopError(saveErr).
+				WithDetail("stage", index+1).
+				WithDetail("cmd", redactCmd(cmd))
+		}
+
+		//the content type of the result is the mimetype of the next src
+		mimeType := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+		if resultType == RESULT_TYPE_JSON {
+			mimeType = "application/json"
+		}
+		src, addErr := fileServ.Add(resultFile, mimeType)
+		if addErr != nil {
+			return nil, 0, "", NewUfopError(E_INTERNAL, addErr.Error())
+		}
+		stageReq.Src = src
+		//the stages without progress are counted when they finish
+		utils.ObserveProgress(ctx, index+1, len(cmds))
+	}
+	return nil, 0, "", nil
+}
+
+//save the result of the fop to a local file
+func saveStageResult(ctx context.Context, result interface{}, resultType int, contentType string) (resultFile string, err error) {
+	switch resultType {
+	case RESULT_TYPE_OCTECT_FILE:
+		resultFile, _ = result.(string)
+		return
+	case RESULT_TYPE_OCTECT_STREAM:
+		resultFile, err = saveStreamResult(ctx, result)
+		return
+	case RESULT_TYPE_OCTECT_URL:
+		resUrl, _ := result.(string)
+		resultFile = filepath.Join(os.TempDir(), fmt.Sprintf("ufop_pipeline_%s_%d", utils.Md5Hex(resUrl), time.Now().UnixNano()))
+		if _, dErr := utils.Download(ctx, resUrl, resultFile); dErr != nil {
+			err = NewUfopError(E_UPSTREAM_FETCH, dErr.Error())
+		}
+		return
+	}
+
+	var data []byte
+	if resultType == RESULT_TYPE_JSON {
+		var encodeErr error
+		if data, encodeErr = json.Marshal(result); encodeErr != nil {
+			err = errors.New(fmt.Sprintf("encode fop result error, %s", encodeErr.Error()))
+			return
+		}
+	} else {
+		data, _ = result.([]byte)
+	}
+
+	tmpFp, tmpErr := ioutil.TempFile("", "ufop_pipeline_")
+	if tmpErr != nil {
+		err = errors.New(fmt.Sprintf("create pipeline temp file error, %s", tmpErr.Error()))
+		return
+	}
+	resultFile = tmpFp.Name()
+	_, wErr := tmpFp.Write(data)
+	tmpFp.Close()
+	if wErr != nil {
+		err = errors.New(fmt.Sprintf("save fop result error, %s", wErr.Error()))
+	}
+	return
+}
+
+//write the stream result to a temp file, for the consumers keeping the result
+func saveStreamResult(ctx context.Context, result interface{}) (resultFile string, err error) {
+	stream, ok := result.(UfopStreamResult)
+	if !ok {
+		err = errors.New("invalid stream result")
+		return
+	}
+
+	tmpFp, tmpErr := ioutil.TempFile("", "ufop_stream_")
+	if tmpErr != nil {
+		err = errors.New(fmt.Sprintf("create stream temp file error, %s", tmpErr.Error()))
+		return
+	}
+	wErr := stream.WriteTo(ctx, tmpFp)
+	tmpFp.Close()
+	if wErr != nil {
+		os.Remove(tmpFp.Name())
+		err = wErr
+		return
+	}
+	resultFile = tmpFp.Name()
+	return
+}
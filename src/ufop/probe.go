@@ -0,0 +1,98 @@
+package ufop
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+)
+
+type UfopHandlerInfo struct {
+	Name           string                 `json:"name"`
+	Cmd            string                 `json:"cmd"`
+	Syntax         string                 `json:"syntax,omitempty"`
+	Timeout        int                    `json:"timeout"`
+	MaxConcurrency int                    `json:"max_concurrency"`
+	QueueDepth     int                    `json:"queue_depth"`
+	Limits         map[string]interface{} `json:"limits,omitempty"`
+}
+
+//liveness probe
+func (this *UfopServer) serveHealth(w http.ResponseWriter, req *http.Request) {
+	writeJsonResult(w, "", 200, map[string]string{
+		"status": "ok",
+	})
+}
+
+//readiness probe, check the temp dir and the external programs of the handlers
+func (this *UfopServer) serveReady(w http.ResponseWriter, req *http.Request) {
+	checkErrors := make(map[string]string)
+
+	if tmpErr := checkTempDir(); tmpErr != nil {
+		checkErrors["tempdir"] = tmpErr.Error()
+	}
+
+	for fop, jobHandler := range this.jobHandlers {
+		if checker, ok := unwrapHandler(jobHandler).(UfopJobHandlerChecker); ok {
+			if checkErr := checker.CheckReady(); checkErr != nil {
+				checkErrors[fop] = checkErr.Error()
+			}
+		}
+	}
+
+	if len(checkErrors) != 0 {
+		writeJsonResult(w, "", 503, map[string]interface{}{
+			"status": "not ready",
+			"errors": checkErrors,
+		})
+		return
+	}
+
+	writeJsonResult(w, "", 200, map[string]string{
+		"status": "ready",
+	})
+}
+
+//list the registered handlers
+func (this *UfopServer) serveHandlers(w http.ResponseWriter, req *http.Request) {
+	handlerInfos := make([]UfopHandlerInfo, 0, len(this.jobHandlers))
+	for fop, jobHandler := range this.jobHandlers {
+		handlerConf := this.cfg.Handlers[jobHandler.Name()]
+		handlerInfo := UfopHandlerInfo{
+			Name:           fop,
+			Cmd:            jobHandler.Name(),
+			Timeout:        handlerConf.Timeout,
+			MaxConcurrency: handlerConf.MaxConcurrency,
+			QueueDepth:     handlerConf.QueueDepth,
+		}
+		if describer, ok := unwrapHandler(jobHandler).(UfopJobHandlerDescriber); ok {
+			handlerInfo.Syntax = describer.Syntax()
+			handlerInfo.Limits = describer.Limits()
+		}
+		handlerInfos = append(handlerInfos, handlerInfo)
+	}
+
+	sort.Slice(handlerInfos, func(i, j int) bool {
+		return handlerInfos[i].Name < handlerInfos[j].Name
+	})
+	writeJsonResult(w, "", 200, handlerInfos)
+}
+
+func checkTempDir() (err error) {
+	tmpFp, tmpErr := ioutil.TempFile("", "ready")
+	if tmpErr != nil {
+		err = tmpErr
+		return
+	}
+	tmpFp.Close()
+	err = os.Remove(tmpFp.Name())
+	return
+}
+
+//get the original handler wrapped by the adapter
+func unwrapHandler(jobHandler UfopJobHandlerV2) interface{} {
+	if adapter, ok := jobHandler.(*jobHandlerAdapter); ok {
+		return adapter.UfopJobHandler
+	}
+	return jobHandler
+}
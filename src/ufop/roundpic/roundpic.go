@@ -1,6 +1,7 @@
 package roundpic
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -18,6 +19,7 @@ import (
 	"strings"
 	"time"
 	"ufop"
+	"ufop/cmdspec"
 	"ufop/utils"
 )
 
@@ -34,9 +36,9 @@ type RoundPicConfig struct {
 }
 
 type RoundPicParams struct {
-	RadiusX string
-	RadiusY string
-	Radius  string
+	RadiusX string `cmd:"radius-x"`
+	RadiusY string `cmd:"radius-y"`
+	Radius  string `cmd:"radius"`
 }
 
 func (this *RoundPicer) Name() string {
@@ -65,34 +67,64 @@ func (this *RoundPicer) InitConfig(jobConf string) (err error) {
 		this.maxFileSize = config.RoundPicMaxFileSize
 	}
 
+	//imagick is initialized once for the process, never terminated since the
+	//requests share it
+	imagick.Initialize()
 	return
 }
 
-func (this *RoundPicer) parse(cmd string) (params RoundPicParams, err error) {
-	pattern := `^roundpic((/radius/\d+(\.\d+){0,1}%{0,1})|(/radius-x/\d+(\.\d+){0,1}%{0,1}/radius-y/\d+(\.\d+){0,1}%{0,1}))$`
-	if matched, _ := regexp.MatchString(pattern, cmd); !matched {
-		err = errors.New("invalid roundpic command")
-		return
+func (this *RoundPicer) Syntax() string {
+	return roundpicSpec.Syntax()
+}
+
+func (this *RoundPicer) Limits() map[string]interface{} {
+	return map[string]interface{}{
+		"round_pic_max_file_size": this.maxFileSize,
 	}
+}
 
-	params = RoundPicParams{}
+//imagick is linked in and initialized by InitConfig, check the formats are supported
+//by the ImageMagick library
+func (this *RoundPicer) CheckReady() (err error) {
+	for _, format := range []string{"PNG", "JPEG"} {
+		if len(imagick.QueryFormats(format)) == 0 {
+			err = errors.New(fmt.Sprintf("imagick format '%s' not supported", format))
+			return
+		}
+	}
+	return
+}
 
-	//get radius if specified
-	params.Radius = utils.GetParam(cmd, `radius/\d+(\.\d+){0,1}%{0,1}`, "radius")
+var roundpicSpec = cmdspec.Spec{
+	Name: "roundpic",
+	Params: []cmdspec.Param{
+		{Name: "radius", Type: cmdspec.PARAM_STRING, Pattern: `^\d+(\.\d+)?%?$`},
+		{Name: "radius-x", Type: cmdspec.PARAM_STRING, Pattern: `^\d+(\.\d+)?%?$`},
+		{Name: "radius-y", Type: cmdspec.PARAM_STRING, Pattern: `^\d+(\.\d+)?%?$`},
+	},
+}
+
+func (this *RoundPicer) parse(cmd string) (params RoundPicParams, err error) {
+	params = RoundPicParams{}
+	if err = roundpicSpec.Parse(cmd, &params); err != nil {
+		return
+	}
 
-	//get radius-x, radius-y
-	params.RadiusX = utils.GetParam(cmd, `radius-x/\d+(\.\d+){0,1}%{0,1}`, "radius-x")
-	params.RadiusY = utils.GetParam(cmd, `radius-y/\d+(\.\d+){0,1}%{0,1}`, "radius-y")
+	//either radius or both radius-x and radius-y
+	if params.Radius != "" && (params.RadiusX != "" || params.RadiusY != "") {
+		err = ufop.NewUfopError(ufop.E_BAD_PARAM, "roundpic radius can not be used with radius-x or radius-y")
+		return
+	}
 
 	if params.Radius == "" && (params.RadiusX == "" || params.RadiusY == "") {
-		err = errors.New("roundpic radius or radius-x or radius-y empty error")
+		err = ufop.NewUfopError(ufop.E_BAD_PARAM, "roundpic radius or radius-x or radius-y empty error")
 		return
 	}
 
 	return
 }
 
-func (this *RoundPicer) Do(req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
+func (this *RoundPicer) DoContext(ctx context.Context, req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
 	//parse cmd
 	cmdParams, pErr := this.parse(req.Cmd)
 	if pErr != nil {
@@ -102,22 +134,23 @@ func (this *RoundPicer) Do(req ufop.UfopRequest) (result interface{}, resultType
 
 	//check src image
 	if matched, _ := regexp.MatchString("image/(png|jpeg)", req.Src.MimeType); !matched {
-		err = errors.New("unsupported mimetype, only 'image/png' and 'image/jpeg' supported")
+		err = ufop.NewUfopError(ufop.E_SRC_UNSUPPORTED, "unsupported mimetype, only 'image/png' and 'image/jpeg' supported")
 		return
 	}
 
 	if req.Src.Fsize > this.maxFileSize {
-		err = errors.New("src image size too large, exceeds the limit")
+		err = ufop.NewUfopError(ufop.E_SRC_TOO_LARGE, "src image size too large, exceeds the limit").
+			WithDetail("limit", this.maxFileSize)
 		return
 	}
 
 	//download the image
-	resp, respErr := http.Get(req.Src.Url)
+	resp, respErr := utils.HttpGet(ctx, req.Src.Url)
 	if respErr != nil || resp.StatusCode != http.StatusOK {
 		if respErr != nil {
-			err = errors.New(fmt.Sprintf("get image data failed, %s", respErr.Error()))
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("get image data failed, %s", respErr.Error()))
 		} else {
-			err = errors.New(fmt.Sprintf("get image data failed, %s", resp.Status))
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("get image data failed, %s", resp.Status))
 			if resp.Body != nil {
 				resp.Body.Close()
 			}
@@ -128,7 +161,7 @@ func (this *RoundPicer) Do(req ufop.UfopRequest) (result interface{}, resultType
 
 	srcImgData, readErr := ioutil.ReadAll(resp.Body)
 	if readErr != nil {
-		err = errors.New(fmt.Sprintf("read image data failed, %s", readErr.Error()))
+		err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("read image data failed, %s", readErr.Error()))
 		return
 	}
 
@@ -143,7 +176,7 @@ func (this *RoundPicer) Do(req ufop.UfopRequest) (result interface{}, resultType
 	}
 
 	if decodeErr != nil {
-		err = errors.New(fmt.Sprintf("decode image failed, %s", decodeErr.Error()))
+		err = ufop.NewUfopError(ufop.E_SRC_INVALID, fmt.Sprintf("decode image failed, %s", decodeErr.Error()))
 		return
 	}
 
@@ -153,10 +186,6 @@ func (this *RoundPicer) Do(req ufop.UfopRequest) (result interface{}, resultType
 	//parse cmd params, radius can be pixels or percentage
 	radiusX, radiusY := getRadius(cmdParams, srcImgWidth, srcImgHeight)
 
-	//init imagick
-	imagick.Initialize()
-	defer imagick.Terminate()
-
 	//create mask
 	maskDraw := imagick.NewMagickWand()
 	defer maskDraw.Destroy()
@@ -168,7 +197,7 @@ func (this *RoundPicer) Do(req ufop.UfopRequest) (result interface{}, resultType
 	//draw mask
 	nErr := maskDraw.NewImage(uint(srcImgWidth), uint(srcImgHeight), backDraw)
 	if nErr != nil {
-		err = errors.New(fmt.Sprintf("create mask image failed, %s", nErr.Error()))
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("create mask image failed, %s", nErr.Error()))
 		return
 	}
 
@@ -181,7 +210,7 @@ func (this *RoundPicer) Do(req ufop.UfopRequest) (result interface{}, resultType
 	//draw round pic
 	dErr := maskDraw.DrawImage(roundDraw)
 	if dErr != nil {
-		err = errors.New(fmt.Sprintf("draw mask image failed, %s", dErr.Error()))
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("draw mask image failed, %s", dErr.Error()))
 		return
 	}
 
@@ -190,14 +219,14 @@ func (this *RoundPicer) Do(req ufop.UfopRequest) (result interface{}, resultType
 	defer srcDraw.Destroy()
 	rErr := srcDraw.ReadImageBlob(srcImgData)
 	if rErr != nil {
-		err = errors.New(fmt.Sprintf("read src image failed, %s", rErr.Error()))
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("read src image failed, %s", rErr.Error()))
 		return
 	}
 
 	//composite the mask and the src image
 	cErr := maskDraw.CompositeImage(srcDraw, imagick.COMPOSITE_OP_SRC_IN, 0, 0)
 	if cErr != nil {
-		err = errors.New(fmt.Sprintf("composite mask and src image failed, %s", cErr.Error()))
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("composite mask and src image failed, %s", cErr.Error()))
 		return
 	}
 
@@ -205,7 +234,7 @@ func (this *RoundPicer) Do(req ufop.UfopRequest) (result interface{}, resultType
 	oTmpFpath := filepath.Join(os.TempDir(), fmt.Sprintf("roundpic_tmp_result_%d.png", time.Now().UnixNano()))
 	wErr := maskDraw.WriteImage(oTmpFpath)
 	if wErr != nil {
-		err = errors.New(fmt.Sprintf("write dest image failed, %s", wErr.Error()))
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("write dest image failed, %s", wErr.Error()))
 		defer os.Remove(oTmpFpath)
 		return
 	}
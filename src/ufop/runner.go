@@ -0,0 +1,135 @@
+package ufop
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+type UfopRunOptions struct {
+	Cmd string
+	//local file used as the src, optional for the handlers not using the src
+	SrcFile string
+	//detected by the file extension or content if empty
+	SrcMimeType string
+	//write to stdout if empty or "-"
+	OutFile string
+}
+
+//run the fop once without the http server, the local src file is served to the
+//handler by a loopback stand-in of the resource url
+func (this *UfopServer) Run(options UfopRunOptions) (err error) {
+	fileServ, servErr := newLocalFileServer()
+	if servErr != nil {
+		err = servErr
+		return
+	}
+	defer fileServ.Close()
+
+	ufopReq := UfopRequest{
+		Cmd: options.Cmd,
+	}
+	//the fops can be given with or without the ufop prefix
+	cmds := pipelineCmds(options.Cmd)
+	for index, cmd := range cmds {
+		if !strings.HasPrefix(cmd, this.cfg.UfopPrefix) {
+			cmds[index] = this.cfg.UfopPrefix + cmd
+		}
+	}
+	ufopReq.Cmd = strings.Join(cmds, PIPELINE_SEPARATOR)
+
+	if options.SrcFile != "" {
+		if ufopReq.Src, err = fileServ.Add(options.SrcFile, options.SrcMimeType); err != nil {
+			return
+		}
+	}
+
+	//cancel the job by ctrl-c, so the external commands are killed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+	defer signal.Stop(sigChan)
+	go func() {
+		select {
+		case <-sigChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	//no limit for the local run
+	result, resultType, _, jobErr := this.handleJob(ctx, ufopReq, nil)
+	if jobErr != nil {
+		err = jobErr
+		return
+	}
+
+	var out io.Writer = os.Stdout
+	if options.OutFile != "" && options.OutFile != "-" {
+		outFp, openErr := os.Create(options.OutFile)
+		if openErr != nil {
+			err = errors.New(fmt.Sprintf("create output file error, %s", openErr.Error()))
+			return
+		}
+		defer outFp.Close()
+		out = outFp
+	}
+
+	err = writeRunResult(ctx, out, result, resultType)
+	return
+}
+
+func writeRunResult(ctx context.Context, out io.Writer, result interface{}, resultType int) (err error) {
+	switch resultType {
+	case RESULT_TYPE_JSON:
+		data, encodeErr := json.MarshalIndent(result, "", "    ")
+		if encodeErr != nil {
+			err = errors.New(fmt.Sprintf("encode ufop result error, %s", encodeErr.Error()))
+			return
+		}
+		data = append(data, '\n')
+		_, err = out.Write(data)
+	case RESULT_TYPE_OCTECT_BYTES:
+		if data, ok := result.([]byte); ok {
+			_, err = out.Write(data)
+		}
+	case RESULT_TYPE_OCTECT_FILE:
+		filePath, _ := result.(string)
+		defer os.Remove(filePath)
+		resultFp, openErr := os.Open(filePath)
+		if openErr != nil {
+			err = errors.New(fmt.Sprintf("open result local file error, %s", openErr.Error()))
+			return
+		}
+		defer resultFp.Close()
+		_, err = io.Copy(out, resultFp)
+	case RESULT_TYPE_OCTECT_STREAM:
+		if stream, ok := result.(UfopStreamResult); ok {
+			err = stream.WriteTo(ctx, out)
+		}
+	case RESULT_TYPE_OCTECT_URL:
+		resUrl, _ := result.(string)
+		resp, respErr := http.Get(resUrl)
+		if respErr != nil {
+			err = errors.New(fmt.Sprintf("get result resource error, %s", respErr.Error()))
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = errors.New(fmt.Sprintf("get result resource error, %s", resp.Status))
+			return
+		}
+		_, err = io.Copy(out, resp.Body)
+	}
+	if err != nil {
+		err = errors.New(fmt.Sprintf("write ufop result error, %s", err.Error()))
+	}
+	return
+}
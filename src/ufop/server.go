@@ -1,6 +1,7 @@
 package ufop
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,40 +10,146 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"ufop/utils"
 )
 
 type UfopServer struct {
 	cfg         *UfopConfig
-	jobHandlers map[string]UfopJobHandler
+	jobHandlers map[string]UfopJobHandlerV2
+	jobLimiters map[string]*limiter
+	jobs        *jobManager
+	metrics     *ufopMetrics
 }
 
 func NewServer(cfg *UfopConfig) *UfopServer {
 	serv := UfopServer{}
 	serv.cfg = cfg
-	serv.jobHandlers = make(map[string]UfopJobHandler, 0)
+	serv.jobHandlers = make(map[string]UfopJobHandlerV2, 0)
+	serv.jobLimiters = make(map[string]*limiter, 0)
+	serv.metrics = newUfopMetrics()
+	serv.jobs = newJobManager(cfg.AsyncWorkers, cfg.AsyncQueueSize,
+		time.Duration(cfg.AsyncJobExpire)*time.Second, serv.handleJob)
 	return &serv
 }
 
 func (this *UfopServer) RegisterJobHandler(jobConf string, jobHandler interface{}) (err error) {
-	if h, ok := jobHandler.(UfopJobHandler); ok {
-		initErr := h.InitConfig(jobConf)
-		if initErr != nil {
-			err = errors.New(fmt.Sprintf("init job handler for cmd '%s' error, %s", h.Name(), initErr.Error()))
+	var h UfopJobHandlerV2
+	switch v := jobHandler.(type) {
+	case UfopJobHandlerV2:
+		h = v
+	case UfopJobHandler:
+		h = &jobHandlerAdapter{v}
+	default:
+		err = errors.New(fmt.Sprintf("job handler of [%s] must implement interface UfopJobHandler or UfopJobHandlerV2", jobConf))
+		return
+	}
+
+	initErr := h.InitConfig(jobConf)
+	if initErr != nil {
+		err = errors.New(fmt.Sprintf("init job handler for cmd '%s' error, %s", h.Name(), initErr.Error()))
+		return
+	}
+
+	this.jobHandlers[this.cfg.UfopPrefix+h.Name()] = h
+	if handlerConf := this.cfg.Handlers[h.Name()]; handlerConf.MaxConcurrency > 0 {
+		this.jobLimiters[this.cfg.UfopPrefix+h.Name()] = newLimiter(handlerConf.MaxConcurrency, handlerConf.QueueDepth)
+	}
+	return
+}
+
+//register the handlers enabled in the config, available are the handlers built in
+func (this *UfopServer) RegisterJobHandlers(available ...interface{}) (err error) {
+	availableHandlers := make(map[string]interface{})
+	for _, jobHandler := range available {
+		switch v := jobHandler.(type) {
+		case UfopJobHandlerV2:
+			availableHandlers[v.Name()] = v
+		case UfopJobHandler:
+			availableHandlers[v.Name()] = v
+		}
+	}
+
+	if len(this.cfg.Handlers) == 0 {
+		err = errors.New("no handlers enabled in the ufop config")
+		return
+	}
+
+	names := make([]string, 0, len(this.cfg.Handlers))
+	for name := range this.cfg.Handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		jobHandler, ok := availableHandlers[name]
+		if !ok {
+			err = errors.New(fmt.Sprintf("unknown handler '%s' in the ufop config", name))
 			return
 		}
 
-		this.jobHandlers[this.cfg.UfopPrefix+h.Name()] = h
-	} else {
-		err = errors.New(fmt.Sprintf("job handler of [%s] must implement interface UfopJobHandler", jobConf))
+		handlerConf := this.cfg.Handlers[name]
+		if handlerConf.ConfigFile != "" {
+			jobConf := handlerConf.ConfigFile
+			if !filepath.IsAbs(jobConf) {
+				jobConf = filepath.Join(this.cfg.configDir, jobConf)
+			}
+			err = this.RegisterJobHandler(jobConf, jobHandler)
+		} else if len(handlerConf.Config) != 0 {
+			err = this.registerJobHandlerInline(name, handlerConf.Config, jobHandler)
+		} else {
+			err = errors.New(fmt.Sprintf("no config or config_file for handler '%s'", name))
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+//the handlers load config from file, so save the inline config to a temp file
+func (this *UfopServer) registerJobHandlerInline(name string, config json.RawMessage, jobHandler interface{}) (err error) {
+	confFp, tmpErr := ioutil.TempFile("", fmt.Sprintf("ufop_%s_conf", name))
+	if tmpErr != nil {
+		err = errors.New(fmt.Sprintf("save inline config of handler '%s' error, %s", name, tmpErr.Error()))
+		return
 	}
+	defer os.Remove(confFp.Name())
+
+	_, wErr := confFp.Write(config)
+	confFp.Close()
+	if wErr != nil {
+		err = errors.New(fmt.Sprintf("save inline config of handler '%s' error, %s", name, wErr.Error()))
+		return
+	}
+
+	err = this.RegisterJobHandler(confFp.Name(), jobHandler)
 	return
 }
 
 func (this *UfopServer) Listen() {
 	//define handler
 	http.HandleFunc("/uop", this.serveUfop)
+	http.HandleFunc("/jobs/", this.serveJobs)
+	http.HandleFunc("/metrics", this.metrics.serveMetrics)
+	http.HandleFunc("/health", this.serveHealth)
+	http.HandleFunc("/ready", this.serveReady)
+	http.HandleFunc("/handlers", this.serveHandlers)
+
+	//keep the temp files in the dedicated dir, so the disk usage is only of this service
+	if tmpErr := useTempDir(this.cfg.TempDir); tmpErr != nil {
+		log.Println(tmpErr)
+		return
+	}
+	this.metrics.sampleTempDisk(this.cfg.TempDir)
+
+	//start async job cleaner
+	this.jobs.Start()
 
 	//bind and listen
 	endPoint := fmt.Sprintf("%s:%d", this.cfg.ListenHost, this.cfg.ListenPort)
@@ -59,10 +166,39 @@ func (this *UfopServer) Listen() {
 	}
 }
 
+//the params hidden in the logs, the job status and the error details
+var secretParamRegexp = regexp.MustCompile(`(^|[/|])(password)/[^/|"]*`)
+
+//hide the values of the secret params like the password of mkzip or unrar, the cmd
+//can also be in the raw request body
+func redactCmd(cmd string) string {
+	return secretParamRegexp.ReplaceAllString(cmd, "${1}${2}/***")
+}
+
+//the temp dir is set as TMPDIR, used by ioutil.TempFile, os.TempDir and the commands
+func useTempDir(tmpDir string) (err error) {
+	if mkErr := os.MkdirAll(tmpDir, 0755); mkErr != nil {
+		err = errors.New(fmt.Sprintf("create temp dir error, %s", mkErr.Error()))
+		return
+	}
+	err = os.Setenv("TMPDIR", tmpDir)
+	return
+}
+
+//log of the failed ufop requests
+type ufopErrorLog struct {
+	ReqId   string      `json:"reqid"`
+	Request UfopRequest `json:"request"`
+	Code    string      `json:"code"`
+	Error   string      `json:"error"`
+}
+
 func (this *UfopServer) serveUfop(w http.ResponseWriter, req *http.Request) {
+	reqId := requestId(w, req)
+
 	//check method
 	if req.Method != "POST" {
-		writeJsonError(w, 405, "method not allowed")
+		writeJsonError(w, reqId, NewUfopError(E_METHOD_NOT_ALLOWED, "method not allowed"))
 		return
 	}
 
@@ -75,75 +211,274 @@ func (this *UfopServer) serveUfop(w http.ResponseWriter, req *http.Request) {
 
 	ufopReqData, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		writeJsonError(w, 500, "read ufop request body error")
+		writeJsonError(w, reqId, NewUfopError(E_BAD_REQUEST, "read ufop request body error"))
 		return
 	}
-	log.Info(string(ufopReqData))
+	log.Info(redactCmd(string(ufopReqData)))
 	err = json.Unmarshal(ufopReqData, &ufopReq)
 	if err != nil {
-		writeJsonError(w, 500, "parse ufop request body error")
+		writeJsonError(w, reqId, NewUfopError(E_BAD_REQUEST, "parse ufop request body error"))
+		return
+	}
+
+	//admission control of the handler
+	fop := fopOf(ufopReq.Cmd)
+	jobLimiter := this.jobLimiters[fop]
+	if !jobLimiter.Enter() {
+		this.metrics.jobRejected(fop)
+		writeRetryLater(w, reqId, this.cfg.RetryAfter, errLimiterFull.Error())
+		return
+	}
+
+	if ufopReq.Async {
+		job, submitErr := this.jobs.Submit(reqId, ufopReq, jobLimiter)
+		if submitErr != nil {
+			jobLimiter.Leave()
+			if submitErr == ErrJobQueueFull {
+				this.metrics.jobRejected(fop)
+				writeRetryLater(w, reqId, this.cfg.RetryAfter, submitErr.Error())
+			} else {
+				writeJsonError(w, reqId, submitErr)
+			}
+			return
+		}
+		writeJsonResult(w, reqId, 200, job)
 		return
 	}
 
-	ufopResult, ufopResultType, ufopResultContentType, err = handleJob(ufopReq, this.cfg.UfopPrefix, this.jobHandlers)
+	//the context is cancelled when the client disconnects
+	if acquireErr := jobLimiter.Acquire(req.Context()); acquireErr != nil {
+		log.Error("wait for job slot error,", acquireErr)
+		return
+	}
+	//released even if the handler panics, and after the stream result is written
+	slot := &jobSlot{limiter: jobLimiter, held: true}
+	defer slot.Release()
+	ufopResult, ufopResultType, ufopResultContentType, err = this.handleJob(req.Context(), ufopReq, slot)
 	if err != nil {
-		ufopErr := UfopError{
+		errLog := ufopErrorLog{
+			ReqId:   reqId,
 			Request: ufopReq,
+			Code:    ToUfopError(err).Code,
 			Error:   err.Error(),
 		}
-		logBytes, _ := json.Marshal(&ufopErr)
+		errLog.Request.Cmd = redactCmd(ufopReq.Cmd)
+		logBytes, _ := json.Marshal(&errLog)
 		log.Error(string(logBytes))
-		writeJsonError(w, 400, err.Error())
+		writeJsonError(w, reqId, err)
 	} else {
+		cw := &countingResponseWriter{ResponseWriter: w}
+		defer func() {
+			this.metrics.addResponseBytes(fop, cw.written)
+		}()
+		w = cw
 		switch ufopResultType {
 		case RESULT_TYPE_JSON:
-			writeJsonResult(w, 200, ufopResult)
+			writeJsonResult(w, reqId, 200, ufopResult)
 		case RESULT_TYPE_OCTECT_BYTES:
 			writeOctetResultFromBytes(w, ufopResult, ufopResultContentType)
 		case RESULT_TYPE_OCTECT_FILE:
 			writeOctetResultFromFile(w, ufopResult, ufopResultContentType)
+		case RESULT_TYPE_OCTECT_STREAM:
+			writeOctetResultFromStream(req.Context(), w, reqId, ufopResult, ufopResultContentType)
 		case RESULT_TYPE_OCTECT_URL:
 			writeOctectResultFromUrl(w, ufopResult)
 		}
 	}
 }
 
-func handleJob(ufopReq UfopRequest, ufopPrefix string, jobHandlers map[string]UfopJobHandler) (interface{}, int, string, error) {
+/*
+
+GET /jobs/<id>			job status, progress and json result
+GET /jobs/<id>/result	octect result of the job
+
+*/
+func (this *UfopServer) serveJobs(w http.ResponseWriter, req *http.Request) {
+	reqId := requestId(w, req)
+
+	if req.Method != "GET" {
+		writeJsonError(w, reqId, NewUfopError(E_METHOD_NOT_ALLOWED, "method not allowed"))
+		return
+	}
+
+	items := strings.Split(strings.TrimPrefix(req.URL.Path, "/jobs/"), "/")
+	if len(items) > 2 || (len(items) == 2 && items[1] != "result") {
+		writeJsonError(w, reqId, NewUfopError(E_NOT_FOUND, "not found"))
+		return
+	}
+
+	job, ok := this.jobs.Get(items[0])
+	if !ok {
+		writeJsonError(w, reqId, NewUfopError(E_NOT_FOUND, "no such job"))
+		return
+	}
+
+	if len(items) == 1 {
+		writeJsonResult(w, reqId, 200, job)
+		return
+	}
+
+	if job.Status != JOB_STATUS_DONE {
+		writeJsonError(w, reqId, NewUfopError(E_NOT_FOUND, fmt.Sprintf("job result not available, job is %s", job.Status)))
+		return
+	}
+
+	cw := &countingResponseWriter{ResponseWriter: w}
+	defer func() {
+		this.metrics.addResponseBytes(fopOf(job.Cmd), cw.written)
+	}()
+	w = cw
+
+	//the result file is kept until the job expires
+	switch job.resultType {
+	case RESULT_TYPE_JSON:
+		writeJsonResult(w, reqId, 200, job.result)
+	case RESULT_TYPE_OCTECT_BYTES:
+		writeOctetResultFromBytes(w, job.result, job.contentType)
+	case RESULT_TYPE_OCTECT_FILE:
+		serveOctetFile(w, job.result, job.contentType)
+	case RESULT_TYPE_OCTECT_URL:
+		writeOctectResultFromUrl(w, job.result)
+	}
+}
+
+//run a single fop of the pipeline
+func (this *UfopServer) handleFop(ctx context.Context, ufopReq UfopRequest) (interface{}, int, string, error) {
 	var ufopResult interface{}
 	var resultType int
 	var contentType string
 	var err error
 	cmd := ufopReq.Cmd
 
-	items := strings.SplitN(cmd, "/", 2)
-	fop := items[0]
-	if jobHandler, ok := jobHandlers[fop]; ok {
-		ufopReq.Cmd = strings.TrimPrefix(ufopReq.Cmd, ufopPrefix)
-		ufopResult, resultType, contentType, err = jobHandler.Do(ufopReq)
+	fop := fopOf(cmd)
+	if jobHandler, ok := this.jobHandlers[fop]; ok {
+		this.metrics.jobStarted(fop)
+		jobStart := time.Now()
+		defer func() {
+			//the stream result is still working, finished when it is written
+			if err == nil && resultType == RESULT_TYPE_OCTECT_STREAM {
+				return
+			}
+			this.metrics.jobFinished(fop, time.Since(jobStart), err)
+		}()
+		observer := &jobObserver{this.metrics, fop}
+		ctx = utils.WithObserver(ctx, observer)
+
+		timeout := this.cfg.Handlers[jobHandler.Name()].Timeout
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+			defer cancel()
+		}
+		ufopReq.Cmd = strings.TrimPrefix(ufopReq.Cmd, this.cfg.UfopPrefix)
+		ufopResult, resultType, contentType, err = jobHandler.DoContext(ctx, ufopReq)
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			err = timeoutError(err, timeout)
+		}
+		if err == nil && resultType == RESULT_TYPE_OCTECT_STREAM {
+			ufopResult = &fopStream{
+				stream:   ufopResult,
+				metrics:  this.metrics,
+				observer: observer,
+				fop:      fop,
+				start:    jobStart,
+				timeout:  timeout,
+			}
+		}
 	} else {
-		err = errors.New("no fop available for the request")
+		err = NewUfopError(E_NO_FOP, "no fop available for the request")
 	}
 	return ufopResult, resultType, contentType, err
 }
 
-func writeJsonError(w http.ResponseWriter, statusCode int, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	io.WriteString(w, fmt.Sprintf(`{"error":"%s"}`, message))
+func timeoutError(err error, timeout int) error {
+	return NewUfopError(E_TIMEOUT, fmt.Sprintf("%s, job timeout", err.Error())).
+		WithDetail("timeout", timeout)
+}
+
+//the stream result of a fop, the stream does the real work of the job while it is
+//written, so it is bounded by the timeout of the handler counted from the job start,
+//observed by the job observer, and the job is finished when it is written
+type fopStream struct {
+	stream   interface{}
+	metrics  *ufopMetrics
+	observer *jobObserver
+	fop      string
+	start    time.Time
+	//seconds, 0 means no limit
+	timeout int
+}
+
+func (this *fopStream) WriteTo(ctx context.Context, w io.Writer) (err error) {
+	defer func() {
+		this.metrics.jobFinished(this.fop, time.Since(this.start), err)
+	}()
+	stream, ok := this.stream.(UfopStreamResult)
+	if !ok {
+		err = NewUfopError(E_INTERNAL, "invalid stream result")
+		return
+	}
+
+	ctx = utils.WithObserver(ctx, this.observer)
+	if this.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, this.start.Add(time.Duration(this.timeout)*time.Second))
+		defer cancel()
+	}
+	err = stream.WriteTo(ctx, w)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = timeoutError(err, this.timeout)
+	}
+	return
 }
 
-func writeJsonResult(w http.ResponseWriter, statusCode int, result interface{}) {
+//use the reqid from the upstream if any, so the logs can be joined
+func requestId(w http.ResponseWriter, req *http.Request) string {
+	reqId := req.Header.Get("X-Reqid")
+	if reqId == "" {
+		reqId, _ = newRandomId()
+	}
+	w.Header().Set("X-Reqid", reqId)
+	return reqId
+}
+
+func writeJsonError(w http.ResponseWriter, reqId string, err error) {
+	//copy it, the error may be shared
+	ufopErr := *ToUfopError(err)
+	ufopErr.ReqId = reqId
+
+	data, encodeErr := json.Marshal(&ufopErr)
+	if encodeErr != nil {
+		log.Error("encode ufop error error,", encodeErr)
+		ufopErr = *NewUfopError(E_INTERNAL, "encode ufop error error")
+		ufopErr.ReqId = reqId
+		data, _ = json.Marshal(&ufopErr)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
+	w.WriteHeader(ufopErr.StatusCode)
+	if _, wErr := w.Write(data); wErr != nil {
+		log.Error("write json error response error", wErr)
+	}
+}
+
+func writeRetryLater(w http.ResponseWriter, reqId string, retryAfter int, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeJsonError(w, reqId, NewUfopError(E_TOO_MANY_JOBS, message).WithDetail("retry_after", retryAfter))
+}
+
+func writeJsonResult(w http.ResponseWriter, reqId string, statusCode int, result interface{}) {
 	data, err := json.Marshal(result)
 	if err != nil {
 		log.Error("encode ufop result error,", err)
-		writeJsonError(w, 500, "encode ufop result error")
-	} else {
-		_, err := io.WriteString(w, string(data))
-		if err != nil {
-			log.Error("write json response error", err)
-		}
+		writeJsonError(w, reqId, NewUfopError(E_INTERNAL, "encode ufop result error"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_, err = w.Write(data)
+	if err != nil {
+		log.Error("write json response error", err)
 	}
 }
 
@@ -161,11 +496,34 @@ func writeOctetResultFromBytes(w http.ResponseWriter, result interface{}, mimeTy
 
 func writeOctetResultFromFile(w http.ResponseWriter, result interface{}, mimeType string) {
 	//delete the tmp file
+	if v, ok := result.(string); ok {
+		defer os.Remove(v)
+	}
+	serveOctetFile(w, result, mimeType)
+}
+
+//the status is sent before the stream is produced, the response is aborted on the
+//error, so the client sees a broken response instead of a truncated one
+func writeOctetResultFromStream(ctx context.Context, w http.ResponseWriter, reqId string, result interface{}, mimeType string) {
+	stream, ok := result.(UfopStreamResult)
+	if !ok {
+		writeJsonError(w, reqId, NewUfopError(E_INTERNAL, "invalid stream result"))
+		return
+	}
+	if mimeType != "" {
+		w.Header().Set("Content-Type", mimeType)
+	}
+	if err := stream.WriteTo(ctx, w); err != nil {
+		log.Error(fmt.Sprintf("[%s] write octect from stream error, %s", reqId, err.Error()))
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func serveOctetFile(w http.ResponseWriter, result interface{}, mimeType string) {
 	var filePath string
 	if v, ok := result.(string); ok {
 		filePath = v
 	}
-	defer os.Remove(filePath)
 	//set response
 	if mimeType != "" {
 		w.Header().Set("Content-Type", mimeType)
@@ -2,3 +2,670 @@ package unrar
 
 //THIS unrar RELYS ON THE unrar PROGRAM ON UBUNTU
 //USE sudo apt-get install -y unrar TO INSTALL IT
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/qiniu/api.v6/auth/digest"
+	"github.com/qiniu/api.v6/conf"
+	fio "github.com/qiniu/api.v6/io"
+	rio "github.com/qiniu/api.v6/resumable/io"
+	"github.com/qiniu/api.v6/rs"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"ufop"
+	"ufop/cmdspec"
+	"ufop/utils"
+)
+
+const (
+	UNRAR_MAX_RAR_FILE_LENGTH uint64 = 1 * 1024 * 1024 * 1024
+	UNRAR_MAX_FILE_LENGTH     uint64 = 100 * 1024 * 1024 //100MB
+	UNRAR_MAX_FILE_COUNT      int    = 10                //10
+	//larger files are uploaded by the resumable put
+	UNRAR_RPUT_THRESHOLD int64 = 100 * 1024 * 1024
+
+	//the same bomb limits as unzip, checked on the bytes actually extracted
+	UNRAR_MAX_TOTAL_LENGTH      uint64 = 1 * 1024 * 1024 * 1024 //1GB
+	UNRAR_MAX_COMPRESSION_RATIO uint64 = 100
+	UNRAR_RATIO_CHECK_LENGTH    uint64 = 1 * 1024 * 1024 //1MB
+)
+
+//exit codes of unrar
+const (
+	UNRAR_EXIT_CRC_ERROR      = 3
+	UNRAR_EXIT_OPEN_ERROR     = 6
+	UNRAR_EXIT_WRONG_PASSWORD = 11
+)
+
+var rarMimeTypes = map[string]bool{
+	"application/x-rar-compressed": true,
+	"application/x-rar":            true,
+	"application/vnd.rar":          true,
+	"application/octet-stream":     true,
+}
+
+type UnrarResult struct {
+	Files []UnrarFile `json:"files"`
+}
+
+type UnrarFile struct {
+	Key   string `json:"key"`
+	Hash  string `json:"hash,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type Unrarer struct {
+	mac              *digest.Mac
+	maxRarFileLength uint64
+	maxFileLength    uint64
+	maxFileCount     int
+
+	maxTotalLength      uint64
+	maxCompressionRatio uint64
+}
+
+type UnrarOptions struct {
+	Bucket    string        `cmd:"bucket"`
+	Prefix    string        `cmd:"prefix"`
+	Overwrite bool          `cmd:"overwrite"`
+	Password  string        `cmd:"password"`
+	Volumes   []UnrarVolume `cmd:"volumes"`
+}
+
+type UnrarVolume struct {
+	Url string `cmd:"volume"`
+}
+
+type UnrarerConfig struct {
+	//ak & sk
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+
+	UnrarMaxRarFileLength uint64 `json:"unrar_max_rar_file_length,omitempty"`
+	UnrarMaxFileLength    uint64 `json:"unrar_max_file_length,omitempty"`
+	UnrarMaxFileCount     int    `json:"unrar_max_file_count,omitempty"`
+
+	UnrarMaxTotalLength      uint64 `json:"unrar_max_total_length,omitempty"`
+	UnrarMaxCompressionRatio uint64 `json:"unrar_max_compression_ratio,omitempty"`
+}
+
+//the entry listed by unrar
+type rarEntry struct {
+	Name       string
+	IsDir      bool
+	Size       uint64
+	PackedSize uint64
+}
+
+func (this *Unrarer) Name() string {
+	return "unrar"
+}
+
+func (this *Unrarer) InitConfig(jobConf string) (err error) {
+	confFp, openErr := os.Open(jobConf)
+	if openErr != nil {
+		err = errors.New(fmt.Sprintf("Open unrar config failed, %s", openErr.Error()))
+		return
+	}
+
+	config := UnrarerConfig{}
+	decoder := json.NewDecoder(confFp)
+	decodeErr := decoder.Decode(&config)
+	if decodeErr != nil {
+		err = errors.New(fmt.Sprintf("Parse unrar config failed, %s", decodeErr.Error()))
+		return
+	}
+
+	if config.UnrarMaxFileCount <= 0 {
+		this.maxFileCount = UNRAR_MAX_FILE_COUNT
+	} else {
+		this.maxFileCount = config.UnrarMaxFileCount
+	}
+
+	if config.UnrarMaxFileLength <= 0 {
+		this.maxFileLength = UNRAR_MAX_FILE_LENGTH
+	} else {
+		this.maxFileLength = config.UnrarMaxFileLength
+	}
+
+	if config.UnrarMaxRarFileLength <= 0 {
+		this.maxRarFileLength = UNRAR_MAX_RAR_FILE_LENGTH
+	} else {
+		this.maxRarFileLength = config.UnrarMaxRarFileLength
+	}
+
+	if config.UnrarMaxTotalLength <= 0 {
+		this.maxTotalLength = UNRAR_MAX_TOTAL_LENGTH
+	} else {
+		this.maxTotalLength = config.UnrarMaxTotalLength
+	}
+
+	if config.UnrarMaxCompressionRatio <= 0 {
+		this.maxCompressionRatio = UNRAR_MAX_COMPRESSION_RATIO
+	} else {
+		this.maxCompressionRatio = config.UnrarMaxCompressionRatio
+	}
+
+	this.mac = &digest.Mac{config.AccessKey, []byte(config.SecretKey)}
+
+	return
+}
+
+func (this *Unrarer) Syntax() string {
+	return unrarSpec.Syntax()
+}
+
+func (this *Unrarer) Limits() map[string]interface{} {
+	return map[string]interface{}{
+		"unrar_max_rar_file_length":   this.maxRarFileLength,
+		"unrar_max_file_length":       this.maxFileLength,
+		"unrar_max_file_count":        this.maxFileCount,
+		"unrar_max_total_length":      this.maxTotalLength,
+		"unrar_max_compression_ratio": this.maxCompressionRatio,
+	}
+}
+
+func (this *Unrarer) CheckReady() error {
+	return utils.CheckCommands("unrar")
+}
+
+/*
+
+unrar/bucket/<encoded bucket>/prefix/<encoded prefix>/overwrite/<[0|1]>/password/<encoded password>
+/volume/<encoded url>/volume/<encoded url>...
+
+the src is the first volume, the other volumes of a multi-volume archive are
+given in order, the volumes are saved with the file names in the urls, so the
+names must follow the naming of the archive, like a.part1.rar, a.part2.rar or
+a.rar, a.r00, a.r01
+
+*/
+var unrarSpec = cmdspec.Spec{
+	Name: "unrar",
+	Params: []cmdspec.Param{
+		{Name: "bucket", Type: cmdspec.PARAM_BASE64, Required: true},
+		{Name: "prefix", Type: cmdspec.PARAM_BASE64},
+		{Name: "overwrite", Type: cmdspec.PARAM_BOOL},
+		{Name: "password", Type: cmdspec.PARAM_BASE64},
+		{Name: "volumes", Type: cmdspec.PARAM_GROUP, Params: []cmdspec.Param{
+			{Name: "volume", Type: cmdspec.PARAM_BASE64},
+		}},
+	},
+}
+
+func (this *Unrarer) parse(cmd string) (options *UnrarOptions, err error) {
+	options = &UnrarOptions{}
+	err = unrarSpec.Parse(cmd, options)
+	return
+}
+
+func (this *Unrarer) DoContext(ctx context.Context, req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
+	//parse command
+	options, pErr := this.parse(req.Cmd)
+	if pErr != nil {
+		err = pErr
+		return
+	}
+
+	//check mimetype
+	if !rarMimeTypes[req.Src.MimeType] {
+		err = ufop.NewUfopError(ufop.E_SRC_UNSUPPORTED, "unsupported mimetype to unrar")
+		return
+	}
+	//check rar file length
+	if req.Src.Fsize > this.maxRarFileLength {
+		err = ufop.NewUfopError(ufop.E_SRC_TOO_LARGE, "src rar file length exceeds the limit").
+			WithDetail("limit", this.maxRarFileLength)
+		return
+	}
+
+	workDir, tmpErr := ioutil.TempDir("", "unrar_")
+	if tmpErr != nil {
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("create unrar temp dir failed, %s", tmpErr.Error()))
+		return
+	}
+	defer os.RemoveAll(workDir)
+
+	volumeDir := filepath.Join(workDir, "volumes")
+	if mkErr := os.Mkdir(volumeDir, 0700); mkErr != nil {
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("create unrar temp dir failed, %s", mkErr.Error()))
+		return
+	}
+
+	//download the volumes, the total length is limited
+	volumeUrls := []string{req.Src.Url}
+	for _, volume := range options.Volumes {
+		volumeUrls = append(volumeUrls, volume.Url)
+	}
+	var rarFilePath string
+	remain := int64(this.maxRarFileLength)
+	for index, volumeUrl := range volumeUrls {
+		volumePath := filepath.Join(volumeDir, volumeName(volumeUrl, index))
+		written, dErr := this.download(ctx, volumeUrl, volumePath, remain)
+		if dErr != nil {
+			err = dErr
+			return
+		}
+		remain -= written
+		if index == 0 {
+			rarFilePath = volumePath
+		}
+	}
+
+	if !isRarFile(rarFilePath) {
+		err = ufop.NewUfopError(ufop.E_SRC_UNSUPPORTED, "src is not a rar file")
+		return
+	}
+
+	//list the files and check the limits before extracting
+	listOutput, listErr := this.exec(ctx, "lt", options.Password, nil, rarFilePath)
+	if listErr != nil {
+		err = listErr
+		return
+	}
+	rarEntries := parseList(listOutput)
+
+	//check file count
+	if len(rarEntries) > this.maxFileCount {
+		err = ufop.NewUfopError(ufop.E_LIMIT_EXCEEDED, "rar files count exceeds the limit").
+			WithDetail("limit", this.maxFileCount)
+		return
+	}
+	//check file size
+	var declaredLength uint64
+	for _, rarEntry := range rarEntries {
+		if rarEntry.Size > this.maxFileLength {
+			err = ufop.NewUfopError(ufop.E_LIMIT_EXCEEDED, "rar file length exceeds the limit").
+				WithDetail("limit", this.maxFileLength)
+			return
+		}
+		declaredLength += rarEntry.Size
+	}
+	//the lengths in the headers are checked first, then the bytes extracted
+	guard := &rarGuard{
+		maxTotalLength:      this.maxTotalLength,
+		maxFileLength:       this.maxFileLength,
+		maxCompressionRatio: this.maxCompressionRatio,
+	}
+	if declaredLength > this.maxTotalLength {
+		err = guard.totalError()
+		return
+	}
+
+	//set up host
+	conf.UP_HOST = "http://up.qiniu.com"
+	rputSettings := rio.Settings{
+		ChunkSize: 4 * 1024 * 1024,
+		Workers:   1,
+	}
+	rio.SetSettings(&rputSettings)
+	policy := rs.PutPolicy{
+		Scope: options.Bucket,
+	}
+	//the files for the progress
+	fileCount := 0
+	for _, rarEntry := range rarEntries {
+		if !rarEntry.IsDir {
+			fileCount += 1
+		}
+	}
+	var unrarResult UnrarResult
+	unrarResult.Files = make([]UnrarFile, 0)
+	for _, rarEntry := range rarEntries {
+		//stop when the job is cancelled
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ufop.NewUfopError(ufop.E_CANCELLED, fmt.Sprintf("unrar cancelled, %s", ctxErr.Error()))
+			return
+		}
+
+		if rarEntry.IsDir {
+			continue
+		}
+
+		fileName := options.Prefix + rarEntry.Name
+		var unrarFile UnrarFile
+		unrarFile.Key = fileName
+		//the names are the masks of unrar, the wildcards and the list files can not
+		//be matched exactly
+		if strings.ContainsAny(rarEntry.Name, "*?") || strings.HasPrefix(rarEntry.Name, "@") {
+			unrarFile.Error = "unsupported rar file name"
+			unrarResult.Files = append(unrarResult.Files, unrarFile)
+			utils.ObserveProgress(ctx, len(unrarResult.Files), fileCount)
+			continue
+		}
+
+		filePath, xErr := this.extract(ctx, workDir, rarFilePath, options.Password, rarEntry, guard)
+		if xErr != nil {
+			err = xErr
+			return
+		}
+
+		//save file to bucket
+		if options.Overwrite {
+			policy.Scope = options.Bucket + ":" + fileName
+		}
+		uptoken := policy.Token(this.mac)
+		hash, saveErr := this.save(filePath, fileName, uptoken)
+		os.Remove(filePath)
+		if saveErr != nil {
+			unrarFile.Error = fmt.Sprintf("save unrar file to bucket error, %s", saveErr.Error())
+		} else {
+			unrarFile.Hash = hash
+		}
+		unrarResult.Files = append(unrarResult.Files, unrarFile)
+		utils.ObserveProgress(ctx, len(unrarResult.Files), fileCount)
+	}
+
+	//write result
+	result = unrarResult
+	resultType = ufop.RESULT_TYPE_JSON
+	contentType = ufop.CONTENT_TYPE_JSON
+
+	return
+}
+
+//the file name in the url, unrar finds the next volume by the name
+func volumeName(volumeUrl string, index int) (name string) {
+	if uri, pErr := url.Parse(volumeUrl); pErr == nil {
+		name = path.Base(uri.Path)
+	}
+	if name == "" || name == "/" || name == "." || name == ".." {
+		name = fmt.Sprintf("volume.part%d.rar", index+1)
+	}
+	return
+}
+
+//RAR 1.5 ~ 4.x and RAR 5.0 signatures
+func isRarFile(filePath string) bool {
+	fp, openErr := os.Open(filePath)
+	if openErr != nil {
+		return false
+	}
+	defer fp.Close()
+
+	header := make([]byte, 8)
+	n, _ := io.ReadFull(fp, header)
+	header = header[:n]
+	return bytes.HasPrefix(header, []byte("Rar!\x1a\x07\x00")) ||
+		bytes.HasPrefix(header, []byte("Rar!\x1a\x07\x01\x00"))
+}
+
+//download the volume, at most limit bytes are read
+func (this *Unrarer) download(ctx context.Context, volumeUrl, volumePath string, limit int64) (written int64, err error) {
+	resp, respErr := utils.HttpGet(ctx, volumeUrl)
+	if respErr != nil || resp.StatusCode != 200 {
+		if respErr != nil {
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("retrieve resource data failed, %s", respErr.Error()))
+		} else {
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("retrieve resource data failed, %s", resp.Status))
+			if resp.Body != nil {
+				resp.Body.Close()
+			}
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	volumeFp, openErr := os.Create(volumePath)
+	if openErr != nil {
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("create volume temp file failed, %s", openErr.Error()))
+		return
+	}
+	defer volumeFp.Close()
+
+	written, cpErr := io.Copy(volumeFp, io.LimitReader(resp.Body, limit+1))
+	if cpErr != nil {
+		err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("read resource data failed, %s", cpErr.Error()))
+		return
+	}
+	if written > limit {
+		err = ufop.NewUfopError(ufop.E_SRC_TOO_LARGE, "src rar file length exceeds the limit").
+			WithDetail("limit", this.maxRarFileLength)
+	}
+	return
+}
+
+//extract the entry to a temp file by `unrar p`, nothing is written to the path in
+//the archive, so the links can never point to the local files, the bytes are
+//counted by the guard while extracted
+func (this *Unrarer) extract(ctx context.Context, workDir, rarFilePath, password string, rarEntry rarEntry,
+	guard *rarGuard) (filePath string, err error) {
+	entryFp, tmpErr := ioutil.TempFile(workDir, "unrar_entry_")
+	if tmpErr != nil {
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("create entry temp file failed, %s", tmpErr.Error()))
+		return
+	}
+	defer entryFp.Close()
+
+	entryWriter := guard.writer(rarEntry, entryFp)
+	_, xErr := this.exec(ctx, "p", password, entryWriter, rarFilePath, rarEntry.Name)
+	if entryWriter.err != nil {
+		err = entryWriter.err
+	} else if xErr != nil {
+		err = xErr
+	} else if entryWriter.length != rarEntry.Size {
+		//the names matched more than one entry, or the header lies
+		err = ufop.NewUfopError(ufop.E_SRC_INVALID, "rar file length mismatches the header").
+			WithDetail("name", rarEntry.Name)
+	}
+	if err != nil {
+		os.Remove(entryFp.Name())
+		return
+	}
+	filePath = entryFp.Name()
+	return
+}
+
+//run unrar, the password is written to the prompt by the stdin, never in the args
+//which can be read by the other local users, unrar reads the prompt from the tty
+//if any, so it is started in a new session without the tty, the output of the
+//command is written to stdout if set, or else returned
+func (this *Unrarer) exec(ctx context.Context, command, password string, stdout io.Writer, args ...string) (output []byte, err error) {
+	//-p- never prompts
+	passwordArg := "-p-"
+	if password != "" {
+		passwordArg = "-p"
+	}
+	//-inul keeps the messages out of the printed file, -r- matches the names only
+	//at the path in the archive
+	cmdArgs := []string{command, "-y", "-o+", passwordArg}
+	if command == "p" {
+		cmdArgs = append(cmdArgs, "-inul", "-r-")
+	}
+	cmdArgs = append(append(cmdArgs, "--"), args...)
+	unrarCmd := exec.CommandContext(ctx, "unrar", cmdArgs...)
+	//list the utf8 names
+	unrarCmd.Env = append(os.Environ(), "LC_ALL=C.UTF-8")
+	unrarCmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if password != "" {
+		unrarCmd.Stdin = strings.NewReader(password + "\n")
+	}
+	stdErr := bytes.NewBuffer(nil)
+	unrarCmd.Stderr = stdErr
+
+	execStart := time.Now()
+	var execErr error
+	if stdout != nil {
+		unrarCmd.Stdout = stdout
+		execErr = unrarCmd.Run()
+	} else {
+		output, execErr = unrarCmd.Output()
+	}
+	utils.ObserveExec(ctx, "unrar", time.Since(execStart))
+	if execErr == nil {
+		return
+	}
+
+	stdErrStr := strings.TrimSpace(stdErr.String())
+	exitCode := -1
+	if exitErr, ok := execErr.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(interface {
+			ExitStatus() int
+		}); ok {
+			exitCode = status.ExitStatus()
+		}
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		err = ctx.Err()
+	case exitCode == UNRAR_EXIT_WRONG_PASSWORD,
+		strings.Contains(stdErrStr, "password is incorrect"),
+		strings.Contains(stdErrStr, "wrong password"):
+		err = ufop.NewUfopError(ufop.E_BAD_PARAM, "rar password is missing or incorrect").
+			WithDetail("param", "password")
+	case exitCode == UNRAR_EXIT_CRC_ERROR, exitCode == UNRAR_EXIT_OPEN_ERROR, exitCode > 0:
+		err = ufop.NewUfopError(ufop.E_SRC_INVALID, fmt.Sprintf("unrar %s failed, %s", command, execErr.Error())).
+			WithDetail("stderr", stdErrStr)
+	default:
+		err = ufop.NewUfopError(ufop.E_CONVERTER_FAILED, fmt.Sprintf("unrar %s failed, %s", command, execErr.Error())).
+			WithDetail("stderr", stdErrStr)
+	}
+	return
+}
+
+//the technical listing is blocks of "key: value" lines, one block for each file,
+//the links and the file references are skipped like the tar of unzip
+func parseList(output []byte) (rarEntries []rarEntry) {
+	rarEntries = make([]rarEntry, 0)
+	var entry *rarEntry
+	regular := true
+	appendEntry := func() {
+		if entry != nil && regular {
+			rarEntries = append(rarEntries, *entry)
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		items := strings.SplitN(line, ": ", 2)
+		if len(items) != 2 {
+			continue
+		}
+		key, value := items[0], items[1]
+		if key == "Name" {
+			appendEntry()
+			entry = &rarEntry{Name: filepath.ToSlash(value)}
+			regular = true
+			continue
+		}
+		if entry == nil {
+			continue
+		}
+		switch key {
+		case "Type":
+			//File, Directory, Unix symbolic link, Windows symbolic link, Junction,
+			//Hard link or File reference
+			entry.IsDir = value == "Directory"
+			regular = value == "File" || value == "Directory"
+		case "Size":
+			entry.Size, _ = strconv.ParseUint(value, 10, 64)
+		case "Packed size":
+			entry.PackedSize, _ = strconv.ParseUint(value, 10, 64)
+		case "Attributes":
+			//the unix mode, like lrwxrwxrwx
+			if len(value) == 10 && value[0] != '-' && value[0] != 'd' {
+				regular = false
+			}
+		}
+	}
+	appendEntry()
+	return
+}
+
+//guard against the rar bombs like the unzip, the lengths are counted on the
+//bytes actually extracted
+type rarGuard struct {
+	maxTotalLength      uint64
+	maxFileLength       uint64
+	maxCompressionRatio uint64
+	totalLength         uint64
+}
+
+func (this *rarGuard) writer(entry rarEntry, w io.Writer) *rarGuardWriter {
+	return &rarGuardWriter{
+		guard: this,
+		entry: entry,
+		w:     w,
+	}
+}
+
+func (this *rarGuard) totalError() error {
+	return ufop.NewUfopError(ufop.E_SRC_BOMB, "rar total uncompressed length exceeds the limit").
+		WithDetail("limit", this.maxTotalLength)
+}
+
+//the writer fails with the ufop error once a limit is exceeded, the error is kept
+//to tell it from the error of unrar killed by the broken pipe
+type rarGuardWriter struct {
+	guard  *rarGuard
+	entry  rarEntry
+	w      io.Writer
+	length uint64
+	err    error
+}
+
+func (this *rarGuardWriter) Write(p []byte) (n int, err error) {
+	if this.err != nil {
+		return 0, this.err
+	}
+	this.length += uint64(len(p))
+	this.guard.totalLength += uint64(len(p))
+
+	guard := this.guard
+	if this.length > guard.maxFileLength {
+		this.err = ufop.NewUfopError(ufop.E_SRC_BOMB, "rar file uncompressed length exceeds the limit").
+			WithDetail("limit", guard.maxFileLength).
+			WithDetail("name", this.entry.Name)
+	} else if guard.totalLength > guard.maxTotalLength {
+		this.err = guard.totalError()
+	} else if this.entry.PackedSize > 0 && this.length > UNRAR_RATIO_CHECK_LENGTH &&
+		this.length/this.entry.PackedSize > guard.maxCompressionRatio {
+		this.err = ufop.NewUfopError(ufop.E_SRC_BOMB, fmt.Sprintf("rar file compression ratio exceeds the limit %d", guard.maxCompressionRatio)).
+			WithDetail("limit", guard.maxCompressionRatio).
+			WithDetail("name", this.entry.Name)
+	}
+	if this.err != nil {
+		return 0, this.err
+	}
+	return this.w.Write(p)
+}
+
+func (this *Unrarer) save(filePath, key, uptoken string) (hash string, err error) {
+	fileInfo, statErr := os.Stat(filePath)
+	if statErr != nil {
+		err = statErr
+		return
+	}
+
+	if fileInfo.Size() <= UNRAR_RPUT_THRESHOLD {
+		var fputRet fio.PutRet
+		if err = fio.PutFile(nil, &fputRet, uptoken, key, filePath, nil); err != nil {
+			return
+		}
+		hash = fputRet.Hash
+		return
+	}
+
+	var rputRet rio.PutRet
+	if err = rio.PutFile(nil, &rputRet, uptoken, key, filePath, nil); err != nil {
+		return
+	}
+	hash = rputRet.Hash
+	return
+}
@@ -0,0 +1,527 @@
+package unzip
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"ufop"
+	"ufop/utils"
+)
+
+const (
+	ARCHIVE_ZIP     = "zip"
+	ARCHIVE_TAR     = "tar"
+	ARCHIVE_TAR_GZ  = "tar.gz"
+	ARCHIVE_TAR_BZ2 = "tar.bz2"
+	ARCHIVE_TAR_XZ  = "tar.xz"
+	ARCHIVE_7Z      = "7z"
+)
+
+//the mimetypes allowed to unzip, the archive type is decided by the magic bytes,
+//the mimetype is used only when the magic bytes tell nothing, like the old tar
+var archiveMimeTypes = map[string]string{
+	"application/zip":              ARCHIVE_ZIP,
+	"application/x-zip-compressed": ARCHIVE_ZIP,
+	"application/x-tar":            ARCHIVE_TAR,
+	"application/gzip":             ARCHIVE_TAR_GZ,
+	"application/x-gzip":           ARCHIVE_TAR_GZ,
+	"application/x-compressed-tar": ARCHIVE_TAR_GZ,
+	"application/x-bzip2":          ARCHIVE_TAR_BZ2,
+	"application/x-bzip":           ARCHIVE_TAR_BZ2,
+	"application/x-xz":             ARCHIVE_TAR_XZ,
+	"application/x-7z-compressed":  ARCHIVE_7Z,
+	"application/octet-stream":     "",
+}
+
+//the entry header of the archive
+type archiveEntry struct {
+	Name           string
+	IsDir          bool
+	Size           uint64
+	CompressedSize uint64
+	ModTime        time.Time
+	CRC32          uint32
+	//the name is utf8, like the zip entry with the flag bit 11 set
+	UTF8 bool
+}
+
+type archiveReader interface {
+	//all the entries, read before extracting to check the limits
+	Entries() []archiveEntry
+	//extract the entries in order, the reader is valid until fn returns,
+	//walking stops when fn returns error
+	Walk(ctx context.Context, fn func(entry archiveEntry, reader io.Reader) error) error
+	Close()
+}
+
+func detectArchiveType(archiveFp *os.File, mimeType string) (archiveType string, err error) {
+	header := make([]byte, 512)
+	n, readErr := archiveFp.ReadAt(header, 0)
+	if readErr != nil && readErr != io.EOF {
+		err = errors.New(fmt.Sprintf("read archive header failed, %s", readErr.Error()))
+		return
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")), bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		archiveType = ARCHIVE_ZIP
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		archiveType = ARCHIVE_TAR_GZ
+	case bytes.HasPrefix(header, []byte("BZh")):
+		archiveType = ARCHIVE_TAR_BZ2
+	case bytes.HasPrefix(header, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		archiveType = ARCHIVE_TAR_XZ
+	case bytes.HasPrefix(header, []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}):
+		archiveType = ARCHIVE_7Z
+	case len(header) >= 262 && bytes.Equal(header[257:262], []byte("ustar")):
+		archiveType = ARCHIVE_TAR
+	case archiveMimeTypes[mimeType] == ARCHIVE_TAR:
+		//the v7 tar has no magic
+		archiveType = ARCHIVE_TAR
+	default:
+		err = errors.New("unknown archive format")
+	}
+	return
+}
+
+func openArchive(ctx context.Context, archiveType string, archiveFp *os.File, archiveSize int64,
+	guard *bombGuard) (reader archiveReader, err error) {
+	switch archiveType {
+	case ARCHIVE_ZIP:
+		reader, err = openZipArchive(archiveFp, archiveSize)
+	case ARCHIVE_TAR, ARCHIVE_TAR_GZ, ARCHIVE_TAR_BZ2, ARCHIVE_TAR_XZ:
+		reader, err = openTarArchive(ctx, archiveType, archiveFp, archiveSize, guard)
+	case ARCHIVE_7Z:
+		reader, err = open7zArchive(ctx, archiveFp)
+	default:
+		err = errors.New(fmt.Sprintf("unsupported archive type '%s'", archiveType))
+	}
+	return
+}
+
+type zipArchive struct {
+	zipReader *zip.Reader
+	entries   []archiveEntry
+}
+
+func openZipArchive(archiveFp *os.File, archiveSize int64) (reader archiveReader, err error) {
+	zipReader, zipErr := zip.NewReader(archiveFp, archiveSize)
+	if zipErr != nil {
+		err = errors.New(fmt.Sprintf("invalid zip file, %s", zipErr.Error()))
+		return
+	}
+
+	archive := zipArchive{
+		zipReader: zipReader,
+		entries:   make([]archiveEntry, 0, len(zipReader.File)),
+	}
+	for _, zipFile := range zipReader.File {
+		archive.entries = append(archive.entries, archiveEntry{
+			Name:           zipFile.Name,
+			IsDir:          zipFile.FileInfo().IsDir(),
+			Size:           zipFile.UncompressedSize64,
+			CompressedSize: zipFile.CompressedSize64,
+			ModTime:        zipFile.ModTime(),
+			CRC32:          zipFile.CRC32,
+			UTF8:           zipFile.Flags&0x800 != 0,
+		})
+	}
+	reader = &archive
+	return
+}
+
+func (this *zipArchive) Entries() []archiveEntry {
+	return this.entries
+}
+
+func (this *zipArchive) Walk(ctx context.Context, fn func(entry archiveEntry, reader io.Reader) error) (err error) {
+	for index, zipFile := range this.zipReader.File {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if err = this.walkFile(zipFile, this.entries[index], fn); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (this *zipArchive) walkFile(zipFile *zip.File, entry archiveEntry, fn func(entry archiveEntry, reader io.Reader) error) (err error) {
+	if entry.IsDir {
+		return fn(entry, bytes.NewReader(nil))
+	}
+
+	zipFileReader, zipErr := zipFile.Open()
+	if zipErr != nil {
+		err = errors.New(fmt.Sprintf("open zip file content failed, %s", zipErr.Error()))
+		return
+	}
+	defer zipFileReader.Close()
+	return fn(entry, zipFileReader)
+}
+
+func (this *zipArchive) Close() {
+}
+
+//the tar is read as a stream, so the entries are listed by reading it once
+//before the extracting, the decompressed stream is limited by the guard
+type tarArchive struct {
+	archiveType string
+	archiveFp   *os.File
+	archiveSize int64
+	entries     []archiveEntry
+	guard       *bombGuard
+}
+
+func openTarArchive(ctx context.Context, archiveType string, archiveFp *os.File, archiveSize int64,
+	guard *bombGuard) (reader archiveReader, err error) {
+	archive := tarArchive{
+		archiveType: archiveType,
+		archiveFp:   archiveFp,
+		archiveSize: archiveSize,
+		entries:     make([]archiveEntry, 0),
+		guard:       guard,
+	}
+
+	//stop as soon as the lengths in the headers exceed the limit
+	var declaredLength uint64
+	err = archive.walk(ctx, func(entry archiveEntry, reader io.Reader) error {
+		declaredLength += entry.Size
+		if declaredLength > guard.maxTotalLength {
+			return guard.totalError()
+		}
+		archive.entries = append(archive.entries, entry)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	reader = &archive
+	return
+}
+
+func (this *tarArchive) Entries() []archiveEntry {
+	return this.entries
+}
+
+func (this *tarArchive) Walk(ctx context.Context, fn func(entry archiveEntry, reader io.Reader) error) error {
+	return this.walk(ctx, fn)
+}
+
+func (this *tarArchive) walk(ctx context.Context, fn func(entry archiveEntry, reader io.Reader) error) (err error) {
+	stream, streamErr := this.decompress(ctx)
+	if streamErr != nil {
+		err = streamErr
+		return
+	}
+	defer stream.Close()
+
+	//the data of the entries is read by Next too when they are skipped
+	guardStream := this.guard.streamReader(stream)
+	tarReader := tar.NewReader(guardStream)
+	for {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		header, nextErr := tarReader.Next()
+		if nextErr == io.EOF {
+			break
+		}
+		if nextErr != nil {
+			if _, ok := nextErr.(*ufop.UfopError); ok {
+				err = nextErr
+			} else {
+				err = errors.New(fmt.Sprintf("invalid %s file, %s", this.archiveType, nextErr.Error()))
+			}
+			return
+		}
+		guardStream.allowHeader()
+
+		//links and devices are skipped
+		var isDir bool
+		switch header.Typeflag {
+		case tar.TypeDir:
+			isDir = true
+		case tar.TypeReg, tar.TypeRegA:
+		default:
+			continue
+		}
+
+		//tar made in the dir like `tar cf a.tar .` names the entries ./<name>
+		name := strings.TrimPrefix(header.Name, "./")
+		if name == "" {
+			continue
+		}
+
+		entry := archiveEntry{
+			Name:    name,
+			IsDir:   isDir,
+			Size:    uint64(header.Size),
+			ModTime: header.ModTime,
+		}
+		if this.archiveType == ARCHIVE_TAR {
+			entry.CompressedSize = entry.Size
+		}
+		if err = fn(entry, tarReader); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (this *tarArchive) Close() {
+}
+
+//the decompressed tar stream of the archive file
+func (this *tarArchive) decompress(ctx context.Context) (stream io.ReadCloser, err error) {
+	fileReader := io.NewSectionReader(this.archiveFp, 0, this.archiveSize)
+	switch this.archiveType {
+	case ARCHIVE_TAR:
+		stream = ioutil.NopCloser(fileReader)
+	case ARCHIVE_TAR_GZ:
+		gzReader, gzErr := gzip.NewReader(fileReader)
+		if gzErr != nil {
+			err = errors.New(fmt.Sprintf("invalid tar.gz file, %s", gzErr.Error()))
+			return
+		}
+		stream = gzReader
+	case ARCHIVE_TAR_BZ2:
+		stream = ioutil.NopCloser(bzip2.NewReader(fileReader))
+	case ARCHIVE_TAR_XZ:
+		stream, err = newXzReader(ctx, fileReader)
+	}
+	return
+}
+
+//no xz in the standard library, decompress it by the xz command
+func newXzReader(ctx context.Context, input io.Reader) (reader io.ReadCloser, err error) {
+	return newCommandReader(ctx, input, "xz", "-dc")
+}
+
+//the stdout of the command, the command is waited by Close, and killed if the
+//output is not read to the end
+type commandReader struct {
+	io.ReadCloser
+	name      string
+	cmd       *exec.Cmd
+	cancel    context.CancelFunc
+	stdErr    *bytes.Buffer
+	execStart time.Time
+	ctx       context.Context
+}
+
+func newCommandReader(ctx context.Context, input io.Reader, name string, args ...string) (reader io.ReadCloser, err error) {
+	cmdCtx, cancel := context.WithCancel(ctx)
+	cmd := exec.CommandContext(cmdCtx, name, args...)
+	cmd.Stdin = input
+	stdErr := bytes.NewBuffer(nil)
+	cmd.Stderr = stdErr
+	stdOutPipe, pipeErr := cmd.StdoutPipe()
+	if pipeErr != nil {
+		cancel()
+		err = errors.New(fmt.Sprintf("open %s stdout pipe error, %s", name, pipeErr.Error()))
+		return
+	}
+	execStart := time.Now()
+	if startErr := cmd.Start(); startErr != nil {
+		cancel()
+		err = errors.New(fmt.Sprintf("start %s command error, %s", name, startErr.Error()))
+		return
+	}
+	reader = &commandReader{
+		ReadCloser: stdOutPipe,
+		name:       name,
+		cmd:        cmd,
+		cancel:     cancel,
+		stdErr:     stdErr,
+		execStart:  execStart,
+		ctx:        ctx,
+	}
+	return
+}
+
+//the error of the command is returned only when the output is read to the end
+func (this *commandReader) Close() (err error) {
+	_, readErr := this.ReadCloser.Read(make([]byte, 1))
+	if readErr != io.EOF {
+		this.cancel()
+	}
+	this.ReadCloser.Close()
+	waitErr := this.cmd.Wait()
+	this.cancel()
+	utils.ObserveExec(this.ctx, this.name, time.Since(this.execStart))
+	if waitErr != nil && readErr == io.EOF {
+		err = errors.New(fmt.Sprintf("%s failed, %s, %s", this.name, waitErr.Error(), strings.TrimSpace(this.stdErr.String())))
+	}
+	return
+}
+
+//no 7z in the standard library, list and extract it by the 7z command, each
+//entry is extracted to the stdout and read by the walk func, nothing is written
+//to the disk, so the links in the archive can never point to the local files
+type sevenZipArchive struct {
+	archiveFp *os.File
+	entries   []archiveEntry
+}
+
+func open7zArchive(ctx context.Context, archiveFp *os.File) (reader archiveReader, err error) {
+	output, execErr := run7z(ctx, "l", "-slt", archiveFp.Name())
+	if execErr != nil {
+		err = execErr
+		return
+	}
+
+	archive := sevenZipArchive{
+		archiveFp: archiveFp,
+		entries:   parse7zList(output),
+	}
+	reader = &archive
+	return
+}
+
+//the technical listing is blocks of "key = value" lines, the entries start after
+//the line of dashes, the first block is the archive itself, the links and the
+//devices are skipped like tar
+func parse7zList(output []byte) (entries []archiveEntry) {
+	entries = make([]archiveEntry, 0)
+	var entry *archiveEntry
+	inEntries := false
+	regular := true
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "----------") {
+			inEntries = true
+			continue
+		}
+		if !inEntries {
+			continue
+		}
+		if line == "" {
+			if entry != nil && regular {
+				entries = append(entries, *entry)
+			}
+			entry = nil
+			continue
+		}
+
+		//the empty value is trimmed, like "Symbolic Link ="
+		items := strings.SplitN(line+" ", " = ", 2)
+		if len(items) != 2 {
+			continue
+		}
+		key, value := items[0], strings.TrimSpace(items[1])
+		if key == "Path" {
+			//7z keeps the names in unicode
+			entry = &archiveEntry{Name: filepath.ToSlash(value), UTF8: true}
+			regular = true
+			continue
+		}
+		if entry == nil {
+			continue
+		}
+		switch key {
+		case "Folder":
+			entry.IsDir = value == "+"
+		case "Size":
+			entry.Size, _ = strconv.ParseUint(value, 10, 64)
+		case "Packed Size":
+			entry.CompressedSize, _ = strconv.ParseUint(value, 10, 64)
+		case "Modified":
+			entry.ModTime, _ = time.Parse("2006-01-02 15:04:05", strings.SplitN(value, ".", 2)[0])
+		case "CRC":
+			crc, _ := strconv.ParseUint(value, 16, 32)
+			entry.CRC32 = uint32(crc)
+		case "Attributes":
+			//the unix mode follows the windows attributes, like "A_ lrwxrwxrwx"
+			fields := strings.Fields(value)
+			if len(fields) > 1 && len(fields[len(fields)-1]) == 10 {
+				mode := fields[len(fields)-1]
+				regular = mode[0] == '-' || mode[0] == 'd'
+			}
+		case "Symbolic Link", "Hard Link":
+			if value != "" {
+				regular = false
+			}
+		}
+	}
+	if entry != nil && regular {
+		entries = append(entries, *entry)
+	}
+	return
+}
+
+func (this *sevenZipArchive) Entries() []archiveEntry {
+	return this.entries
+}
+
+func (this *sevenZipArchive) Walk(ctx context.Context, fn func(entry archiveEntry, reader io.Reader) error) (err error) {
+	for _, entry := range this.entries {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if err = this.walkFile(ctx, entry, fn); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (this *sevenZipArchive) walkFile(ctx context.Context, entry archiveEntry, fn func(entry archiveEntry, reader io.Reader) error) (err error) {
+	if entry.IsDir {
+		return fn(entry, bytes.NewReader(nil))
+	}
+
+	//the empty password never prompts, -spd matches the name without the wildcards,
+	//-r- matches it only at the path in the archive
+	fileReader, readErr := newCommandReader(ctx, nil, "7z", "x", "-so", "-p", "-spd", "-r-", "--",
+		this.archiveFp.Name(), entry.Name)
+	if readErr != nil {
+		err = readErr
+		return
+	}
+	if err = fn(entry, fileReader); err != nil {
+		fileReader.Close()
+		return
+	}
+	if cErr := fileReader.Close(); cErr != nil {
+		err = errors.New(fmt.Sprintf("read 7z file content failed, %s", cErr.Error()))
+	}
+	return
+}
+
+func (this *sevenZipArchive) Close() {
+}
+
+func run7z(ctx context.Context, args ...string) (output []byte, err error) {
+	//empty password, never prompt for the encrypted archives
+	cmdArgs := append([]string{args[0], "-p"}, args[1:]...)
+	sevenZipCmd := exec.CommandContext(ctx, "7z", cmdArgs...)
+	stdErr := bytes.NewBuffer(nil)
+	sevenZipCmd.Stderr = stdErr
+
+	execStart := time.Now()
+	output, execErr := sevenZipCmd.Output()
+	utils.ObserveExec(ctx, "7z", time.Since(execStart))
+	if execErr != nil {
+		err = errors.New(fmt.Sprintf("7z %s failed, %s, %s", args[0], execErr.Error(), strings.TrimSpace(stdErr.String())))
+	}
+	return
+}
@@ -0,0 +1,119 @@
+package unzip
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"ufop"
+)
+
+//the reasons of the skipped entries
+const (
+	SKIP_NOT_INCLUDED = "not_included"
+	SKIP_EXCLUDED     = "excluded"
+	SKIP_HIDDEN       = "hidden"
+	//the key is taken by an earlier entry, like the same names in different
+	//directories with flatten
+	SKIP_DUPLICATE = "duplicate"
+)
+
+//the metadata files made by the os, besides the hidden files starting with "."
+var osMetaNames = map[string]bool{
+	"__MACOSX":    true,
+	"Thumbs.db":   true,
+	"desktop.ini": true,
+}
+
+//select the entries to extract by the globs, the glob without "/" matches the
+//base name, the glob ending with "/" matches the directories, other globs match
+//the whole name, like *.jpg, __MACOSX/ or photos/*.png
+type entryFilter struct {
+	includes   []string
+	excludes   []string
+	skipHidden bool
+}
+
+func newEntryFilter(options *UnzipOptions) (filter *entryFilter, err error) {
+	filter = &entryFilter{
+		skipHidden: options.SkipHidden,
+	}
+	if filter.includes, err = parseGlobs("include", options.Include); err != nil {
+		return
+	}
+	filter.excludes, err = parseGlobs("exclude", options.Exclude)
+	return
+}
+
+//the globs are separated by ","
+func parseGlobs(param, globList string) (globs []string, err error) {
+	globs = make([]string, 0)
+	for _, glob := range strings.Split(globList, ",") {
+		glob = strings.TrimSpace(glob)
+		if glob == "" {
+			continue
+		}
+		if _, mErr := path.Match(strings.TrimSuffix(glob, "/"), ""); mErr != nil {
+			err = ufop.NewUfopError(ufop.E_BAD_PARAM, fmt.Sprintf("invalid unzip parameter '%s', bad glob '%s'", param, glob)).
+				WithDetail("param", param).
+				WithDetail("reason", "bad glob")
+			return
+		}
+		globs = append(globs, glob)
+	}
+	return
+}
+
+//the reason to skip the entry, empty if the entry is extracted
+func (this *entryFilter) skip(name string) (reason string) {
+	segments := strings.Split(strings.Trim(name, "/"), "/")
+
+	if this.skipHidden {
+		for _, segment := range segments {
+			if strings.HasPrefix(segment, ".") || osMetaNames[segment] {
+				return SKIP_HIDDEN
+			}
+		}
+	}
+
+	for _, glob := range this.excludes {
+		if matchGlob(glob, segments) {
+			return SKIP_EXCLUDED
+		}
+	}
+
+	if len(this.includes) == 0 {
+		return
+	}
+	for _, glob := range this.includes {
+		if matchGlob(glob, segments) {
+			return
+		}
+	}
+	return SKIP_NOT_INCLUDED
+}
+
+func matchGlob(glob string, segments []string) bool {
+	//match the parent directories
+	if strings.HasSuffix(glob, "/") {
+		glob = strings.TrimSuffix(glob, "/")
+		for index := 0; index < len(segments)-1; index++ {
+			dir := segments[index]
+			if strings.Contains(glob, "/") {
+				dir = strings.Join(segments[:index+1], "/")
+			}
+			if matched, _ := path.Match(glob, dir); matched {
+				return true
+			}
+		}
+		return false
+	}
+
+	//match the base name
+	if !strings.Contains(glob, "/") {
+		matched, _ := path.Match(glob, segments[len(segments)-1])
+		return matched
+	}
+
+	matched, _ := path.Match(glob, strings.Join(segments, "/"))
+	return matched
+}
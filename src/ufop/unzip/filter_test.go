@@ -0,0 +1,90 @@
+package unzip
+
+import (
+	"testing"
+	"ufop"
+)
+
+func TestEntryFilter(t *testing.T) {
+	tests := []struct {
+		options UnzipOptions
+		name    string
+		//empty when the entry is extracted
+		reason string
+	}{
+		{UnzipOptions{}, "a/b.jpg", ""},
+		{UnzipOptions{}, ".DS_Store", ""},
+
+		//the glob without "/" matches the base name
+		{UnzipOptions{Include: "*.jpg"}, "a.jpg", ""},
+		{UnzipOptions{Include: "*.jpg"}, "a/b/c.jpg", ""},
+		{UnzipOptions{Include: "*.jpg"}, "a/b/c.png", SKIP_NOT_INCLUDED},
+		{UnzipOptions{Include: "*.jpg"}, "a.jpg/b.png", SKIP_NOT_INCLUDED},
+		{UnzipOptions{Include: "*.jpg, *.png"}, "a/b.png", ""},
+		{UnzipOptions{Exclude: "*.jpg"}, "a/b.jpg", SKIP_EXCLUDED},
+		{UnzipOptions{Exclude: "*.jpg"}, "a/b.png", ""},
+
+		//the glob ending with "/" matches the directories
+		{UnzipOptions{Exclude: "__MACOSX/"}, "__MACOSX/a.jpg", SKIP_EXCLUDED},
+		{UnzipOptions{Exclude: "__MACOSX/"}, "a/__MACOSX/._b.jpg", SKIP_EXCLUDED},
+		{UnzipOptions{Exclude: "__MACOSX/"}, "a/__MACOSX.jpg", ""},
+		{UnzipOptions{Include: "photos/"}, "photos/2015/a.jpg", ""},
+		{UnzipOptions{Include: "photos/"}, "docs/photos", SKIP_NOT_INCLUDED},
+		{UnzipOptions{Include: "a/photos/"}, "a/photos/b.jpg", ""},
+		{UnzipOptions{Include: "a/photos/"}, "b/a/photos/b.jpg", SKIP_NOT_INCLUDED},
+
+		//other globs match the whole name
+		{UnzipOptions{Include: "photos/*.png"}, "photos/a.png", ""},
+		{UnzipOptions{Include: "photos/*.png"}, "/photos/a.png", ""},
+		{UnzipOptions{Include: "photos/*.png"}, "photos/2015/a.png", SKIP_NOT_INCLUDED},
+		{UnzipOptions{Include: "photos/*.png"}, "a/photos/a.png", SKIP_NOT_INCLUDED},
+		{UnzipOptions{Include: "photos/*.png"}, "photos/a.jpg", SKIP_NOT_INCLUDED},
+
+		//the exclude wins over the include
+		{UnzipOptions{Include: "*.jpg", Exclude: "__MACOSX/"}, "__MACOSX/a.jpg", SKIP_EXCLUDED},
+		{UnzipOptions{Include: "photos/", Exclude: "*.tmp"}, "photos/a.tmp", SKIP_EXCLUDED},
+
+		//the hidden files and the os metadata in any directory
+		{UnzipOptions{SkipHidden: true}, ".DS_Store", SKIP_HIDDEN},
+		{UnzipOptions{SkipHidden: true}, "a/.DS_Store", SKIP_HIDDEN},
+		{UnzipOptions{SkipHidden: true}, ".git/config", SKIP_HIDDEN},
+		{UnzipOptions{SkipHidden: true}, "__MACOSX/a/._b.jpg", SKIP_HIDDEN},
+		{UnzipOptions{SkipHidden: true}, "a/Thumbs.db", SKIP_HIDDEN},
+		{UnzipOptions{SkipHidden: true}, "desktop.ini", SKIP_HIDDEN},
+		{UnzipOptions{SkipHidden: true}, "a/b.c.jpg", ""},
+		{UnzipOptions{SkipHidden: true}, "thumbs.db", ""},
+		{UnzipOptions{SkipHidden: true, Include: "*.jpg"}, "a/.b.jpg", SKIP_HIDDEN},
+		{UnzipOptions{SkipHidden: true, Exclude: "*.jpg"}, "a/b.png", ""},
+	}
+	for _, test := range tests {
+		filter, err := newEntryFilter(&test.options)
+		if err != nil {
+			t.Errorf("newEntryFilter(%+v) error, %s", test.options, err)
+			continue
+		}
+		if reason := filter.skip(test.name); reason != test.reason {
+			t.Errorf("skip(%q) with %+v = %q, want %q", test.name, test.options, reason, test.reason)
+		}
+	}
+}
+
+func TestEntryFilterBadGlob(t *testing.T) {
+	tests := []struct {
+		options UnzipOptions
+		param   string
+	}{
+		{UnzipOptions{Include: "*.jpg,[a-"}, "include"},
+		{UnzipOptions{Exclude: "photos/[/"}, "exclude"},
+	}
+	for _, test := range tests {
+		_, err := newEntryFilter(&test.options)
+		ufopErr, ok := err.(*ufop.UfopError)
+		if !ok {
+			t.Errorf("newEntryFilter(%+v) error = %v, want E_BAD_PARAM", test.options, err)
+			continue
+		}
+		if param, _ := ufopErr.Details["param"].(string); ufopErr.Code != ufop.E_BAD_PARAM || param != test.param {
+			t.Errorf("newEntryFilter(%+v) error = %s %q, want E_BAD_PARAM of '%s'", test.options, ufopErr.Code, ufopErr.Message, test.param)
+		}
+	}
+}
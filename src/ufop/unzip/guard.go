@@ -0,0 +1,158 @@
+package unzip
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"ufop"
+)
+
+const (
+	UNZIP_MAX_TOTAL_LENGTH      uint64 = 1 * 1024 * 1024 * 1024 //1GB
+	UNZIP_MAX_COMPRESSION_RATIO uint64 = 100
+	UNZIP_MAX_NESTING_DEPTH     int    = 32
+	//the compression ratio is not checked before so many bytes are read,
+	//the small files of zeros are highly compressed too
+	UNZIP_RATIO_CHECK_LENGTH uint64 = 1 * 1024 * 1024 //1MB
+	//the bytes of the tar stream besides the file data, the end blocks and the
+	//padding of the record, and each entry for its header, padding and long name
+	UNZIP_TAR_END_LENGTH    uint64 = 10240
+	UNZIP_TAR_HEADER_LENGTH uint64 = 2048
+)
+
+//guard against the zip bombs, the lengths are counted on the bytes actually read,
+//the lengths in the entry headers can lie
+type bombGuard struct {
+	maxTotalLength      uint64
+	maxFileLength       uint64
+	maxCompressionRatio uint64
+	//the compressed archive length, for the archives whose entries have no compressed size
+	archiveLength uint64
+	totalLength   uint64
+}
+
+//check the headers before extracting, the archive is refused early when the
+//declared lengths or the depth of the names exceed the limits
+func (this *bombGuard) checkEntries(entries []archiveEntry, maxNestingDepth int) (err error) {
+	var declaredLength uint64
+	for _, entry := range entries {
+		declaredLength += entry.Size
+		if depth := len(strings.Split(strings.Trim(entry.Name, "/"), "/")); depth > maxNestingDepth {
+			err = ufop.NewUfopError(ufop.E_SRC_BOMB, "zip file nesting depth exceeds the limit").
+				WithDetail("limit", maxNestingDepth).
+				WithDetail("name", entry.Name)
+			return
+		}
+	}
+	if declaredLength > this.maxTotalLength {
+		err = this.totalError()
+	}
+	return
+}
+
+//wrap the entry reader to count the bytes read, the reader fails with the
+//ufop error once a limit is exceeded
+func (this *bombGuard) reader(entry archiveEntry, reader io.Reader) io.Reader {
+	return &bombGuardReader{
+		guard:  this,
+		entry:  entry,
+		reader: reader,
+	}
+}
+
+//wrap the decompressed stream of the tar, which is read whole when the entries are
+//listed and before the entries are checked, the stream can not be longer than the
+//total limit, or the archive length by the ratio limit, besides the headers
+func (this *bombGuard) streamReader(reader io.Reader) *bombStreamReader {
+	streamReader := &bombStreamReader{
+		guard:  this,
+		reader: reader,
+		limit:  this.maxTotalLength,
+	}
+	if ratioLimit := this.archiveLength * this.maxCompressionRatio; this.archiveLength > 0 && ratioLimit < streamReader.limit {
+		streamReader.limit = ratioLimit
+		if streamReader.limit < UNZIP_RATIO_CHECK_LENGTH {
+			streamReader.limit = UNZIP_RATIO_CHECK_LENGTH
+		}
+		streamReader.byRatio = true
+	}
+	streamReader.limit += UNZIP_TAR_END_LENGTH + UNZIP_TAR_HEADER_LENGTH
+	return streamReader
+}
+
+func (this *bombGuard) totalError() error {
+	return ufop.NewUfopError(ufop.E_SRC_BOMB, "zip total uncompressed length exceeds the limit").
+		WithDetail("limit", this.maxTotalLength)
+}
+
+type bombGuardReader struct {
+	guard  *bombGuard
+	entry  archiveEntry
+	reader io.Reader
+	length uint64
+}
+
+func (this *bombGuardReader) Read(p []byte) (n int, err error) {
+	n, err = this.reader.Read(p)
+	this.length += uint64(n)
+	this.guard.totalLength += uint64(n)
+
+	guard := this.guard
+	if this.length > guard.maxFileLength {
+		err = ufop.NewUfopError(ufop.E_SRC_BOMB, "zip file uncompressed length exceeds the limit").
+			WithDetail("limit", guard.maxFileLength).
+			WithDetail("name", this.entry.Name)
+		return
+	}
+
+	if guard.totalLength > guard.maxTotalLength {
+		err = guard.totalError()
+		return
+	}
+
+	//the entry is checked by its own compressed size if known,
+	//or else the whole archive is checked, like the tar.gz
+	if this.entry.CompressedSize > 0 {
+		if this.length > UNZIP_RATIO_CHECK_LENGTH && this.length/this.entry.CompressedSize > guard.maxCompressionRatio {
+			err = this.ratioError()
+		}
+	} else if guard.archiveLength > 0 {
+		if guard.totalLength > UNZIP_RATIO_CHECK_LENGTH && guard.totalLength/guard.archiveLength > guard.maxCompressionRatio {
+			err = this.ratioError()
+		}
+	}
+	return
+}
+
+type bombStreamReader struct {
+	guard   *bombGuard
+	reader  io.Reader
+	length  uint64
+	limit   uint64
+	byRatio bool
+}
+
+//the next header is allowed after one is read
+func (this *bombStreamReader) allowHeader() {
+	this.limit += UNZIP_TAR_HEADER_LENGTH
+}
+
+func (this *bombStreamReader) Read(p []byte) (n int, err error) {
+	n, err = this.reader.Read(p)
+	this.length += uint64(n)
+	if this.length > this.limit {
+		if this.byRatio {
+			err = ufop.NewUfopError(ufop.E_SRC_BOMB, fmt.Sprintf("zip file compression ratio exceeds the limit %d", this.guard.maxCompressionRatio)).
+				WithDetail("limit", this.guard.maxCompressionRatio)
+		} else {
+			err = this.guard.totalError()
+		}
+	}
+	return
+}
+
+func (this *bombGuardReader) ratioError() error {
+	return ufop.NewUfopError(ufop.E_SRC_BOMB, fmt.Sprintf("zip file compression ratio exceeds the limit %d", this.guard.maxCompressionRatio)).
+		WithDetail("limit", this.guard.maxCompressionRatio).
+		WithDetail("name", this.entry.Name)
+}
@@ -0,0 +1,190 @@
+package unzip
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"ufop"
+)
+
+const testMB uint64 = 1024 * 1024
+
+func testGuard() *bombGuard {
+	return &bombGuard{
+		maxTotalLength:      8 * testMB,
+		maxFileLength:       4 * testMB,
+		maxCompressionRatio: 100,
+	}
+}
+
+//the zeros read by the entry whose header lies
+type zeroReader struct{}
+
+func (this zeroReader) Read(p []byte) (n int, err error) {
+	for index := range p {
+		p[index] = 0
+	}
+	return len(p), nil
+}
+
+//read the entry through the guard, the error is nil when it is read to the end
+func readGuarded(guard *bombGuard, entry archiveEntry, length uint64) error {
+	reader := guard.reader(entry, io.LimitReader(zeroReader{}, int64(length)))
+	_, err := io.Copy(ioutil.Discard, reader)
+	return err
+}
+
+func checkBombError(t *testing.T, name string, err error, message string) {
+	ufopErr, ok := err.(*ufop.UfopError)
+	if !ok {
+		t.Errorf("%s: error = %v, want E_SRC_BOMB", name, err)
+		return
+	}
+	if ufopErr.Code != ufop.E_SRC_BOMB || !strings.HasPrefix(ufopErr.Message, message) {
+		t.Errorf("%s: error = %s %q, want E_SRC_BOMB %q", name, ufopErr.Code, ufopErr.Message, message)
+	}
+}
+
+//the headers understate the lengths, the limits fire on the bytes actually read
+func TestBombGuardReader(t *testing.T) {
+	tests := []struct {
+		name          string
+		archiveLength uint64
+		entries       []archiveEntry
+		//the bytes really read of each entry
+		lengths []uint64
+		//empty when all the entries are read
+		message string
+	}{
+		{"fits", 0,
+			[]archiveEntry{{Name: "a", Size: 3 * testMB, CompressedSize: testMB}},
+			[]uint64{3 * testMB}, ""},
+		{"file length", 0,
+			[]archiveEntry{{Name: "a", Size: 1, CompressedSize: testMB}},
+			[]uint64{5 * testMB}, "zip file uncompressed length exceeds the limit"},
+		{"total length", 0,
+			[]archiveEntry{
+				{Name: "a", Size: 1, CompressedSize: testMB},
+				{Name: "b", Size: 1, CompressedSize: testMB},
+				{Name: "c", Size: 1, CompressedSize: testMB},
+			},
+			[]uint64{3 * testMB, 3 * testMB, 3 * testMB}, "zip total uncompressed length exceeds the limit"},
+		{"entry ratio", 0,
+			[]archiveEntry{{Name: "a", Size: 1, CompressedSize: 10 * 1024}},
+			[]uint64{2 * testMB}, "zip file compression ratio exceeds the limit"},
+		//the small files are not checked by the ratio
+		{"entry ratio under the check length", 0,
+			[]archiveEntry{{Name: "a", Size: 1, CompressedSize: 1}},
+			[]uint64{testMB}, ""},
+		//no compressed size of the tar.gz entries, the whole archive is checked
+		{"archive ratio", 20 * 1024,
+			[]archiveEntry{
+				{Name: "a", Size: 1},
+				{Name: "b", Size: 1},
+			},
+			[]uint64{testMB, 2 * testMB}, "zip file compression ratio exceeds the limit"},
+		{"archive ratio fits", 40 * 1024,
+			[]archiveEntry{
+				{Name: "a", Size: 1},
+				{Name: "b", Size: 1},
+			},
+			[]uint64{testMB, 2 * testMB}, ""},
+	}
+	for _, test := range tests {
+		guard := testGuard()
+		guard.archiveLength = test.archiveLength
+		var err error
+		for index, entry := range test.entries {
+			if err = readGuarded(guard, entry, test.lengths[index]); err != nil {
+				break
+			}
+		}
+		if test.message == "" {
+			if err != nil {
+				t.Errorf("%s: error = %v, want nil", test.name, err)
+			}
+			continue
+		}
+		checkBombError(t, test.name, err, test.message)
+	}
+}
+
+//write the tar.gz of the files of zeros to a temp file
+func testTarGz(t *testing.T, sizes []int64) (fp *os.File, length int64) {
+	fp, err := ioutil.TempFile("", "unzip_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzWriter := gzip.NewWriter(fp)
+	tarWriter := tar.NewWriter(gzWriter)
+	for index, size := range sizes {
+		tarWriter.WriteHeader(&tar.Header{
+			Name:     strings.Repeat("a", index+1),
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     size,
+		})
+		io.Copy(tarWriter, io.LimitReader(zeroReader{}, size))
+	}
+	tarWriter.Close()
+	gzWriter.Close()
+	if length, err = fp.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+//the tar stream is read whole to list the entries, before the entries are checked
+func TestOpenTarArchiveBomb(t *testing.T) {
+	tests := []struct {
+		name    string
+		sizes   []int64
+		message string
+	}{
+		{"fits", []int64{int64(testMB), 100, 0}, ""},
+		//the zeros are compressed about 1000 times by gzip
+		{"ratio", []int64{6 * int64(testMB)}, "zip file compression ratio exceeds the limit"},
+		{"declared total", []int64{int64(testMB), 8 * int64(testMB)}, "zip total uncompressed length exceeds the limit"},
+	}
+	for _, test := range tests {
+		fp, length := testTarGz(t, test.sizes)
+		guard := testGuard()
+		guard.maxFileLength = 16 * testMB
+		guard.archiveLength = uint64(length)
+		archive, err := openArchive(context.Background(), ARCHIVE_TAR_GZ, fp, length, guard)
+		fp.Close()
+		os.Remove(fp.Name())
+		if test.message == "" {
+			if err != nil {
+				t.Errorf("%s: error = %v, want nil", test.name, err)
+			} else if len(archive.Entries()) != len(test.sizes) {
+				t.Errorf("%s: %d entries, want %d", test.name, len(archive.Entries()), len(test.sizes))
+			}
+			continue
+		}
+		checkBombError(t, test.name, err, test.message)
+	}
+}
+
+//the listing stops early, the stream is not decompressed to the end
+func TestBombStreamReader(t *testing.T) {
+	guard := testGuard()
+	guard.archiveLength = 1024
+	stream := guard.streamReader(zeroReader{})
+	read, err := io.Copy(ioutil.Discard, stream)
+	checkBombError(t, "stream", err, "zip file compression ratio exceeds the limit")
+	if limit := int64(testMB + UNZIP_TAR_END_LENGTH + UNZIP_TAR_HEADER_LENGTH + 32*1024); read > limit {
+		t.Errorf("stream read %d bytes, want at most %d", read, limit)
+	}
+
+	guard = testGuard()
+	stream = guard.streamReader(bytes.NewReader(make([]byte, 9*testMB)))
+	_, err = io.Copy(ioutil.Discard, stream)
+	checkBombError(t, "stream without archive length", err, "zip total uncompressed length exceeds the limit")
+}
@@ -0,0 +1,105 @@
+package unzip
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+//the result of unzip/list/1, what would be extracted, nothing is uploaded
+type UnzipListResult struct {
+	Entries []UnzipEntry `json:"entries"`
+	//the count and the total length of the entries to extract
+	FileCount   int    `json:"file_count"`
+	TotalLength uint64 `json:"total_length"`
+	//the limits exceeded by the whole archive, named by the config keys
+	Exceeds []string `json:"exceeds,omitempty"`
+	//the charset to decode the names without the utf8 flag
+	Encoding string `json:"encoding"`
+}
+
+type UnzipEntry struct {
+	//the decoded name
+	Name           string `json:"name"`
+	Key            string `json:"key,omitempty"`
+	Dir            bool   `json:"dir"`
+	Size           uint64 `json:"size"`
+	CompressedSize uint64 `json:"compressed_size"`
+	CRC32          string `json:"crc32,omitempty"`
+	ModTime        string `json:"mtime,omitempty"`
+	Skipped        string `json:"skipped,omitempty"`
+	Error          string `json:"error,omitempty"`
+	//the limits exceeded by the entry, named by the config keys
+	Exceeds []string `json:"exceeds,omitempty"`
+}
+
+//list the entries by the headers, the limits are checked the same way as before
+//extracting, the bytes actually read are not known without extracting
+func (this *Unzipper) list(archive archiveReader, charset string, options *UnzipOptions, filter *entryFilter,
+	archiveLength uint64) (listResult UnzipListResult) {
+	listResult.Entries = make([]UnzipEntry, 0)
+	listResult.Encoding = charset
+	keys := make(map[string]bool)
+	for _, zipFile := range archive.Entries() {
+		entry := UnzipEntry{
+			Name:           zipFile.Name,
+			Dir:            zipFile.IsDir,
+			Size:           zipFile.Size,
+			CompressedSize: zipFile.CompressedSize,
+		}
+		if zipFile.CRC32 != 0 {
+			entry.CRC32 = fmt.Sprintf("%08x", zipFile.CRC32)
+		}
+		if !zipFile.ModTime.IsZero() {
+			entry.ModTime = zipFile.ModTime.UTC().Format(time.RFC3339)
+		}
+
+		//the error which refuses the whole archive is kept in the entry
+		unzipFile, keyErr := this.entryKey(zipFile, charset, options, filter)
+		if unzipFile.Name != "" {
+			entry.Name = unzipFile.Name
+		}
+		if keyErr != nil {
+			entry.Error = keyErr.Error()
+		} else if !zipFile.IsDir {
+			skipDuplicate(&unzipFile, keys)
+			entry.Key = unzipFile.Key
+			entry.Skipped = unzipFile.Skipped
+			entry.Error = unzipFile.Error
+		}
+
+		if !zipFile.IsDir && entry.Key != "" {
+			listResult.FileCount += 1
+			listResult.TotalLength += zipFile.Size
+			entry.Exceeds = this.entryExceeds(zipFile)
+		}
+		listResult.Entries = append(listResult.Entries, entry)
+	}
+
+	if listResult.FileCount > this.maxFileCount {
+		listResult.Exceeds = append(listResult.Exceeds, "unzip_max_file_count")
+	}
+	if listResult.TotalLength > this.maxTotalLength {
+		listResult.Exceeds = append(listResult.Exceeds, "unzip_max_total_length")
+	}
+	//the ratio of the whole archive, like the tar.gz
+	if archiveLength > 0 && listResult.TotalLength > UNZIP_RATIO_CHECK_LENGTH &&
+		listResult.TotalLength/archiveLength > this.maxCompressionRatio {
+		listResult.Exceeds = append(listResult.Exceeds, "unzip_max_compression_ratio")
+	}
+	return
+}
+
+func (this *Unzipper) entryExceeds(zipFile archiveEntry) (exceeds []string) {
+	if zipFile.Size > this.maxFileLength {
+		exceeds = append(exceeds, "unzip_max_file_length")
+	}
+	if zipFile.CompressedSize > 0 && zipFile.Size > UNZIP_RATIO_CHECK_LENGTH &&
+		zipFile.Size/zipFile.CompressedSize > this.maxCompressionRatio {
+		exceeds = append(exceeds, "unzip_max_compression_ratio")
+	}
+	if len(strings.Split(strings.Trim(zipFile.Name, "/"), "/")) > this.maxNestingDepth {
+		exceeds = append(exceeds, "unzip_max_nesting_depth")
+	}
+	return
+}
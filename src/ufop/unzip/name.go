@@ -0,0 +1,106 @@
+package unzip
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"ufop/utils"
+	"unicode"
+	"unicode/utf8"
+)
+
+//how the entry names which may escape the prefix are handled
+const (
+	//the archive is refused when any entry name is not clean
+	NAME_POLICY_REJECT = "reject"
+	//the bad parts of the entry name are removed
+	NAME_POLICY_SANITIZE = "sanitize"
+	//only the sanitized base name of the entry is kept
+	NAME_POLICY_FLATTEN = "flatten"
+)
+
+var namePolicies = map[string]bool{
+	NAME_POLICY_REJECT:   true,
+	NAME_POLICY_SANITIZE: true,
+	NAME_POLICY_FLATTEN:  true,
+}
+
+//the charset of the entry names is detected when not specified
+const NAME_ENCODING_AUTO = "auto"
+
+//the charset to decode the names without the utf8 flag, it is detected over all
+//the names of the archive, which is far more reliable than name by name
+func nameCharset(entries []archiveEntry, encoding string) string {
+	if encoding != NAME_ENCODING_AUTO {
+		return encoding
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.UTF8 {
+			names = append(names, entry.Name)
+		}
+	}
+	return utils.DetectCharset(names)
+}
+
+//the names with the utf8 flag are always utf8, the others are decoded by the charset
+//specified, or by the charset detected if they are not valid utf8, since many tools
+//write the utf8 names without the flag
+func decodeName(entry archiveEntry, charset, encoding string) (name string, err error) {
+	switch {
+	case entry.UTF8:
+		name, err = utils.DecodeString(entry.Name, utils.CHARSET_UTF8)
+	case encoding == NAME_ENCODING_AUTO && utf8.ValidString(entry.Name):
+		name = entry.Name
+	default:
+		name, err = utils.DecodeString(entry.Name, charset)
+	}
+	return
+}
+
+//normalize the entry name to a relative path with "/" separators, the backslashes,
+//control characters, drive letters, empty, "." and ".." segments are removed
+func normalizeName(name, policy string) (normName string, err error) {
+	cleanName := strings.Map(func(r rune) rune {
+		if r == '\\' {
+			return '/'
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+
+	//the windows drive letter like C:
+	if len(cleanName) >= 2 && cleanName[1] == ':' &&
+		(cleanName[0] >= 'a' && cleanName[0] <= 'z' || cleanName[0] >= 'A' && cleanName[0] <= 'Z') {
+		cleanName = cleanName[2:]
+	}
+
+	segments := make([]string, 0)
+	for _, segment := range strings.Split(cleanName, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	normName = strings.Join(segments, "/")
+
+	switch policy {
+	case NAME_POLICY_REJECT:
+		//the trailing slash of the directory is fine
+		if normName != strings.TrimSuffix(name, "/") {
+			err = errors.New(fmt.Sprintf("unsafe file name %q", name))
+			return
+		}
+	case NAME_POLICY_FLATTEN:
+		if len(segments) > 0 {
+			normName = segments[len(segments)-1]
+		}
+	}
+
+	if normName == "" {
+		err = errors.New(fmt.Sprintf("empty file name of %q after normalized", name))
+	}
+	return
+}
@@ -0,0 +1,68 @@
+package unzip
+
+import (
+	"testing"
+)
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		//empty when the name is refused
+		normName string
+	}{
+		{"a/b/c.txt", NAME_POLICY_SANITIZE, "a/b/c.txt"},
+		{"a/b/c.txt", NAME_POLICY_REJECT, "a/b/c.txt"},
+		{"a/b/c.txt", NAME_POLICY_FLATTEN, "c.txt"},
+		{"a/b/", NAME_POLICY_REJECT, "a/b"},
+
+		//zip slip
+		{"../../etc/passwd", NAME_POLICY_SANITIZE, "etc/passwd"},
+		{"a/../../b.txt", NAME_POLICY_SANITIZE, "a/b.txt"},
+		{"../../etc/passwd", NAME_POLICY_REJECT, ""},
+		{"../../etc/passwd", NAME_POLICY_FLATTEN, "passwd"},
+		{"/etc/passwd", NAME_POLICY_SANITIZE, "etc/passwd"},
+		{"/etc/passwd", NAME_POLICY_REJECT, ""},
+		{"./a//b.txt", NAME_POLICY_SANITIZE, "a/b.txt"},
+		{"./a//b.txt", NAME_POLICY_REJECT, ""},
+
+		//windows paths
+		{`C:\Windows\system.ini`, NAME_POLICY_SANITIZE, "Windows/system.ini"},
+		{`c:..\a.txt`, NAME_POLICY_SANITIZE, "a.txt"},
+		{`a\b.txt`, NAME_POLICY_SANITIZE, "a/b.txt"},
+		{`C:\Windows\system.ini`, NAME_POLICY_REJECT, ""},
+		{`a\b.txt`, NAME_POLICY_REJECT, ""},
+		{`\\server\share\a.txt`, NAME_POLICY_FLATTEN, "a.txt"},
+
+		//control characters
+		{"a\x00b\r\n.txt", NAME_POLICY_SANITIZE, "ab.txt"},
+		{"a/\x1bb.txt", NAME_POLICY_SANITIZE, "a/b.txt"},
+		{"a\x7f.txt", NAME_POLICY_SANITIZE, "a.txt"},
+		{"a\u0085.txt", NAME_POLICY_SANITIZE, "a.txt"},
+		{"a\x00b.txt", NAME_POLICY_REJECT, ""},
+
+		//nothing left
+		{"../..", NAME_POLICY_SANITIZE, ""},
+		{"/", NAME_POLICY_FLATTEN, ""},
+		{"\x00", NAME_POLICY_SANITIZE, ""},
+		{"C:", NAME_POLICY_SANITIZE, ""},
+
+		//not the drive letter
+		{"1:a.txt", NAME_POLICY_SANITIZE, "1:a.txt"},
+		{"中文/名字.txt", NAME_POLICY_REJECT, "中文/名字.txt"},
+	}
+	for _, test := range tests {
+		normName, err := normalizeName(test.name, test.policy)
+		if test.normName == "" {
+			if err == nil {
+				t.Errorf("normalizeName(%q, %s) = %q, want error", test.name, test.policy, normName)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("normalizeName(%q, %s) error, %s", test.name, test.policy, err)
+		} else if normName != test.normName {
+			t.Errorf("normalizeName(%q, %s) = %q, want %q", test.name, test.policy, normName, test.normName)
+		}
+	}
+}
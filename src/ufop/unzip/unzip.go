@@ -1,30 +1,28 @@
 package unzip
 
 import (
-	"archive/zip"
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/qiniu/api.v6/auth/digest"
 	"github.com/qiniu/api.v6/conf"
-	fio "github.com/qiniu/api.v6/io"
 	rio "github.com/qiniu/api.v6/resumable/io"
-	"github.com/qiniu/api.v6/rs"
+	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
-	"regexp"
-	"strconv"
+	"path"
 	"ufop"
+	"ufop/cmdspec"
 	"ufop/utils"
-	"unicode/utf8"
 )
 
 const (
 	UNZIP_MAX_ZIP_FILE_LENGTH uint64 = 1 * 1024 * 1024 * 1024
 	UNZIP_MAX_FILE_LENGTH     uint64 = 100 * 1024 * 1024 //100MB
 	UNZIP_MAX_FILE_COUNT      int    = 10                //10
+	//larger entries are uploaded by the resumable put
+	UNZIP_RPUT_THRESHOLD uint64 = 100 * 1024 * 1024
 )
 
 type UnzipResult struct {
@@ -32,9 +30,13 @@ type UnzipResult struct {
 }
 
 type UnzipFile struct {
+	//the original entry name in the archive
+	Name  string `json:"name"`
 	Key   string `json:"key"`
 	Hash  string `json:"hash,omitempty"`
 	Error string `json:"error,omitempty"`
+	//the reason when the entry is not extracted
+	Skipped string `json:"skipped,omitempty"`
 }
 
 type Unzipper struct {
@@ -42,6 +44,30 @@ type Unzipper struct {
 	maxZipFileLength uint64
 	maxFileLength    uint64
 	maxFileCount     int
+	namePolicy       string
+
+	maxTotalLength      uint64
+	maxCompressionRatio uint64
+	maxNestingDepth     int
+
+	uploadWorkers int
+	uploadRetries int
+}
+
+type UnzipOptions struct {
+	Bucket     string `cmd:"bucket"`
+	Prefix     string `cmd:"prefix"`
+	Overwrite  bool   `cmd:"overwrite"`
+	Include    string `cmd:"include"`
+	Exclude    string `cmd:"exclude"`
+	Flatten    bool   `cmd:"flatten"`
+	SkipHidden bool   `cmd:"skip-hidden"`
+	//fail_fast or best_effort
+	UploadPolicy string `cmd:"upload-policy"`
+	//list the entries only
+	List bool `cmd:"list"`
+	//the charset of the entry names, auto by default
+	Encoding string `cmd:"encoding"`
 }
 
 type UnzipperConfig struct {
@@ -52,6 +78,16 @@ type UnzipperConfig struct {
 	UnzipMaxZipFileLength uint64 `json:"unzip_max_zip_file_length,omitempty"`
 	UnzipMaxFileLength    uint64 `json:"unzip_max_file_length,omitempty"`
 	UnzipMaxFileCount     int    `json:"unzip_max_file_count,omitempty"`
+	//reject, sanitize or flatten, default sanitize
+	UnzipNamePolicy string `json:"unzip_name_policy,omitempty"`
+
+	//the zip bomb limits, checked on the bytes actually read
+	UnzipMaxTotalLength      uint64 `json:"unzip_max_total_length,omitempty"`
+	UnzipMaxCompressionRatio uint64 `json:"unzip_max_compression_ratio,omitempty"`
+	UnzipMaxNestingDepth     int    `json:"unzip_max_nesting_depth,omitempty"`
+
+	UnzipUploadWorkers int `json:"unzip_upload_workers,omitempty"`
+	UnzipUploadRetries int `json:"unzip_upload_retries,omitempty"`
 }
 
 func (this *Unzipper) Name() string {
@@ -91,114 +127,221 @@ func (this *Unzipper) InitConfig(jobConf string) (err error) {
 		this.maxZipFileLength = config.UnzipMaxZipFileLength
 	}
 
+	if config.UnzipMaxTotalLength <= 0 {
+		this.maxTotalLength = UNZIP_MAX_TOTAL_LENGTH
+	} else {
+		this.maxTotalLength = config.UnzipMaxTotalLength
+	}
+
+	if config.UnzipMaxCompressionRatio <= 0 {
+		this.maxCompressionRatio = UNZIP_MAX_COMPRESSION_RATIO
+	} else {
+		this.maxCompressionRatio = config.UnzipMaxCompressionRatio
+	}
+
+	if config.UnzipMaxNestingDepth <= 0 {
+		this.maxNestingDepth = UNZIP_MAX_NESTING_DEPTH
+	} else {
+		this.maxNestingDepth = config.UnzipMaxNestingDepth
+	}
+
+	if config.UnzipUploadWorkers <= 0 {
+		this.uploadWorkers = UNZIP_UPLOAD_WORKERS
+	} else {
+		this.uploadWorkers = config.UnzipUploadWorkers
+	}
+
+	//0 is no retry
+	if config.UnzipUploadRetries < 0 {
+		this.uploadRetries = 0
+	} else if config.UnzipUploadRetries == 0 {
+		this.uploadRetries = UNZIP_UPLOAD_RETRIES
+	} else {
+		this.uploadRetries = config.UnzipUploadRetries
+	}
+
+	if config.UnzipNamePolicy == "" {
+		this.namePolicy = NAME_POLICY_SANITIZE
+	} else if namePolicies[config.UnzipNamePolicy] {
+		this.namePolicy = config.UnzipNamePolicy
+	} else {
+		err = errors.New(fmt.Sprintf("Invalid unzip name policy '%s'", config.UnzipNamePolicy))
+		return
+	}
+
 	this.mac = &digest.Mac{config.AccessKey, []byte(config.SecretKey)}
 
 	return
 }
 
-/*
+func (this *Unzipper) Syntax() string {
+	return unzipSpec.Syntax()
+}
 
+func (this *Unzipper) Limits() map[string]interface{} {
+	return map[string]interface{}{
+		"unzip_max_zip_file_length":   this.maxZipFileLength,
+		"unzip_max_file_length":       this.maxFileLength,
+		"unzip_max_file_count":        this.maxFileCount,
+		"unzip_name_policy":           this.namePolicy,
+		"unzip_max_total_length":      this.maxTotalLength,
+		"unzip_max_compression_ratio": this.maxCompressionRatio,
+		"unzip_max_nesting_depth":     this.maxNestingDepth,
+		"unzip_upload_workers":        this.uploadWorkers,
+		"unzip_upload_retries":        this.uploadRetries,
+	}
+}
+
+//7z and xz are used for the 7z and tar.xz archives
+func (this *Unzipper) CheckReady() error {
+	return utils.CheckCommands("7z", "xz")
+}
+
+/*
 unzip/bucket/<encoded bucket>/prefix/<encoded prefix>/overwrite/<[0|1]>
+/include/<encoded globs>/exclude/<encoded globs>/flatten/<[0|1]>/skip-hidden/<[0|1]>
+/upload-policy/<fail_fast|best_effort>/encoding/<auto|utf8|gbk|big5|shiftjis|euckr|cp437>
+
+unzip/list/1
 
+list the entries without extracting, the bucket is not required
 */
-func (this *Unzipper) parse(cmd string) (bucket string, prefix string, overwrite bool, err error) {
-	pattern := "^unzip/bucket/[0-9a-zA-Z-_=]+(/prefix/[0-9a-zA-Z-_=]+){0,1}(/overwrite/(0|1)){0,1}$"
-	matched, _ := regexp.MatchString(pattern, cmd)
-	if !matched {
-		err = errors.New("invalid unzip command format")
-		return
-	}
+var unzipSpec = cmdspec.Spec{
+	Name: "unzip",
+	Params: []cmdspec.Param{
+		//required when not listing
+		{Name: "bucket", Type: cmdspec.PARAM_BASE64},
+		{Name: "prefix", Type: cmdspec.PARAM_BASE64},
+		{Name: "overwrite", Type: cmdspec.PARAM_BOOL},
+		{Name: "include", Type: cmdspec.PARAM_BASE64},
+		{Name: "exclude", Type: cmdspec.PARAM_BASE64},
+		{Name: "flatten", Type: cmdspec.PARAM_BOOL},
+		{Name: "skip-hidden", Type: cmdspec.PARAM_BOOL},
+		{Name: "list", Type: cmdspec.PARAM_BOOL},
+		{Name: "upload-policy", Type: cmdspec.PARAM_ENUM, Values: []string{UPLOAD_FAIL_FAST, UPLOAD_BEST_EFFORT}, Default: UPLOAD_BEST_EFFORT},
+		{Name: "encoding", Type: cmdspec.PARAM_ENUM, Values: append([]string{NAME_ENCODING_AUTO}, utils.Charsets...), Default: NAME_ENCODING_AUTO},
+	},
+}
 
-	var decodeErr error
-	bucket, decodeErr = utils.GetParamDecoded(cmd, "bucket/[0-9a-zA-Z-_=]+", "bucket")
-	if decodeErr != nil {
-		err = errors.New("invalid unzip parameter 'bucket'")
-		return
-	}
-	prefix, decodeErr = utils.GetParamDecoded(cmd, "prefix/[0-9a-zA-Z-_=]+", "prefix")
-	if decodeErr != nil {
-		err = errors.New("invalid unzip parameter 'prefix'")
+func (this *Unzipper) parse(cmd string) (options *UnzipOptions, err error) {
+	options = &UnzipOptions{}
+	if err = unzipSpec.Parse(cmd, options); err != nil {
 		return
 	}
-	overwriteStr := utils.GetParam(cmd, "overwrite/(0|1)", "overwrite")
-	if overwriteStr != "" {
-		overwriteVal, paramErr := strconv.ParseInt(overwriteStr, 10, 64)
-		if paramErr != nil {
-			err = errors.New("invalid unzip parameter 'overwrite'")
-			return
-		}
-		if overwriteVal == 1 {
-			overwrite = true
-		}
+
+	if !options.List && options.Bucket == "" {
+		err = ufop.NewUfopError(ufop.E_BAD_PARAM, "invalid unzip command format, missing parameter 'bucket'").
+			WithDetail("reason", "missing parameter 'bucket'")
 	}
 	return
 }
 
-func (this *Unzipper) Do(req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
+func (this *Unzipper) DoContext(ctx context.Context, req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
 	//parse command
-	bucket, prefix, overwrite, pErr := this.parse(req.Cmd)
+	options, pErr := this.parse(req.Cmd)
 	if pErr != nil {
 		err = pErr
 		return
 	}
+	filter, fErr := newEntryFilter(options)
+	if fErr != nil {
+		err = fErr
+		return
+	}
 
-	//check mimetype
-	if req.Src.MimeType != "application/zip" {
-		err = errors.New("unsupported mimetype to unzip")
+	//check mimetype, the archive type is detected later by the magic bytes
+	if _, ok := archiveMimeTypes[req.Src.MimeType]; !ok {
+		err = ufop.NewUfopError(ufop.E_SRC_UNSUPPORTED, "unsupported mimetype to unzip")
 		return
 	}
 	//check zip file length
 	if req.Src.Fsize > this.maxZipFileLength {
-		err = errors.New("src zip file length exceeds the limit")
+		err = ufop.NewUfopError(ufop.E_SRC_TOO_LARGE, "src zip file length exceeds the limit").
+			WithDetail("limit", this.maxZipFileLength)
 		return
 	}
 
-	//get resource
-	resUrl := req.Src.Url
-	resResp, respErr := http.Get(resUrl)
-	if respErr != nil || resResp.StatusCode != 200 {
-		if respErr != nil {
-			err = errors.New(fmt.Sprintf("retrieve resource data failed, %s", respErr.Error()))
-		} else {
-			err = errors.New(fmt.Sprintf("retrieve resource data failed, %s", resResp.Status))
-			if resResp.Body != nil {
-				resResp.Body.Close()
-			}
-		}
+	//spool the zip file to local disk, zip needs random access to read the entries
+	zipFp, zipFileLength, spoolErr := this.spool(ctx, req.Src.Url)
+	if spoolErr != nil {
+		err = spoolErr
 		return
 	}
-	defer resResp.Body.Close()
-
-	respData, readErr := ioutil.ReadAll(resResp.Body)
-	if readErr != nil {
-		err = errors.New(fmt.Sprintf("read resource data failed, %s", readErr.Error()))
+	defer func() {
+		zipFp.Close()
+		os.Remove(zipFp.Name())
+	}()
+
+	//read archive
+	archiveType, detectErr := detectArchiveType(zipFp, req.Src.MimeType)
+	if detectErr != nil {
+		err = ufop.NewUfopError(ufop.E_SRC_UNSUPPORTED, fmt.Sprintf("unsupported archive to unzip, %s", detectErr.Error()))
 		return
 	}
-
-	//read zip
-	respReader := bytes.NewReader(respData)
-	zipReader, zipErr := zip.NewReader(respReader, int64(respReader.Len()))
-	if zipErr != nil {
-		err = errors.New(fmt.Sprintf("invalid zip file, %s", zipErr.Error()))
+	//the lengths in the headers are checked first, then the bytes read, the tar
+	//is limited by the guard even when its entries are listed
+	guard := &bombGuard{
+		maxTotalLength:      this.maxTotalLength,
+		maxFileLength:       this.maxFileLength,
+		maxCompressionRatio: this.maxCompressionRatio,
+		archiveLength:       uint64(zipFileLength),
+	}
+	archive, archiveErr := openArchive(ctx, archiveType, zipFp, zipFileLength, guard)
+	if archiveErr != nil {
+		err = archiveError(archiveErr)
 		return
 	}
-	zipFiles := zipReader.File
+	defer archive.Close()
+	charset := nameCharset(archive.Entries(), options.Encoding)
+
+	//dry run
+	if options.List {
+		result = this.list(archive, charset, options, filter, uint64(zipFileLength))
+		resultType = ufop.RESULT_TYPE_JSON
+		contentType = ufop.CONTENT_TYPE_JSON
+		return
+	}
+
+	//only the selected entries are checked, the first entry of the same key is
+	//extracted in the archive order, the later ones are skipped as duplicate
+	zipFiles := make([]archiveEntry, 0)
+	keys := make(map[string]bool)
+	for _, zipFile := range archive.Entries() {
+		if zipFile.IsDir {
+			continue
+		}
+		unzipFile, keyErr := this.entryKey(zipFile, charset, options, filter)
+		if keyErr != nil {
+			err = keyErr
+			return
+		}
+		if unzipFile.Key != "" && !keys[unzipFile.Key] {
+			keys[unzipFile.Key] = true
+			zipFiles = append(zipFiles, zipFile)
+		}
+	}
 	//check file count
 	zipFileCount := len(zipFiles)
 	if zipFileCount > this.maxFileCount {
-		err = errors.New("zip files count exceeds the limit")
+		err = ufop.NewUfopError(ufop.E_LIMIT_EXCEEDED, "zip files count exceeds the limit").
+			WithDetail("limit", this.maxFileCount)
 		return
 	}
 	//check file size
 	for _, zipFile := range zipFiles {
-		fileSize := zipFile.UncompressedSize64
+		fileSize := zipFile.Size
 		//check file size
 		if fileSize > this.maxFileLength {
-			err = errors.New("zip file length exceeds the limit")
+			err = ufop.NewUfopError(ufop.E_LIMIT_EXCEEDED, "zip file length exceeds the limit").
+				WithDetail("limit", this.maxFileLength)
 			return
 		}
 	}
 
+	if err = guard.checkEntries(zipFiles, this.maxNestingDepth); err != nil {
+		return
+	}
+
 	//set up host
 	conf.UP_HOST = "http://up.qiniu.com"
 	rputSettings := rio.Settings{
@@ -206,78 +349,181 @@ func (this *Unzipper) Do(req ufop.UfopRequest) (result interface{}, resultType i
 		Workers:   1,
 	}
 	rio.SetSettings(&rputSettings)
-	var rputThreshold uint64 = 100 * 1024 * 1024
-	policy := rs.PutPolicy{
-		Scope: bucket,
-	}
-	var unzipResult UnzipResult
-	unzipResult.Files = make([]UnzipFile, 0)
-	var tErr error
-	//iterate the zip file
-	for _, zipFile := range zipFiles {
-		fileInfo := zipFile.FileHeader.FileInfo()
-		fileName := zipFile.FileHeader.Name
-		fileSize := zipFile.UncompressedSize64
-
-		if !utf8.Valid([]byte(fileName)) {
-			fileName, tErr = utils.Gbk2Utf8(fileName)
-			if tErr != nil {
-				err = errors.New(fmt.Sprintf("unsupported file name encoding, %s", tErr.Error()))
-				return
-			}
+	up := newUploader(ctx, this.mac, options.Bucket, options.Overwrite,
+		this.uploadWorkers, this.uploadRetries, options.UploadPolicy == UPLOAD_FAIL_FAST, len(zipFiles))
+	//the results are filled by the upload workers
+	unzipFiles := make([]*UnzipFile, 0)
+	walkKeys := make(map[string]bool)
+	//iterate the archive
+	walkErr := archive.Walk(ctx, func(zipFile archiveEntry, reader io.Reader) (err error) {
+		if zipFile.IsDir {
+			return
 		}
 
-		if fileInfo.IsDir() {
-			continue
+		unzipFile, keyErr := this.entryKey(zipFile, charset, options, filter)
+		if keyErr != nil {
+			err = keyErr
+			return
 		}
-
-		zipFileReader, zipErr := zipFile.Open()
-		if zipErr != nil {
-			err = errors.New(fmt.Sprintf("open zip file content failed, %s", zipErr.Error()))
+		skipDuplicate(&unzipFile, walkKeys)
+		unzipFiles = append(unzipFiles, &unzipFile)
+		//skipped or bad name
+		if unzipFile.Key == "" {
 			return
 		}
-		defer zipFileReader.Close()
 
-		unzipData, unzipErr := ioutil.ReadAll(zipFileReader)
-		if unzipErr != nil {
-			err = errors.New(fmt.Sprintf("unzip the file content failed, %s", unzipErr.Error()))
+		//save file to bucket, the ufop error is returned when the archive is
+		//broken or the upload fails in the fail_fast mode
+		err = up.submit(&unzipFile, guard.reader(zipFile, reader))
+		return
+	})
+	//the temp files are removed by the workers
+	upErr := up.wait()
+	if walkErr != nil {
+		err = archiveError(walkErr)
+		return
+	}
+	if upErr != nil {
+		err = upErr
+		return
+	}
+
+	var unzipResult UnzipResult
+	unzipResult.Files = make([]UnzipFile, 0, len(unzipFiles))
+	for _, unzipFile := range unzipFiles {
+		unzipResult.Files = append(unzipResult.Files, *unzipFile)
+	}
+
+	//write result
+	result = unzipResult
+	resultType = ufop.RESULT_TYPE_JSON
+	contentType = ufop.CONTENT_TYPE_JSON
+
+	return
+}
+
+//the key of the entry under the prefix, the key is empty when the entry is
+//skipped or the name is bad, the error is returned when the archive is refused
+func (this *Unzipper) entryKey(zipFile archiveEntry, charset string, options *UnzipOptions,
+	filter *entryFilter) (unzipFile UnzipFile, err error) {
+	fileName, tErr := decodeName(zipFile, charset, options.Encoding)
+	if tErr != nil {
+		err = ufop.NewUfopError(ufop.E_SRC_INVALID, fmt.Sprintf("unsupported file name encoding, %s", tErr.Error())).
+			WithDetail("encoding", charset)
+		return
+	}
+	unzipFile.Name = fileName
+
+	//keep the key under the prefix
+	normName, nErr := normalizeName(fileName, this.namePolicy)
+	if nErr != nil {
+		if this.namePolicy == NAME_POLICY_REJECT {
+			err = ufop.NewUfopError(ufop.E_SRC_INVALID, fmt.Sprintf("zip file name rejected, %s", nErr.Error())).
+				WithDetail("name", fileName)
 			return
 		}
-		unzipReader := bytes.NewReader(unzipData)
+		unzipFile.Error = nErr.Error()
+		return
+	}
 
-		//save file to bucket
-		fileName = prefix + fileName
-		if overwrite {
-			policy.Scope = bucket + ":" + fileName
-		}
-		uptoken := policy.Token(this.mac)
-		var unzipFile UnzipFile
-		unzipFile.Key = fileName
-		if fileSize <= rputThreshold {
-			var fputRet fio.PutRet
-			fErr := fio.Put(nil, &fputRet, uptoken, fileName, unzipReader, nil)
-			if fErr != nil {
-				unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", fErr.Error())
-			} else {
-				unzipFile.Hash = fputRet.Hash
-			}
+	if unzipFile.Skipped = filter.skip(normName); unzipFile.Skipped != "" {
+		return
+	}
+
+	if options.Flatten {
+		normName = path.Base(normName)
+	}
+	unzipFile.Key = options.Prefix + normName
+	return
+}
 
+//the entry is skipped when its key is taken by an earlier entry, so the parallel
+//uploads never write the same key
+func skipDuplicate(unzipFile *UnzipFile, keys map[string]bool) {
+	if unzipFile.Key == "" {
+		return
+	}
+	if keys[unzipFile.Key] {
+		unzipFile.Key = ""
+		unzipFile.Skipped = SKIP_DUPLICATE
+		return
+	}
+	keys[unzipFile.Key] = true
+}
+
+//download the zip file to a temp file, at most maxZipFileLength bytes are read
+//whatever the fsize of the src says
+func (this *Unzipper) spool(ctx context.Context, resUrl string) (zipFp *os.File, zipFileLength int64, err error) {
+	resResp, respErr := utils.HttpGet(ctx, resUrl)
+	if respErr != nil || resResp.StatusCode != 200 {
+		if respErr != nil {
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("retrieve resource data failed, %s", respErr.Error()))
 		} else {
-			var rputRet rio.PutRet
-			rErr := rio.Put(nil, &rputRet, uptoken, fileName, unzipReader, int64(fileSize), nil)
-			if rErr != nil {
-				unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", rErr.Error())
-			} else {
-				unzipFile.Hash = rputRet.Hash
+			err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("retrieve resource data failed, %s", resResp.Status))
+			if resResp.Body != nil {
+				resResp.Body.Close()
 			}
 		}
-		unzipResult.Files = append(unzipResult.Files, unzipFile)
+		return
 	}
+	defer resResp.Body.Close()
 
-	//write result
-	result = unzipResult
-	resultType = ufop.RESULT_TYPE_JSON
-	contentType = ufop.CONTENT_TYPE_JSON
+	tmpFp, tmpErr := ioutil.TempFile("", "unzip_src_")
+	if tmpErr != nil {
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("create zip temp file failed, %s", tmpErr.Error()))
+		return
+	}
 
+	limit := int64(this.maxZipFileLength)
+	written, cpErr := io.Copy(tmpFp, io.LimitReader(resResp.Body, limit+1))
+	if cpErr != nil {
+		err = ufop.NewUfopError(ufop.E_UPSTREAM_FETCH, fmt.Sprintf("read resource data failed, %s", cpErr.Error()))
+	} else if written > limit {
+		err = ufop.NewUfopError(ufop.E_SRC_TOO_LARGE, "src zip file length exceeds the limit").
+			WithDetail("limit", this.maxZipFileLength)
+	}
+	if err != nil {
+		tmpFp.Close()
+		os.Remove(tmpFp.Name())
+		return
+	}
+
+	zipFp = tmpFp
+	zipFileLength = written
 	return
 }
+
+//keep the read error of the zip entry, to tell it from the upload error
+type entryErrorReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (this *entryErrorReader) Read(p []byte) (n int, err error) {
+	n, err = this.reader.Read(p)
+	if err != nil && err != io.EOF {
+		this.err = err
+	}
+	return
+}
+
+//the limits exceeded while reading are kept
+func (this *entryErrorReader) readError() error {
+	if _, ok := this.err.(*ufop.UfopError); ok {
+		return this.err
+	}
+	return ufop.NewUfopError(ufop.E_SRC_INVALID, fmt.Sprintf("unzip the file content failed, %s", this.err.Error()))
+}
+
+//the errors of reading the archive, the ufop errors from the walk func are kept
+func archiveError(err error) error {
+	switch err.(type) {
+	case *ufop.UfopError:
+		return err
+	}
+	switch err {
+	case context.Canceled, context.DeadlineExceeded:
+		return ufop.NewUfopError(ufop.E_CANCELLED, fmt.Sprintf("unzip cancelled, %s", err.Error()))
+	}
+	return ufop.NewUfopError(ufop.E_SRC_INVALID, err.Error())
+}
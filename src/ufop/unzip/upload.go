@@ -0,0 +1,225 @@
+package unzip
+
+import (
+	"context"
+	"fmt"
+	"github.com/qiniu/api.v6/auth/digest"
+	fio "github.com/qiniu/api.v6/io"
+	rio "github.com/qiniu/api.v6/resumable/io"
+	"github.com/qiniu/api.v6/rs"
+	"github.com/qiniu/rpc"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+	"ufop"
+	"ufop/utils"
+)
+
+const (
+	UNZIP_UPLOAD_WORKERS int = 4
+	UNZIP_UPLOAD_RETRIES int = 3
+	//the first retry waits so long, and doubled for each retry
+	UNZIP_UPLOAD_RETRY_DELAY     = 500 * time.Millisecond
+	UNZIP_UPLOAD_RETRY_MAX_DELAY = 8 * time.Second
+)
+
+//what to do when a file fails to upload after the retries
+const (
+	//stop the job and return the error
+	UPLOAD_FAIL_FAST = "fail_fast"
+	//keep the error in the result of the file and go on
+	UPLOAD_BEST_EFFORT = "best_effort"
+)
+
+//upload the extracted files by a pool of workers, the files are submitted in the
+//order of the archive and the result of each file is kept at its own place, so the
+//result order never depends on which upload finishes first
+type uploader struct {
+	mac       *digest.Mac
+	bucket    string
+	overwrite bool
+	retries   int
+	failFast  bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	slots  chan bool
+	wg     sync.WaitGroup
+
+	lock sync.Mutex
+	err  error
+	//the files uploaded or failed of all the files to upload, for the progress
+	done  int
+	total int
+}
+
+func newUploader(ctx context.Context, mac *digest.Mac, bucket string, overwrite bool,
+	workers, retries int, failFast bool, total int) *uploader {
+	upCtx, cancel := context.WithCancel(ctx)
+	return &uploader{
+		mac:       mac,
+		bucket:    bucket,
+		overwrite: overwrite,
+		retries:   retries,
+		failFast:  failFast,
+		ctx:       upCtx,
+		cancel:    cancel,
+		slots:     make(chan bool, workers),
+		total:     total,
+	}
+}
+
+//the first upload error in the fail_fast mode
+func (this *uploader) failed() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.err
+}
+
+//spool the entry to a temp file, which can be read again by the retries, then
+//upload it by a free worker, it blocks when all the workers are busy
+func (this *uploader) submit(unzipFile *UnzipFile, reader io.Reader) (err error) {
+	select {
+	case this.slots <- true:
+	case <-this.ctx.Done():
+		if err = this.failed(); err == nil {
+			err = this.ctx.Err()
+		}
+		return
+	}
+
+	filePath, fileSize, spoolErr := spoolEntry(reader)
+	if spoolErr != nil {
+		<-this.slots
+		err = spoolErr
+		return
+	}
+
+	this.wg.Add(1)
+	go func() {
+		defer func() {
+			os.Remove(filePath)
+			this.lock.Lock()
+			this.done += 1
+			done := this.done
+			this.lock.Unlock()
+			utils.ObserveProgress(this.ctx, done, this.total)
+			<-this.slots
+			this.wg.Done()
+		}()
+
+		hash, attempts, putErr := this.put(unzipFile.Key, filePath, fileSize)
+		if putErr == nil {
+			unzipFile.Hash = hash
+			return
+		}
+
+		unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", putErr.Error())
+		if this.failFast {
+			this.lock.Lock()
+			if this.err == nil {
+				this.err = ufop.NewUfopError(ufop.E_UPSTREAM_STORAGE, unzipFile.Error).
+					WithDetail("key", unzipFile.Key).
+					WithDetail("attempts", attempts)
+			}
+			this.lock.Unlock()
+			this.cancel()
+		}
+	}()
+	return
+}
+
+//wait for the uploads, the error is set in the fail_fast mode
+func (this *uploader) wait() error {
+	this.wg.Wait()
+	this.cancel()
+	return this.failed()
+}
+
+//upload with retries, the delay is doubled for each retry
+func (this *uploader) put(key, filePath string, fileSize int64) (hash string, attempts int, err error) {
+	putPolicy := rs.PutPolicy{
+		Scope: this.bucket,
+	}
+	if this.overwrite {
+		putPolicy.Scope = this.bucket + ":" + key
+	}
+
+	delay := UNZIP_UPLOAD_RETRY_DELAY
+	for {
+		attempts += 1
+		//the token is made for each attempt, it may expire in the long retries
+		hash, err = putFile(putPolicy.Token(this.mac), key, filePath, fileSize)
+		if err == nil || attempts > this.retries || !retryable(err) {
+			return
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-this.ctx.Done():
+			return
+		}
+		delay *= 2
+		if delay > UNZIP_UPLOAD_RETRY_MAX_DELAY {
+			delay = UNZIP_UPLOAD_RETRY_MAX_DELAY
+		}
+	}
+}
+
+func putFile(uptoken, key, filePath string, fileSize int64) (hash string, err error) {
+	if uint64(fileSize) <= UNZIP_RPUT_THRESHOLD {
+		var fputRet fio.PutRet
+		if err = fio.PutFile(nil, &fputRet, uptoken, key, filePath, nil); err != nil {
+			return
+		}
+		hash = fputRet.Hash
+		return
+	}
+
+	var rputRet rio.PutRet
+	if err = rio.PutFile(nil, &rputRet, uptoken, key, filePath, nil); err != nil {
+		return
+	}
+	hash = rputRet.Hash
+	return
+}
+
+//the network errors and the server errors are retried, the errors like file exists
+//or bad token fail the same way again
+func retryable(err error) bool {
+	if respErr, ok := err.(*rpc.ErrorInfo); ok {
+		//579 is the callback failure, the file is saved already
+		return respErr.Code >= 500 && respErr.Code != 579
+	}
+	return true
+}
+
+//save the entry to a temp file, the ufop error is returned when the entry is broken
+func spoolEntry(reader io.Reader) (filePath string, fileSize int64, err error) {
+	//the reader fails when the data is corrupted or longer than the header says
+	entryReader := &entryErrorReader{reader: reader}
+
+	entryFp, tmpErr := ioutil.TempFile("", "unzip_entry_")
+	if tmpErr != nil {
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("create entry temp file failed, %s", tmpErr.Error()))
+		return
+	}
+	defer entryFp.Close()
+
+	written, cpErr := io.Copy(entryFp, entryReader)
+	if entryReader.err != nil {
+		err = entryReader.readError()
+	} else if cpErr != nil {
+		err = ufop.NewUfopError(ufop.E_INTERNAL, fmt.Sprintf("save entry temp file failed, %s", cpErr.Error()))
+	}
+	if err != nil {
+		os.Remove(entryFp.Name())
+		return
+	}
+
+	filePath = entryFp.Name()
+	fileSize = written
+	return
+}
@@ -1,7 +1,17 @@
 package utils
 
 import (
+	"errors"
+	"fmt"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
 	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 var gbkDecoder = simplifiedchinese.GBK.NewDecoder()
@@ -38,3 +48,181 @@ func Utf82Gbk(text string) (string, error) {
 	}
 	return string(gbkBytes), nil
 }
+
+//the charsets of the file names in the archives
+const (
+	CHARSET_UTF8      = "utf8"
+	CHARSET_GBK       = "gbk"
+	CHARSET_BIG5      = "big5"
+	CHARSET_SHIFT_JIS = "shiftjis"
+	CHARSET_EUC_KR    = "euckr"
+	CHARSET_CP437     = "cp437"
+)
+
+var Charsets = []string{CHARSET_UTF8, CHARSET_GBK, CHARSET_BIG5, CHARSET_SHIFT_JIS, CHARSET_EUC_KR, CHARSET_CP437}
+
+var charsetEncodings = map[string]encoding.Encoding{
+	CHARSET_GBK:       simplifiedchinese.GBK,
+	CHARSET_BIG5:      traditionalchinese.Big5,
+	CHARSET_SHIFT_JIS: japanese.ShiftJIS,
+	CHARSET_EUC_KR:    korean.EUCKR,
+	CHARSET_CP437:     charmap.CodePage437,
+}
+
+//the charsets tried by the detection in order, the former wins on the same score,
+//cp437 is tried at last since any bytes are valid cp437
+var detectCharsets = []string{CHARSET_GBK, CHARSET_BIG5, CHARSET_SHIFT_JIS, CHARSET_EUC_KR}
+
+//the frequently used characters of each language, including the words often seen in
+//the file names, the text decoded by the wrong charset hits few of them
+var commonChars = map[string]string{
+	CHARSET_GBK: "的一是不了在人有我他这个们中来上大为和国地到以说时要就出会可也你对生能而子那得于着下自之年过发后作里用道" +
+		"行所然家种事成方多经么去法学如都同现当没动面起看定天分还进好小部其些主样理心她本前开但因只从想实日新文件图片" +
+		"资料照表报告数据视频音乐档案合同项目设计方案培训课程模板备份工作总结申请通知会议记录简历附录目录",
+	CHARSET_BIG5: "的一是不了在人有我他這個們中來上大為和國地到以說時要就出會可也你對生能而子那得於著下自之年過發後作裡用道" +
+		"行所然家種事成方多經麼去法學如都同現當沒動面起看定天分還進好小部其些主樣理心她本前開但因只從想實日新文件圖片" +
+		"資料照表報告數據視頻音樂檔案合同項目設計方案培訓課程模板備份工作總結申請通知會議記錄簡歷附錄目錄",
+	CHARSET_SHIFT_JIS: "日一国人年大十二本中長出三時行見月後前生五間上東四今金九入学高円子外八六下来気小七山話女北午百書先名川千" +
+		"水半男西電校語土木聞食車何南万毎白天母火右読友左休父雨写真資料画像動会社新文件報告表会議録仕様設計見積請求",
+	CHARSET_EUC_KR: "이다의는에가을하고서지기로사한대정자리수일아시도인전상라제어보게있나해부구문화장스과적주성소국계것들진경모" +
+		"신내를마우연공동비관방위그중은요조면유명분무개미영원선학회여세물생행실결트드터파료진본사업계획서회의록",
+}
+
+var commonCharSets = make(map[string]map[rune]bool)
+
+var halfwidthKana = &unicode.RangeTable{
+	R16: []unicode.Range16{{Lo: 0xff61, Hi: 0xff9f, Stride: 1}},
+}
+
+func init() {
+	for charset, chars := range commonChars {
+		charSet := make(map[rune]bool)
+		for _, char := range chars {
+			charSet[char] = true
+		}
+		commonCharSets[charset] = charSet
+	}
+}
+
+//decode the text in the charset to utf8, the error is returned when the text
+//has bytes invalid in the charset
+func DecodeString(text, charset string) (utf8Text string, err error) {
+	if charset == CHARSET_UTF8 {
+		if !utf8.ValidString(text) {
+			err = errors.New("invalid utf8 text")
+			return
+		}
+		utf8Text = text
+		return
+	}
+
+	enc, ok := charsetEncodings[charset]
+	if !ok {
+		err = errors.New(fmt.Sprintf("unsupported charset '%s'", charset))
+		return
+	}
+	utf8Text, err = enc.NewDecoder().String(text)
+	if err != nil {
+		return
+	}
+	//the invalid bytes are decoded as the replacement char
+	if strings.ContainsRune(utf8Text, utf8.RuneError) && !strings.Contains(text, string(utf8.RuneError)) {
+		err = errors.New(fmt.Sprintf("invalid %s text", charset))
+	}
+	return
+}
+
+//encode the utf8 text to the charset, the error is returned when some chars
+//are not in the charset
+func EncodeString(utf8Text, charset string) (text string, err error) {
+	if charset == CHARSET_UTF8 {
+		text = utf8Text
+		return
+	}
+
+	enc, ok := charsetEncodings[charset]
+	if !ok {
+		err = errors.New(fmt.Sprintf("unsupported charset '%s'", charset))
+		return
+	}
+	text, err = enc.NewEncoder().String(utf8Text)
+	return
+}
+
+//detect the charset of the texts together, like all the names of an archive, more
+//texts make a better guess, utf8 is returned when all the texts are valid utf8
+func DetectCharset(texts []string) (charset string) {
+	nonUtf8Texts := make([]string, 0)
+	for _, text := range texts {
+		if !utf8.ValidString(text) {
+			nonUtf8Texts = append(nonUtf8Texts, text)
+		}
+	}
+	if len(nonUtf8Texts) == 0 {
+		return CHARSET_UTF8
+	}
+
+	var bestScore float64
+	var firstValid string
+	for _, candidate := range detectCharsets {
+		score, valid := charsetScore(nonUtf8Texts, candidate)
+		if !valid {
+			continue
+		}
+		if firstValid == "" {
+			firstValid = candidate
+		}
+		if score > bestScore {
+			charset = candidate
+			bestScore = score
+		}
+	}
+	if charset != "" {
+		return
+	}
+
+	//the accented letters of the western names are decoded as the rare chars by
+	//the cjk charsets, but all as the letters by cp437, the cjk names are mostly
+	//decoded as the symbols by cp437
+	if score, _ := charsetScore(nonUtf8Texts, CHARSET_CP437); score == 1 || firstValid == "" {
+		charset = CHARSET_CP437
+		return
+	}
+	//the first valid charset is kept when no one hits the common chars
+	charset = firstValid
+	return
+}
+
+//the ratio of the common chars in the non-ascii chars decoded
+func charsetScore(texts []string, charset string) (score float64, valid bool) {
+	charSet := commonCharSets[charset]
+	var total, common int
+	for _, text := range texts {
+		utf8Text, err := DecodeString(text, charset)
+		if err != nil {
+			return
+		}
+		for _, char := range utf8Text {
+			if char < utf8.RuneSelf {
+				continue
+			}
+			total += 1
+			if charSet[char] {
+				common += 1
+			} else if charset == CHARSET_SHIFT_JIS && unicode.In(char, unicode.Hiragana, unicode.Katakana) &&
+				!unicode.In(char, halfwidthKana) {
+				//the kana is seldom decoded from the other charsets, except the halfwidth ones
+				common += 1
+			} else if charset == CHARSET_CP437 && unicode.In(char, unicode.Latin) {
+				//the accented letters, the other charsets decoded as cp437 are mostly symbols
+				common += 1
+			}
+		}
+	}
+
+	valid = true
+	if total > 0 {
+		score = float64(common) / float64(total)
+	}
+	return
+}
@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"testing"
+)
+
+//the names of the archives made by the tools of each language, encoded in the charset
+var detectCharsetTests = []struct {
+	charset string
+	names   []string
+}{
+	{CHARSET_GBK, []string{"工作总结/2015年工作总结.docx", "照片/上海外滩.jpg", "会议记录.txt", "简历.pdf"}},
+	{CHARSET_GBK, []string{"新建文件夹/"}},
+	{CHARSET_BIG5, []string{"工作總結/2015年工作總結.docx", "照片/台北101.jpg", "會議記錄.txt", "簡歷.pdf"}},
+	{CHARSET_BIG5, []string{"資料/報告.doc"}},
+	{CHARSET_SHIFT_JIS, []string{"資料/会議録.xlsx", "写真/東京タワー.jpg", "見積書.pdf", "ﾃｽﾄ.txt"}},
+	{CHARSET_SHIFT_JIS, []string{"新しいフォルダー/画像.png"}},
+	{CHARSET_EUC_KR, []string{"회의록/2015년 회의록.hwp", "사진/서울.jpg", "사업계획서.docx"}},
+	{CHARSET_EUC_KR, []string{"새 폴더/문서.txt"}},
+	{CHARSET_CP437, []string{"Résumé.docx", "Café/Menü.pdf", "naïve.txt", "Ångström.csv"}},
+	{CHARSET_CP437, []string{"Über uns/Straße.txt"}},
+}
+
+func TestDetectCharset(t *testing.T) {
+	for _, test := range detectCharsetTests {
+		encodedNames := make([]string, 0, len(test.names))
+		for _, name := range test.names {
+			encodedName, err := EncodeString(name, test.charset)
+			if err != nil {
+				t.Fatalf("encode %q to %s error, %s", name, test.charset, err)
+			}
+			encodedNames = append(encodedNames, encodedName)
+		}
+
+		charset := DetectCharset(encodedNames)
+		if charset != test.charset {
+			t.Errorf("DetectCharset(%q) = %s, want %s", test.names, charset, test.charset)
+			continue
+		}
+		for index, encodedName := range encodedNames {
+			name, err := DecodeString(encodedName, charset)
+			if err != nil {
+				t.Errorf("decode %q from %s error, %s", test.names[index], charset, err)
+			} else if name != test.names[index] {
+				t.Errorf("decode %q from %s = %q", test.names[index], charset, name)
+			}
+		}
+	}
+}
+
+func TestDetectCharsetUtf8(t *testing.T) {
+	tests := [][]string{
+		{},
+		{"a.txt", "b/c.jpg"},
+		{"工作总结.docx", "Résumé.docx", "사진.jpg"},
+	}
+	for _, names := range tests {
+		if charset := DetectCharset(names); charset != CHARSET_UTF8 {
+			t.Errorf("DetectCharset(%q) = %s, want %s", names, charset, CHARSET_UTF8)
+		}
+	}
+}
+
+func TestDecodeStringInvalid(t *testing.T) {
+	tests := []struct {
+		text    string
+		charset string
+	}{
+		{"\xff\xfe", CHARSET_UTF8},
+		{"\x81", CHARSET_GBK},
+		{"a.txt", "latin1"},
+	}
+	for _, test := range tests {
+		if _, err := DecodeString(test.text, test.charset); err == nil {
+			t.Errorf("DecodeString(%q, %s) should fail", test.text, test.charset)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+//observe the resource usage of a job, carried by the context
+type JobObserver interface {
+	ObserveDownload(n int64)
+	ObserveExec(command string, duration time.Duration)
+}
+
+type observerKey struct{}
+
+func WithObserver(ctx context.Context, observer JobObserver) context.Context {
+	return context.WithValue(ctx, observerKey{}, observer)
+}
+
+func observerFrom(ctx context.Context) JobObserver {
+	if observer, ok := ctx.Value(observerKey{}).(JobObserver); ok {
+		return observer
+	}
+	return nil
+}
+
+//report the runtime of an external command like ffmpeg
+func ObserveExec(ctx context.Context, command string, duration time.Duration) {
+	if observer := observerFrom(ctx); observer != nil {
+		observer.ObserveExec(command, duration)
+	}
+}
+
+//observe the progress of an async job, kept apart from the JobObserver which is
+//set again for each fop of the pipeline
+type ProgressObserver interface {
+	ObserveProgress(done, total int)
+}
+
+type progressKey struct{}
+
+func WithProgressObserver(ctx context.Context, observer ProgressObserver) context.Context {
+	return context.WithValue(ctx, progressKey{}, observer)
+}
+
+//report the progress of the job, like the entries uploaded of all the entries
+func ObserveProgress(ctx context.Context, done, total int) {
+	if observer, ok := ctx.Value(progressKey{}).(ProgressObserver); ok && total > 0 {
+		observer.ObserveProgress(done, total)
+	}
+}
+
+//count the bytes read from the body
+type countingReadCloser struct {
+	io.ReadCloser
+	observer JobObserver
+}
+
+func (this *countingReadCloser) Read(p []byte) (n int, err error) {
+	n, err = this.ReadCloser.Read(p)
+	if n > 0 {
+		this.observer.ObserveDownload(int64(n))
+	}
+	return
+}
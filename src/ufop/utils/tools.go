@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
@@ -8,6 +9,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"os/exec"
 )
 
 func Md5Hex(str string) string {
@@ -16,8 +18,24 @@ func Md5Hex(str string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-func Download(remoteUrl, localPath string) (contentType string, err error) {
-	resp, respErr := http.Get(remoteUrl)
+//get the remote resource, the request is cancelled with the ctx
+func HttpGet(ctx context.Context, remoteUrl string) (resp *http.Response, err error) {
+	req, reqErr := http.NewRequest("GET", remoteUrl, nil)
+	if reqErr != nil {
+		err = reqErr
+		return
+	}
+	resp, err = http.DefaultClient.Do(req.WithContext(ctx))
+	if err == nil {
+		if observer := observerFrom(ctx); observer != nil {
+			resp.Body = &countingReadCloser{resp.Body, observer}
+		}
+	}
+	return
+}
+
+func Download(ctx context.Context, remoteUrl, localPath string) (contentType string, err error) {
+	resp, respErr := HttpGet(ctx, remoteUrl)
 	if respErr != nil || resp.StatusCode != http.StatusOK {
 		if respErr != nil {
 			err = errors.New(fmt.Sprintf("get resource by url '%s' failed, %s", remoteUrl, respErr.Error()))
@@ -51,6 +69,17 @@ func Download(remoteUrl, localPath string) (contentType string, err error) {
 	return
 }
 
+//check the external programs can be found in the PATH
+func CheckCommands(names ...string) (err error) {
+	for _, name := range names {
+		if _, lookErr := exec.LookPath(name); lookErr != nil {
+			err = errors.New(fmt.Sprintf("command '%s' not available, %s", name, lookErr.Error()))
+			return
+		}
+	}
+	return
+}
+
 func MaxInt(array ...int) int {
 	max := array[0]
 	for _, val := range array {